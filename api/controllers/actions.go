@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+func (s *SocketServer) registerBuiltinActions() {
+	s.RegisterAction(Action{
+		Name:       "hello",
+		NewPayload: func() Payload { return &types.HelloData{} },
+		Required:   []string{"versions"},
+		RateLimit:  RateLimit{PerSecond: 0.5, Burst: 3},
+		NoAck:      true,
+		Handler:    s.handleHello,
+	})
+
+	s.RegisterAction(Action{
+		Name:       "create_room",
+		NewPayload: func() Payload { return &types.CreateRoomRequest{} },
+		Required:   []string{"email", "video_source", "timestamp"},
+		RateLimit:  RateLimit{PerSecond: 0.2, Burst: 2},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			room, err := s.CreateRoom(ctx.Conn, *ctx.Payload.(*types.CreateRoomRequest))
+			if err != nil {
+				return nil, types.WrapSocketError(types.ErrorCodeFor(err), fmt.Sprintf("Failed to create room: %v", err), err)
+			}
+			s.sendRoomState(ctx, room)
+			if err := s.sendSession(ctx, room.ID.String(), room.CreatedBy); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"room_id": room.ID.String(), "room": room}, nil
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "join_room",
+		NewPayload: func() Payload { return &types.JoinRoomData{} },
+		Required:   []string{"room_id", "email"},
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			data := ctx.Payload.(*types.JoinRoomData)
+			room, err := s.handleJoinRoom(ctx.Conn, *data)
+			if err != nil {
+				return nil, err
+			}
+			s.sendRoomState(ctx, room)
+			if err := s.sendSession(ctx, data.RoomID, data.Email); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"room_id": room.ID.String(), "room": room}, nil
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "subscribe_room",
+		NewPayload: func() Payload { return &types.SubscribeRoomData{} },
+		Required:   []string{"room_id"},
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Handler:    s.handleSubscribeRoom,
+	})
+
+	s.RegisterAction(Action{
+		Name:       "unsubscribe_room",
+		NewPayload: func() Payload { return &types.SubscribeRoomData{} },
+		Required:   []string{"room_id"},
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Handler:    s.handleUnsubscribeRoom,
+	})
+
+	s.RegisterAction(Action{
+		Name:       "resume",
+		NewPayload: func() Payload { return &types.ResumeData{} },
+		Required:   []string{"room_id", "email", "resume_token"},
+		RateLimit:  RateLimit{PerSecond: 0.5, Burst: 3},
+		NoAck:      true,
+		Handler:    s.handleResume,
+	})
+
+	s.RegisterAction(Action{
+		Name:       "leave_room",
+		NewPayload: func() Payload { return &types.LeaveRoomData{} },
+		Required:   []string{"room_id", "email"},
+		Role:       RoleSelf,
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			data := ctx.Payload.(*types.LeaveRoomData)
+			if err := s.handleLeaveRoom(ctx.Conn, data.RoomID, data.Email); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"room_id": data.RoomID}, nil
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "ping",
+		NewPayload: func() Payload { return &types.PingData{} },
+		Required:   []string{"email"},
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			s.handlePing(ctx.Payload.(*types.PingData).Email)
+			return map[string]interface{}{"server_time": time.Now()}, nil
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "player_state",
+		NewPayload: func() Payload { return &types.PlayerStateData{} },
+		Required:   []string{"room_id", "email", "paused"},
+		Role:       RoleMember,
+		RateLimit:  RateLimit{PerSecond: 4, Burst: 8},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			return nil, s.handlePlayerState(ctx.Conn, *ctx.Payload.(*types.PlayerStateData))
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "update_timestamp",
+		NewPayload: func() Payload { return &types.VideoSyncData{} },
+		Required:   []string{"room_id", "email", "timestamp", "seeking"},
+		Role:       RoleMember,
+		RateLimit:  RateLimit{PerSecond: 5, Burst: 10},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			return nil, s.handleVideoSync(ctx.Conn, *ctx.Payload.(*types.VideoSyncData))
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "chat_message",
+		NewPayload: func() Payload { return &types.ChatMessageData{} },
+		Required:   []string{"room_id", "email", "message"},
+		Role:       RoleMember,
+		RateLimit:  RateLimit{PerSecond: 2, Burst: 5},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			seq, err := s.handleChatMessage(ctx.Conn, *ctx.Payload.(*types.ChatMessageData))
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"seq": seq}, nil
+		},
+	})
+
+	for _, name := range []string{"typing_start", "typing_stop"} {
+		typing := name == "typing_start"
+		s.RegisterAction(Action{
+			Name:       name,
+			NewPayload: func() Payload { return &types.TypingData{} },
+			Required:   []string{"room_id", "email"},
+			Role:       RoleMember,
+			RateLimit:  RateLimit{PerSecond: 4, Burst: 8},
+			Handler: func(ctx *ActionContext) (interface{}, error) {
+				return nil, s.handleTyping(ctx.Conn, *ctx.Payload.(*types.TypingData), typing)
+			},
+		})
+	}
+
+	s.RegisterAction(Action{
+		Name:       "chat_read",
+		NewPayload: func() Payload { return &types.ChatReadData{} },
+		Required:   []string{"room_id", "email", "seq"},
+		Role:       RoleMember,
+		RateLimit:  RateLimit{PerSecond: 4, Burst: 8},
+		Handler: func(ctx *ActionContext) (interface{}, error) {
+			data := ctx.Payload.(*types.ChatReadData)
+			if err := s.handleChatRead(ctx.Conn, *data); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"seq": data.Seq}, nil
+		},
+	})
+
+	s.RegisterAction(Action{
+		Name:       "room_sync",
+		NewPayload: func() Payload { return &types.RoomSyncData{} },
+		Required:   []string{"room_id", "email"},
+		Role:       RoleMember,
+		RateLimit:  RateLimit{PerSecond: 1, Burst: 3},
+		Versions:   []int{deltaProtocolVersion},
+		NoAck:      true,
+		Handler:    s.handleRoomSync,
+	})
+}
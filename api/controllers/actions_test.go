@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// TestActionsForAnotherPeerAreRefused sends the in-room actions on behalf of
+// another peer of the room. The connection only acts as the peer it joined
+// as, so each is refused.
+func TestActionsForAnotherPeerAreRefused(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, url)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	stranger := dialTestClient(t, url)
+
+	actions := map[string]map[string]interface{}{
+		"leave_room":       {},
+		"player_state":     {"paused": true},
+		"update_timestamp": {"timestamp": 10, "seeking": true},
+		"chat_message":     {"message": "hi"},
+		"typing_start":     {},
+		"typing_stop":      {},
+		"chat_read":        {"seq": 1},
+	}
+	for name, c := range map[string]*testClient{"peer": b, "stranger": stranger} {
+		for action, data := range actions {
+			data["room_id"], data["email"] = roomID, "a@example.com"
+			c.send(action, action, data)
+			msg := c.expectMatch("error", func(m testMessage) bool { return m.RequestID == action })
+			if msg.Data["code"] != string(types.CodeNotAuthorized) {
+				t.Fatalf("%s sent %s for another peer and got %v, want %s", name, action, msg.Data["code"], types.CodeNotAuthorized)
+			}
+		}
+	}
+
+	room, _ := s.loadRoom(roomID)
+	if _, err := room.GetPeer("a@example.com"); err != nil {
+		t.Fatalf("a@example.com was removed from the room: %v", err)
+	}
+}
@@ -60,3 +60,25 @@ func (c *AuthController) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return &user, nil
 	})
 }
+
+// authenticate returns the user a REST request authenticates as with HTTP
+// basic auth, the email and password of the user.
+func authenticate(store storage.Storage, r *http.Request) (*types.User, error) {
+	email, password, ok := r.BasicAuth()
+	if !ok || email == "" {
+		return nil, utils.NewHTTPError("Authentication required", http.StatusUnauthorized)
+	}
+	val := store.Get("user:" + email)
+	if val == "" {
+		return nil, utils.NewHTTPError("Invalid credentials", http.StatusUnauthorized)
+	}
+	var user types.User
+	if err := json.Unmarshal([]byte(val), &user); err != nil {
+		fmt.Printf("Error in unmarshalling user data: %v\n", err)
+		return nil, utils.NewHTTPError("Invalid user data", http.StatusInternalServerError)
+	}
+	if user.Password != password {
+		return nil, utils.NewHTTPError("Invalid credentials", http.StatusUnauthorized)
+	}
+	return &user, nil
+}
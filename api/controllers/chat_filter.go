@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+const defaultChatMaxLength = 2000
+
+var (
+	// linkPattern matches URLs, www. links, IPv4 addresses and bare host
+	// names like example.com/path. The host of an email address is no link.
+	linkPattern = regexp.MustCompile(`(?i)(?:^|[^\w@.-])(` +
+		`(?:https?://|www\.)\S+|` +
+		`(?:\d{1,3}\.){3}\d{1,3}(?:[:/?#]\S*)?|` +
+		`(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9](?:[:/?#]\S*)?)`)
+	mentionPattern = regexp.MustCompile(`(?:^|\s)@([\w.+-]+(?:@[\w.-]+)?)`)
+)
+
+// ChatFilter inspects and may rewrite a chat message before it is broadcast.
+// Returning an error rejects the message and the error is reported to the
+// sender.
+type ChatFilter interface {
+	Apply(room *types.Room, msg *types.ChatMessageData) error
+}
+
+type ChatFilterFunc func(room *types.Room, msg *types.ChatMessageData) error
+
+func (f ChatFilterFunc) Apply(room *types.Room, msg *types.ChatMessageData) error {
+	return f(room, msg)
+}
+
+// NewChatFilters builds the filter pipeline described by a policy.
+func NewChatFilters(policy types.ChatPolicy) []ChatFilter {
+	var filters []ChatFilter
+	if policy.MaxLength > 0 {
+		filters = append(filters, maxLengthFilter(policy.MaxLength))
+	}
+	if len(policy.BlockedWords) > 0 {
+		filters = append(filters, blocklistFilter(policy.BlockedWords))
+	}
+	if policy.DisableLinks || len(policy.AllowedDomains) > 0 || len(policy.DeniedDomains) > 0 {
+		filters = append(filters, linkPolicyFilter(policy))
+	}
+	return filters
+}
+
+// UseChatFilter appends a server-wide filter that runs after the configured
+// policy filters and before the per-room ones.
+func (s *SocketServer) UseChatFilter(f ChatFilter) {
+	s.chatFilters = append(s.chatFilters, f)
+}
+
+func (s *SocketServer) filterChatMessage(room *types.Room, msg *types.ChatMessageData) error {
+	for _, f := range s.chatFilters {
+		if err := f.Apply(room, msg); err != nil {
+			return err
+		}
+	}
+	for _, f := range s.roomChatFilters(room) {
+		if err := f.Apply(room, msg); err != nil {
+			return err
+		}
+	}
+	return parseMentions(room, msg)
+}
+
+// roomChatPolicy is the filter pipeline built from the chat policy of a room.
+type roomChatPolicy struct {
+	policy  *types.ChatPolicy
+	filters []ChatFilter
+}
+
+// roomChatFilters returns the pipeline of the chat policy of the room, built
+// once per policy the room is given.
+func (s *SocketServer) roomChatFilters(room *types.Room) []ChatFilter {
+	policy := room.GetChatPolicy()
+	if policy == nil {
+		return nil
+	}
+	roomID := room.ID.String()
+	if val, ok := s.chatPolicies.Load(roomID); ok && val.(*roomChatPolicy).policy == policy {
+		return val.(*roomChatPolicy).filters
+	}
+	compiled := &roomChatPolicy{policy: policy, filters: NewChatFilters(*policy)}
+	s.chatPolicies.Store(roomID, compiled)
+	return compiled.filters
+}
+
+func maxLengthFilter(max int) ChatFilter {
+	return ChatFilterFunc(func(_ *types.Room, msg *types.ChatMessageData) error {
+		if utf8.RuneCountInString(msg.Message) > max {
+			return types.ErrMessageTooLong
+		}
+		return nil
+	})
+}
+
+func blocklistFilter(words []string) ChatFilter {
+	blocked := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			blocked[w] = struct{}{}
+		}
+	}
+	return ChatFilterFunc(func(_ *types.Room, msg *types.ChatMessageData) error {
+		words := strings.FieldsFunc(strings.ToLower(msg.Message), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			if _, ok := blocked[w]; ok {
+				return types.ErrBlockedWord
+			}
+		}
+		return nil
+	})
+}
+
+func linkPolicyFilter(policy types.ChatPolicy) ChatFilter {
+	return ChatFilterFunc(func(_ *types.Room, msg *types.ChatMessageData) error {
+		for _, match := range linkPattern.FindAllStringSubmatch(msg.Message, -1) {
+			link := match[1]
+			if policy.DisableLinks {
+				return types.ErrLinkNotAllowed
+			}
+			if !strings.Contains(link, "://") {
+				link = "http://" + link
+			}
+			u, err := url.Parse(link)
+			if err != nil || u.Hostname() == "" {
+				return types.ErrLinkNotAllowed
+			}
+			host := strings.ToLower(u.Hostname())
+			if matchesDomain(host, policy.DeniedDomains) {
+				return types.ErrLinkNotAllowed
+			}
+			if len(policy.AllowedDomains) > 0 && !matchesDomain(host, policy.AllowedDomains) {
+				return types.ErrLinkNotAllowed
+			}
+		}
+		return nil
+	})
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "."))
+		if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMentions resolves @name and @email tokens against the peers of the
+// room and records the mentioned emails on the message.
+func parseMentions(room *types.Room, msg *types.ChatMessageData) error {
+	msg.Mentions = nil
+	seen := make(map[string]struct{})
+	for _, match := range mentionPattern.FindAllStringSubmatch(msg.Message, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], ".,"))
+		room.ForEachPeer(func(email string, _ *types.Peer) bool {
+			local := strings.ToLower(strings.Split(email, "@")[0])
+			if name == strings.ToLower(email) || name == local {
+				if _, ok := seen[email]; !ok {
+					seen[email] = struct{}{}
+					msg.Mentions = append(msg.Mentions, email)
+				}
+				return false
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+func loadChatPolicyFromEnv() types.ChatPolicy {
+	policy := types.ChatPolicy{
+		MaxLength:      defaultChatMaxLength,
+		BlockedWords:   splitEnvList("CHAT_BLOCKED_WORDS"),
+		AllowedDomains: splitEnvList("CHAT_ALLOWED_DOMAINS"),
+		DeniedDomains:  splitEnvList("CHAT_DENIED_DOMAINS"),
+		DisableLinks:   os.Getenv("CHAT_DISABLE_LINKS") == "true",
+	}
+	if v, err := strconv.Atoi(os.Getenv("CHAT_MAX_LENGTH")); err == nil && v > 0 {
+		policy.MaxLength = v
+	}
+	return policy
+}
+
+func splitEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
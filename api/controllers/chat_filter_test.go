@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+func applyChatFilters(filters []ChatFilter, message string) error {
+	msg := &types.ChatMessageData{Message: message}
+	for _, f := range filters {
+		if err := f.Apply(nil, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLinkPolicyFilter(t *testing.T) {
+	noLinks := NewChatFilters(types.ChatPolicy{DisableLinks: true})
+	denied := NewChatFilters(types.ChatPolicy{DeniedDomains: []string{"evil.com"}})
+	allowed := NewChatFilters(types.ChatPolicy{AllowedDomains: []string{"example.org"}})
+
+	tests := []struct {
+		name    string
+		filters []ChatFilter
+		message string
+		blocked bool
+	}{
+		{"plain text", noLinks, "see you at 8. bring snacks", false},
+		{"email", noLinks, "mail me at bob@evil.com", false},
+		{"mention", noLinks, "@bob@evil.com look", false},
+		{"url", noLinks, "https://example.org/watch", true},
+		{"www", noLinks, "www.example.org", true},
+		{"bare host", noLinks, "go to evil.com/x now", true},
+		{"bare host at start", noLinks, "evil.com", true},
+		{"bare host with port", noLinks, "evil.com:8080", true},
+		{"ip address", noLinks, "try 10.0.0.1/admin", true},
+		{"denied url", denied, "http://evil.com", true},
+		{"denied bare host", denied, "look: evil.com/x", true},
+		{"denied subdomain", denied, "cdn.EVIL.com/x", true},
+		{"other bare host", denied, "example.org/x", false},
+		{"allowed bare host", allowed, "example.org/x", false},
+		{"not allowed bare host", allowed, "example.org and evil.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyChatFilters(tt.filters, tt.message)
+			if tt.blocked && !errors.Is(err, types.ErrLinkNotAllowed) {
+				t.Fatalf("%q: got %v, want ErrLinkNotAllowed", tt.message, err)
+			}
+			if !tt.blocked && err != nil {
+				t.Fatalf("%q: got %v, want nil", tt.message, err)
+			}
+		})
+	}
+}
+
+func TestRoomJSONHidesChatPolicy(t *testing.T) {
+	room := types.NewRoom(uuid.New(), "a@example.com", "video", types.TimeStamp{})
+	room.ChatPolicy = &types.ChatPolicy{BlockedWords: []string{"secretword"}}
+
+	data, err := json.Marshal(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secretword") {
+		t.Fatalf("room JSON leaks the chat policy: %s", data)
+	}
+}
+
+func TestRoomPatchHidesChatPolicy(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	c := dialTestClient(t, url, "goparty.v2")
+	roomID := c.createTestRoom("a@example.com")
+
+	room, ok := s.loadRoom(roomID)
+	if !ok {
+		t.Fatal("room not found")
+	}
+	policy := &types.ChatPolicy{BlockedWords: []string{"secretword"}}
+	if err := s.updateRoom(room, types.UpdateRoomRequest{ChatPolicy: policy}, stateReasonRequested); err != nil {
+		t.Fatal(err)
+	}
+	patch := c.expect("room_patch")
+	if strings.Contains(patch.raw, "secretword") || strings.Contains(patch.raw, "chat_policy") {
+		t.Fatalf("room_patch leaks the chat policy: %s", patch.raw)
+	}
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// client wraps a websocket connection so that writes coming from the read
+// loop, broadcasts and background timers never interleave on the same socket.
+type client struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	// protocol is switched by the read loop and read by broadcasts, which
+	// pick the events to send by protocol version.
+	protocol atomic.Pointer[protocol]
+	// encoding is switched by the read loop and read by every writer.
+	encoding int32
+	// compressionThreshold is the smallest message compressed when
+	// permessage-deflate was negotiated.
+	compressionThreshold int
+
+	roomsMu sync.Mutex
+	// rooms maps the IDs of the rooms the connection is subscribed to to the
+	// email it joined them as, or to "" for rooms it only observes.
+	rooms map[string]string
+}
+
+func newClient(conn *websocket.Conn, compressionThreshold int) *client {
+	p, enc := protocolForConn(conn)
+	c := &client{
+		conn:                 conn,
+		encoding:             int32(enc),
+		compressionThreshold: compressionThreshold,
+		rooms:                make(map[string]string),
+	}
+	c.setProtocol(p)
+	return c
+}
+
+func (c *client) getProtocol() *protocol {
+	return c.protocol.Load()
+}
+
+func (c *client) setProtocol(p *protocol) {
+	c.protocol.Store(p)
+}
+
+func (c *client) getEncoding() encoding {
+	return encoding(atomic.LoadInt32(&c.encoding))
+}
+
+func (c *client) setEncoding(e encoding) {
+	atomic.StoreInt32(&c.encoding, int32(e))
+}
+
+func (c *client) writeEncoded(msg *encodedMessage) error {
+	e := c.getEncoding()
+	data, err := msg.bytes(e)
+	if err != nil {
+		return err
+	}
+	return c.write(e.frameType(), data)
+}
+
+func (c *client) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.EnableWriteCompression(len(data) >= c.compressionThreshold)
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// closeConn sends a close frame with the given code. The caller stops reading
+// afterwards and handleDisconnect tears the socket down.
+func (s *SocketServer) closeConn(conn *websocket.Conn, code int, reason string) {
+	data := websocket.FormatCloseMessage(code, reason)
+	if val, ok := s.clients.Load(conn); ok {
+		val.(*client).write(websocket.CloseMessage, data)
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(writeWait))
+}
+
+func (s *SocketServer) clientFor(conn *websocket.Conn) (*client, bool) {
+	val, ok := s.clients.Load(conn)
+	if !ok {
+		return nil, false
+	}
+	return val.(*client), true
+}
+
+func (s *SocketServer) sendTo(conn *websocket.Conn, msg types.Message) error {
+	return s.writeEncoded(conn, newEncodedMessage(msg))
+}
+
+func (s *SocketServer) writeEncoded(conn *websocket.Conn, msg *encodedMessage) error {
+	if val, ok := s.clients.Load(conn); ok {
+		return val.(*client).writeEncoded(msg)
+	}
+	data, err := msg.bytes(encodingJSON)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,361 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// roomsChannel is the bus channel the nodes exchange room events on.
+const roomsChannel = "goparty:rooms"
+
+const (
+	changePeerAdded   = "peer_added"
+	changePeerUpdated = "peer_updated"
+	changePeerRemoved = "peer_removed"
+	changeRoomUpdated = "room_updated"
+	changeRSVP        = "rsvp"
+	// changePeersRequested asks the other nodes to publish the peers they
+	// hold sessions of, e.g. after a node restored the room from storage.
+	changePeersRequested = "peers_requested"
+	// changeRoomRequested asks the owner of the room for a snapshot of it,
+	// for a copy that missed changes.
+	changeRoomRequested = "room_requested"
+)
+
+// roomEvent is a broadcast travelling between nodes. It carries a message
+// for every connection of the room, a change the owner of the room made,
+// which the other nodes apply to their copy with the revision of the owner,
+// a command forwarded to the owner and the reply to it, or a snapshot of the
+// room the owner sends a node whose copy missed changes.
+type roomEvent struct {
+	Node    string          `json:"node"`
+	RoomID  string          `json:"room_id"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Change  *roomChange     `json:"change,omitempty"`
+	Command *roomCommand    `json:"command,omitempty"`
+	// Reply and Snapshot are meant for the node To only.
+	Reply    *commandReply `json:"reply,omitempty"`
+	Snapshot *roomSnapshot `json:"snapshot,omitempty"`
+	To       string        `json:"to,omitempty"`
+}
+
+// roomSnapshot is a room on its owner, encoded like storage keeps it.
+type roomSnapshot struct {
+	Fields map[string]string          `json:"fields"`
+	Peers  map[string]json.RawMessage `json:"peers"`
+}
+
+type roomChange struct {
+	Kind  string      `json:"kind"`
+	Email string      `json:"email,omitempty"`
+	Peer  *types.Peer `json:"peer,omitempty"`
+	// Update is set for room_updated.
+	Update *types.UpdateRoomRequest `json:"update,omitempty"`
+	// Going is set for rsvp.
+	Going bool `json:"going,omitempty"`
+	// Reason is set for room_updated changing the status of the room.
+	Reason string `json:"reason,omitempty"`
+	// Revision is the revision the change gave the room on its owner.
+	Revision int64 `json:"revision,omitempty"`
+	// IfEmpty makes the owner refuse the change while the room has peers.
+	IfEmpty bool `json:"if_empty,omitempty"`
+}
+
+// newBusFromEnv returns the bus selected by BROADCAST_BUS: "redis", the
+// default, or "memory" for a single node.
+func newBusFromEnv(opts storage.RedisOpts) storage.Bus {
+	if os.Getenv("BROADCAST_BUS") == "memory" {
+		return storage.NewMemoryBus()
+	}
+	return storage.NewRedisBus(opts)
+}
+
+func (s *SocketServer) publishRoomEvent(ev roomEvent) {
+	ev.Node = s.node
+	data, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("Error marshaling room event: %v\n", err)
+		return
+	}
+	if err := s.bus.Publish(roomsChannel, data); err != nil {
+		fmt.Printf("Error publishing room event: %v\n", err)
+	}
+}
+
+func (s *SocketServer) publishMessage(roomID string, msg types.Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("Error marshaling room message: %v\n", err)
+		return
+	}
+	s.publishRoomEvent(roomEvent{RoomID: roomID, Message: data})
+}
+
+func (s *SocketServer) publishRoomChange(roomID string, change roomChange) {
+	s.publishRoomEvent(roomEvent{RoomID: roomID, Change: &change})
+}
+
+// handleRoomEvent delivers an event published by another node to the
+// connections of this node.
+func (s *SocketServer) handleRoomEvent(payload []byte) {
+	var ev roomEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		fmt.Printf("Error unmarshaling room event: %v\n", err)
+		return
+	}
+	if ev.Node == s.node {
+		return
+	}
+	if ev.To != "" && ev.To != s.node {
+		return
+	}
+	if ev.Reply != nil {
+		s.handleReply(ev.Reply)
+		return
+	}
+	if _, ok := s.rooms.Load(ev.RoomID); !ok {
+		return
+	}
+
+	if ev.Message != nil {
+		s.relay.push(relayedMessage{roomID: ev.RoomID, message: ev.Message})
+		return
+	}
+	if ev.Snapshot != nil {
+		s.reloadRoom(ev.RoomID, ev.Snapshot)
+		return
+	}
+	if ev.Command != nil {
+		s.handleCommand(ev)
+		return
+	}
+	if ev.Change != nil && ev.Change.Kind == changeRoomRequested {
+		s.sendRoomSnapshot(ev.RoomID, ev.Node)
+		return
+	}
+	if ev.Change != nil && ev.Change.Kind == changePeersRequested {
+		// Syncing waits for replies, which this handler delivers.
+		go s.syncLocalPeers(ev.RoomID)
+		return
+	}
+	if ev.Change != nil {
+		s.mirrorRoomChange(ev.RoomID, ev.Change)
+	}
+}
+
+// relayedMessage is a message another node published for the connections of
+// a room.
+type relayedMessage struct {
+	roomID  string
+	message json.RawMessage
+}
+
+// relayQueue holds the messages other nodes published until they are
+// delivered to the connections of this node. Delivering waits for the locks
+// of the peers, whose holders may wait for the reply to a forwarded change,
+// so it runs on a goroutine of its own and the bus keeps bringing replies.
+type relayQueue struct {
+	mu       sync.Mutex
+	messages []relayedMessage
+	wake     chan struct{}
+}
+
+func newRelayQueue() *relayQueue {
+	return &relayQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *relayQueue) push(m relayedMessage) {
+	q.mu.Lock()
+	q.messages = append(q.messages, m)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relayMessages delivers the messages of the relay queue in the order they
+// arrived until the server shuts down.
+func (s *SocketServer) relayMessages() {
+	for {
+		select {
+		case <-s.relay.wake:
+		case <-s.shutdown:
+			return
+		}
+		s.relay.mu.Lock()
+		messages := s.relay.messages
+		s.relay.messages = nil
+		s.relay.mu.Unlock()
+
+		for _, m := range messages {
+			roomVal, ok := s.rooms.Load(m.roomID)
+			if !ok {
+				continue
+			}
+			roomVal.(*types.Room).Touch()
+			encoded := newEncodedJSON(m.message)
+			s.broadcastEncoded(m.roomID, func(*client) *encodedMessage { return encoded })
+		}
+	}
+}
+
+// syncLocalPeers tells the owner of the room, e.g. a node that restored it,
+// about the peers holding sessions on this node.
+func (s *SocketServer) syncLocalPeers(roomID string) {
+	roomVal, ok := s.rooms.Load(roomID)
+	if !ok {
+		return
+	}
+	room := roomVal.(*types.Room)
+	for email := range room.GetPeers() {
+		ps, ok := s.loadPeer(roomID, email)
+		if !ok {
+			continue
+		}
+		if len(ps.sessions) > 0 {
+			s.syncPeer(ps, room, email)
+		}
+		ps.mu.Unlock()
+	}
+}
+
+// requestRoom asks the owner of the room for a snapshot of it.
+func (s *SocketServer) requestRoom(roomID string) {
+	s.publishRoomChange(roomID, roomChange{Kind: changeRoomRequested})
+}
+
+// sendRoomSnapshot sends the room to the node that asked for it, if this
+// node owns it. It holds the lock the changes of the room are made under, so
+// the snapshot has every change published before it and none after it.
+func (s *SocketServer) sendRoomSnapshot(roomID, node string) {
+	roomVal, ok := s.rooms.Load(roomID)
+	if !ok || !s.ownsRoom(roomID) {
+		return
+	}
+	room := roomVal.(*types.Room)
+	lock := s.commandLock(roomID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, fields, err := roomFields(room)
+	if err != nil {
+		fmt.Printf("Error taking a snapshot of room %s: %v\n", roomID, err)
+		return
+	}
+	peers := make(map[string]json.RawMessage)
+	for email, peer := range room.GetPeers() {
+		data, err := json.Marshal(peer)
+		if err != nil {
+			fmt.Printf("Error taking a snapshot of room %s: %v\n", roomID, err)
+			return
+		}
+		peers[email] = data
+	}
+	s.publishRoomEvent(roomEvent{RoomID: roomID, To: node, Snapshot: &roomSnapshot{Fields: fields, Peers: peers}})
+}
+
+// reloadRoom makes the copy of this node take the snapshot the owner sent,
+// unless the copy is newer, and catches up with the changes it missed.
+func (s *SocketServer) reloadRoom(roomID string, snapshot *roomSnapshot) {
+	roomVal, ok := s.rooms.Load(roomID)
+	if !ok {
+		return
+	}
+	room := roomVal.(*types.Room)
+	from, err := decodeRoom(snapshot.Fields, snapshot.Peers)
+	if err != nil {
+		fmt.Printf("Error reloading room %s: %v\n", roomID, err)
+		return
+	}
+	if room.Reload(from) {
+		fmt.Printf("Reloaded room %s at revision %d\n", roomID, from.Revision())
+		s.reconcileRoom(room)
+	}
+}
+
+// mirrorRoomChange applies a change the owner of the room made to the copy
+// of this node, with the revision the owner gave it. Changes the copy has
+// already are skipped. The watch of the room announces it like a change made
+// here. A copy that missed changes, e.g. one restored from storage before
+// the owner stored them, asks the owner for the room, whose snapshot follows
+// the change on the bus.
+func (s *SocketServer) mirrorRoomChange(roomID string, change *roomChange) {
+	roomVal, ok := s.rooms.Load(roomID)
+	if !ok {
+		return
+	}
+	room := roomVal.(*types.Room)
+	if change.Revision > room.Revision()+1 && !s.ownsRoom(roomID) {
+		fmt.Printf("Room %s missed the changes before revision %d\n", roomID, change.Revision)
+		// The owner may be publishing the change under the lock its
+		// snapshot takes.
+		go s.requestRoom(roomID)
+	}
+	var err error
+	room.Mirror(change.Revision, func() {
+		switch change.Kind {
+		case changePeerAdded, changePeerUpdated:
+			// Whether the copy of this node has the peer or not, it
+			// takes the one of the owner.
+			if change.Peer == nil {
+				return
+			}
+			if _, err = updatePeer(room, change.Peer); errors.Is(err, types.ErrPeerNotFound) {
+				_, err = room.AddPeer(change.Peer)
+			}
+		default:
+			_, err = s.applyRoomChange(room, change)
+		}
+	})
+	if err != nil && !errors.Is(err, types.ErrPeerNotFound) {
+		fmt.Printf("Error applying %s to room %s: %v\n", change.Kind, roomID, err)
+	}
+}
+
+// applyRoomChange applies a peer or room change to the copy of this node and
+// returns the revision of the room after it.
+func (s *SocketServer) applyRoomChange(room *types.Room, change *roomChange) (int64, error) {
+	switch change.Kind {
+	case changeRoomUpdated:
+		if change.Update == nil {
+			return 0, types.NewSocketError(types.CodeInvalidPayload, "Room update is missing")
+		}
+		return s.applyRoomUpdate(room, *change.Update, change.Reason)
+	case changeRSVP:
+		return s.applyRSVP(room, change.Email, change.Going)
+	case changePeerRemoved:
+		return room.RemovePeer(change.Email)
+	}
+	if change.Peer == nil {
+		return 0, types.ErrInvalidPeer
+	}
+	switch change.Kind {
+	case changePeerAdded:
+		return room.AddPeer(change.Peer)
+	case changePeerUpdated:
+		return updatePeer(room, change.Peer)
+	}
+	return 0, fmt.Errorf("unknown room change %q", change.Kind)
+}
+
+// withRemotePeer runs fn for a peer without sessions on this node. It holds
+// the peer lock meanwhile, so no local session starts under it. fn must not
+// broadcast.
+func (s *SocketServer) withRemotePeer(roomID, email string, fn func()) bool {
+	ps := s.lockPeer(roomID, email)
+	defer ps.mu.Unlock()
+	if len(ps.sessions) > 0 {
+		return false
+	}
+	ps.removed = true
+	s.sessions.Delete(sessionKey(roomID, email))
+	fn()
+	return true
+}
@@ -0,0 +1,414 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// cutBus is the bus of a node that can be cut off the cluster, like a node
+// that died without releasing its leases.
+type cutBus struct {
+	storage.Bus
+	cut atomic.Bool
+}
+
+func (b *cutBus) Publish(channel string, payload []byte) error {
+	if b.cut.Load() {
+		return nil
+	}
+	return b.Bus.Publish(channel, payload)
+}
+
+func (b *cutBus) Subscribe(channel string, handler func([]byte)) {
+	b.Bus.Subscribe(channel, func(payload []byte) {
+		if !b.cut.Load() {
+			handler(payload)
+		}
+	})
+}
+
+// queuedBus hands every subscription its messages on a goroutine of its own,
+// in publishing order, like the Redis bus does.
+type queuedBus struct {
+	storage.Bus
+}
+
+func (b *queuedBus) Subscribe(channel string, handler func([]byte)) {
+	queue := make(chan []byte, 1<<16)
+	go func() {
+		for payload := range queue {
+			handler(payload)
+		}
+	}()
+	b.Bus.Subscribe(channel, func(payload []byte) { queue <- payload })
+}
+
+// join joins the room as email and returns the code of the error the join
+// failed with, if any.
+func (c *testClient) join(roomID, email string) string {
+	c.t.Helper()
+	c.send("join_room", "join", map[string]interface{}{"room_id": roomID, "email": email})
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatal("connection closed waiting for the join")
+			}
+			switch {
+			case msg.RequestID != "join":
+			case msg.Action == "error":
+				return msg.Data["code"].(string)
+			case msg.Action == "ack":
+				return ""
+			}
+		case <-deadline:
+			c.t.Fatal("timed out waiting for the join")
+		}
+	}
+}
+
+// TestJoinsOnTwoNodesRespectCapacity joins a room through its owner and
+// another node at once. The owner admits the peers, so the room never
+// holds more than its capacity.
+func TestJoinsOnTwoNodesRespectCapacity(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	owner, ownerURL := newTestNode(t, st, bus)
+	other, otherURL := newTestNode(t, st, bus)
+
+	roomID := dialTestClient(t, ownerURL).createTestRoom("a@example.com")
+	room, _ := owner.loadRoom(roomID)
+	capacity := int32(3)
+	if err := owner.updateRoom(room, types.UpdateRoomRequest{MaxCapacity: &capacity}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var joined, full atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		url := ownerURL
+		if i%2 == 1 {
+			url = otherURL
+		}
+		c := dialTestClient(t, url)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch code := c.join(roomID, fmt.Sprintf("p%d@example.com", i)); code {
+			case "":
+				joined.Add(1)
+			case string(types.CodeRoomFull):
+				full.Add(1)
+			default:
+				t.Errorf("join failed with %s", code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if joined.Load() != 2 || full.Load() != 4 {
+		t.Fatalf("%d joined and %d were refused, want 2 and 4", joined.Load(), full.Load())
+	}
+	copy, _ := other.loadRoom(roomID)
+	if room.PeerCount() != 3 || copy.PeerCount() != 3 {
+		t.Fatalf("owner holds %d peers and the other node %d, want 3", room.PeerCount(), copy.PeerCount())
+	}
+}
+
+// TestOwnerDeathHandsRoomOver cuts the owner of a room off the cluster.
+// Changes fail while it holds the lease and go through the node that takes
+// the room over once the lease expired.
+func TestOwnerDeathHandsRoomOver(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	ownerBus := &cutBus{Bus: bus}
+	owner, ownerURL := newTestNode(t, st, ownerBus)
+	other, otherURL := newTestNode(t, st, bus)
+
+	roomID := dialTestClient(t, ownerURL).createTestRoom("a@example.com")
+	if code := dialTestClient(t, otherURL).join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join through the other node failed with %s", code)
+	}
+	if other.ownsRoom(roomID) {
+		t.Fatal("the other node took the room while its owner was alive")
+	}
+	if st.SCard(roomPeersKey(roomID)) != 2 {
+		t.Fatalf("owner stored %v, want both peers", st.SMembers(roomPeersKey(roomID)))
+	}
+
+	ownerBus.cut.Store(true)
+	c := dialTestClient(t, otherURL)
+	if code := c.join(roomID, "c@example.com"); code != string(types.CodeInternal) {
+		t.Fatalf("join while the dead owner held the lease got %q, want %s", code, types.CodeInternal)
+	}
+	if !owner.ownsRoom(roomID) {
+		t.Fatal("the owner lost the lease")
+	}
+
+	// The lease of the dead owner expires.
+	st.ReleaseLease(roomLeaseKey(roomID), owner.node)
+	if code := c.join(roomID, "c@example.com"); code != "" {
+		t.Fatalf("join after the lease expired failed with %s", code)
+	}
+	if !other.ownsRoom(roomID) {
+		t.Fatal("the other node did not take the room over")
+	}
+	room, _ := other.loadRoom(roomID)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		peer, err := room.GetPeer("a@example.com")
+		if err == nil && peer.Status == types.PeerReconnecting && st.SCard(roomPeersKey(roomID)) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer of the dead owner is %v (%v), stored peers %v", peer, err, st.SMembers(roomPeersKey(roomID)))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestChatSeqIsClusterWide sends chat messages through two nodes at once.
+// Every message gets its own sequence number, whichever node relays it.
+func TestChatSeqIsClusterWide(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	_, firstURL := newTestNode(t, st, bus)
+	_, secondURL := newTestNode(t, st, bus)
+
+	a := dialTestClient(t, firstURL)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, secondURL)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+
+	const perClient = 5
+	seqs := make(chan int64, 2*perClient)
+	var wg sync.WaitGroup
+	for email, c := range map[string]*testClient{"a@example.com": a, "b@example.com": b} {
+		wg.Add(1)
+		go func(email string, c *testClient) {
+			defer wg.Done()
+			for i := 0; i < perClient; i++ {
+				requestID := fmt.Sprintf("chat%d", i)
+				c.send("chat_message", requestID, map[string]interface{}{"room_id": roomID, "email": email, "message": "hi"})
+				ack := c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == requestID })
+				seqs <- int64(ack.Data["result"].(map[string]interface{})["seq"].(float64))
+			}
+		}(email, c)
+	}
+	wg.Wait()
+	close(seqs)
+
+	seen := make(map[int64]bool)
+	for seq := range seqs {
+		if seen[seq] || seq < 1 || seq > 2*perClient {
+			t.Fatalf("sequence number %d handed out twice or out of range", seq)
+		}
+		seen[seq] = true
+	}
+}
+
+// TestNodesAgreeOnRevisions changes a room through its owner and another
+// node. Both copies number every change with the revision of the owner.
+func TestNodesAgreeOnRevisions(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	owner, ownerURL := newTestNode(t, st, bus)
+	other, otherURL := newTestNode(t, st, bus)
+	subprotocol := fmt.Sprintf("goparty.v%d", deltaProtocolVersion)
+
+	a := dialTestClient(t, ownerURL, subprotocol)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, otherURL, subprotocol)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	room, _ := owner.loadRoom(roomID)
+	copy, _ := other.loadRoom(roomID)
+	// The copy of the other node misses a change, like one restored from
+	// storage lagging behind the owner.
+	source := "https://videos.example.com/b.mp4"
+	if _, _, err := room.Update(types.UpdateRoomRequest{VideoSource: &source}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialTestClient(t, otherURL, subprotocol)
+	if code := c.join(roomID, "c@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	capacity := int32(5)
+	if err := other.updateRoom(copy, types.UpdateRoomRequest{MaxCapacity: &capacity}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c.send("leave_room", "leave", map[string]interface{}{"room_id": roomID, "email": "c@example.com"})
+	c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "leave" })
+
+	if room.Revision() != copy.Revision() {
+		t.Fatalf("owner is at revision %d, the other node at %d", room.Revision(), copy.Revision())
+	}
+	changes := []struct {
+		action string
+		match  func(testMessage) bool
+	}{
+		{"peer_added", func(m testMessage) bool {
+			return m.Data["peer"].(map[string]interface{})["email"] == "c@example.com"
+		}},
+		{"room_patch", func(m testMessage) bool {
+			return m.Data["patch"].(map[string]interface{})["max_capacity"] != nil
+		}},
+		{"peer_removed", func(m testMessage) bool { return m.Data["email"] == "c@example.com" }},
+	}
+	for _, change := range changes {
+		action, match := change.action, change.match
+		onOwner, onOther := a.expectMatch(action, match), b.expectMatch(action, match)
+		if onOwner.Data["revision"] != onOther.Data["revision"] {
+			t.Fatalf("%s has revision %v on the owner and %v on the other node", action, onOwner.Data["revision"], onOther.Data["revision"])
+		}
+	}
+}
+
+// TestJoinOnOtherNodeDuringChat joins a room through a node that does not
+// own it while the owner relays chat messages. Relaying them takes the locks
+// of the peers the joins hold while they wait for the owner to reply, which
+// must not keep the replies from arriving.
+func TestJoinOnOtherNodeDuringChat(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := &queuedBus{Bus: storage.NewMemoryBus()}
+	owner, ownerURL := newTestNode(t, st, bus)
+	_, otherURL := newTestNode(t, st, bus)
+
+	roomID := dialTestClient(t, ownerURL).createTestRoom("a@example.com")
+	stop := make(chan struct{})
+	chatting := make(chan struct{})
+	go func() {
+		defer close(chatting)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			chat := types.ChatMessageData{RoomID: roomID, Email: "a@example.com", Message: "hi"}
+			if _, err := owner.handleChatMessage(nil, chat); err != nil {
+				t.Errorf("chat failed: %v", err)
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-chatting
+	}()
+
+	// The second device changes a peer the other node holds already, so
+	// relaying a message waits for its lock.
+	for i := 0; i < 3; i++ {
+		email := fmt.Sprintf("p%d@example.com", i)
+		for device := 0; device < 2; device++ {
+			start := time.Now()
+			if code := dialTestClient(t, otherURL).join(roomID, email); code != "" {
+				t.Fatalf("join of %s on device %d failed with %s after %v", email, device, code, time.Since(start))
+			}
+		}
+	}
+}
+
+// TestCopyReloadsAfterMissingChanges cuts a node off while the owner of a
+// room changes it. The next change tells the node that its copy missed
+// changes; it takes the room of the owner instead of closing a copy that
+// only looks empty.
+func TestCopyReloadsAfterMissingChanges(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	owner, ownerURL := newTestNode(t, st, bus)
+	otherBus := &cutBus{Bus: bus}
+	other, _ := newTestNode(t, st, otherBus)
+
+	a := dialTestClient(t, ownerURL)
+	roomID := a.createTestRoom("a@example.com")
+	copy, ok := other.loadRoom(roomID)
+	if !ok {
+		t.Fatal("the other node could not restore the room")
+	}
+
+	otherBus.cut.Store(true)
+	if code := dialTestClient(t, ownerURL).join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	capacity := int32(5)
+	room, _ := owner.loadRoom(roomID)
+	if err := owner.updateRoom(room, types.UpdateRoomRequest{MaxCapacity: &capacity}, ""); err != nil {
+		t.Fatal(err)
+	}
+	otherBus.cut.Store(false)
+
+	a.send("leave_room", "leave", map[string]interface{}{"room_id": roomID, "email": "a@example.com"})
+	a.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "leave" })
+
+	deadline := time.Now().Add(testTimeout)
+	for copy.Revision() != room.Revision() || copy.GetMaxCapacity() != capacity {
+		if time.Now().After(deadline) {
+			t.Fatalf("copy is at revision %d, the owner at %d", copy.Revision(), room.Revision())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if copy.GetState() == types.RoomStateClosed {
+		t.Fatal("the other node closed a room the owner keeps")
+	}
+	if _, err := copy.GetPeer("b@example.com"); err != nil || copy.PeerCount() != 1 {
+		t.Fatalf("copy holds %v, want b@example.com only", copy.GetPeers())
+	}
+}
+
+// TestShutdownLeavesRoomsOpen shuts down the owner of a room. Its peers are
+// not told the room closed, and the room stays open for the other nodes.
+func TestShutdownLeavesRoomsOpen(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	bus := storage.NewMemoryBus()
+	// The owner is served here, as the cleanup of newTestNode shuts it down.
+	owner, err := newSocketServer(st, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(owner.HandleHTTP))
+	defer srv.Close()
+	other, _ := newTestNode(t, st, bus)
+
+	a := dialTestClient(t, srv.URL, fmt.Sprintf("goparty.v%d", deltaProtocolVersion))
+	roomID := a.createTestRoom("a@example.com")
+	copy, ok := other.loadRoom(roomID)
+	if !ok {
+		t.Fatal("the other node could not restore the room")
+	}
+
+	owner.Shutdown()
+	for _, msg := range a.drain(100 * time.Millisecond) {
+		if patch, _ := msg.Data["patch"].(map[string]interface{}); patch["status"] != nil {
+			t.Fatal("shutdown told the peers the room closed")
+		}
+	}
+	if copy.GetState() == types.RoomStateClosed {
+		t.Fatal("the other node closed its copy")
+	}
+	if st.HGetAll(roomKey(roomID))["status"] != fmt.Sprint(int(types.RoomStateActive)) {
+		t.Fatal("the room was stored closed")
+	}
+}
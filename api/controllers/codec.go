@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+// encoding is the wire format negotiated for a connection. JSON travels in
+// text frames, MessagePack in binary frames.
+type encoding int32
+
+const (
+	encodingJSON encoding = iota
+	encodingMsgpack
+)
+
+const msgpackSubprotocolSuffix = "+msgpack"
+
+func (e encoding) String() string {
+	switch e {
+	case encodingMsgpack:
+		return "msgpack"
+	default:
+		return "json"
+	}
+}
+
+func parseEncoding(name string) (encoding, bool) {
+	switch name {
+	case "json":
+		return encodingJSON, true
+	case "msgpack":
+		return encodingMsgpack, true
+	default:
+		return encodingJSON, false
+	}
+}
+
+func (e encoding) frameType() int {
+	if e == encodingMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// encodedMessage encodes a message lazily, at most once per encoding, so a
+// broadcast costs one marshal per format in use instead of one per peer.
+type encodedMessage struct {
+	msg types.Message
+
+	once     [2]sync.Once
+	payloads [2][]byte
+	errs     [2]error
+}
+
+func newEncodedMessage(msg types.Message) *encodedMessage {
+	return &encodedMessage{msg: msg}
+}
+
+// newEncodedJSON wraps a message that arrived already encoded as JSON, e.g.
+// from another node.
+func newEncodedJSON(data []byte) *encodedMessage {
+	m := &encodedMessage{}
+	m.once[encodingJSON].Do(func() {
+		m.payloads[encodingJSON] = data
+	})
+	return m
+}
+
+func (m *encodedMessage) bytes(e encoding) ([]byte, error) {
+	m.once[e].Do(func() {
+		if e == encodingJSON {
+			m.payloads[e], m.errs[e] = json.Marshal(m.msg)
+			return
+		}
+		data, err := m.bytes(encodingJSON)
+		if err != nil {
+			m.errs[e] = err
+			return
+		}
+		m.payloads[e], m.errs[e] = utils.JSONToMsgpack(data)
+	})
+	return m.payloads[e], m.errs[e]
+}
+
+// decodeFrame turns an incoming frame into the JSON the message decoding
+// works on.
+func decodeFrame(frameType int, data []byte) ([]byte, error) {
+	if frameType == websocket.BinaryMessage {
+		return utils.MsgpackToJSON(data)
+	}
+	return data, nil
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// commandTimeout is how long a node waits for the owner of a room to reply
+// to a forwarded change. An owner that died keeps its lease for up to
+// roomLeaseTTL, so changes fail until another node takes the room over.
+const commandTimeout = 2 * time.Second
+
+// Changes to a room are made by its owner only, one at a time and in the
+// order they reach it, so every node sees them in the same order and the
+// capacity of the room is checked against the copy that counts. Other nodes
+// forward their changes as commands and wait for the reply; the owner
+// applies them and tells every node the change.
+
+// roomCommand asks the owner of a room to make a change.
+type roomCommand struct {
+	ID     string     `json:"id"`
+	Change roomChange `json:"change"`
+}
+
+// commandReply tells the node that sent a command whether the owner made
+// the change.
+type commandReply struct {
+	ID    string          `json:"id"`
+	Code  types.ErrorCode `json:"code,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+var errOwnerUnavailable = types.NewSocketError(types.CodeInternal, "The room is unavailable, try again")
+
+// commandErrors are the errors a failed command reports as themselves, so
+// the sender can tell them apart.
+var commandErrors = []error{
+	types.ErrRoomFull,
+	types.ErrRoomInactive,
+	types.ErrRoomClosed,
+	types.ErrPeerExists,
+	types.ErrPeerNotFound,
+	types.ErrInvalidTransition,
+	types.ErrInvalidPeer,
+	types.ErrNotScheduled,
+}
+
+// changeRoom makes a change to the room on its owner. A node owning the
+// room makes it right away; other nodes take over a room without owner or
+// forward the change to the owner. It returns once the change is made and
+// this node applied it to its copy.
+func (s *SocketServer) changeRoom(room *types.Room, change roomChange) error {
+	roomID := room.ID.String()
+	if !s.ownsRoom(roomID) && s.acquireRoom(roomID) {
+		fmt.Printf("Took over room %s\n", roomID)
+		// The caller may hold the lock of a peer the takeover locks.
+		go s.takeOverRoom(room)
+	}
+	if s.ownsRoom(roomID) {
+		return s.makeChange(room, change)
+	}
+	return s.forwardChange(roomID, change)
+}
+
+// makeChange applies a change to the room this node owns and tells the
+// other nodes. Changes of a room are made one at a time, so the nodes get
+// them in the order they were made.
+func (s *SocketServer) makeChange(room *types.Room, change roomChange) error {
+	roomID := room.ID.String()
+	lock := s.commandLock(roomID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if change.IfEmpty && !room.IsEmpty() {
+		return types.ErrInvalidTransition
+	}
+	revision, err := s.applyRoomChange(room, &change)
+	if err != nil {
+		return err
+	}
+	change.Revision = revision
+	s.publishRoomChange(roomID, change)
+	return nil
+}
+
+// commandLock returns the lock the changes of a room this node owns are made
+// under.
+func (s *SocketServer) commandLock(roomID string) *sync.Mutex {
+	lockVal, _ := s.commands.LoadOrStore(roomID, &sync.Mutex{})
+	return lockVal.(*sync.Mutex)
+}
+
+// forwardChange sends a change to the owner of the room and waits for its
+// reply. The owner publishes the change before replying, so this node has
+// applied it by the time the reply arrives.
+func (s *SocketServer) forwardChange(roomID string, change roomChange) error {
+	id := uuid.New().String()
+	reply := make(chan commandReply, 1)
+	s.replies.Store(id, reply)
+	defer s.replies.Delete(id)
+
+	s.publishRoomEvent(roomEvent{RoomID: roomID, Command: &roomCommand{ID: id, Change: change}})
+	select {
+	case r := <-reply:
+		return commandError(r)
+	case <-time.After(commandTimeout):
+		fmt.Printf("Owner of room %s did not reply to %s\n", roomID, change.Kind)
+		return errOwnerUnavailable
+	case <-s.shutdown:
+		return errOwnerUnavailable
+	}
+}
+
+// handleCommand makes a change another node forwarded, if this node owns
+// the room, and replies to it.
+func (s *SocketServer) handleCommand(ev roomEvent) {
+	if !s.ownsRoom(ev.RoomID) {
+		return
+	}
+	roomVal, ok := s.rooms.Load(ev.RoomID)
+	if !ok {
+		return
+	}
+	reply := commandReply{ID: ev.Command.ID}
+	if err := s.makeChange(roomVal.(*types.Room), ev.Command.Change); err != nil {
+		reply.Code = types.ErrorCodeFor(err)
+		reply.Error = err.Error()
+	}
+	s.publishRoomEvent(roomEvent{RoomID: ev.RoomID, To: ev.Node, Reply: &reply})
+}
+
+func (s *SocketServer) handleReply(r *commandReply) {
+	reply, ok := s.replies.Load(r.ID)
+	if !ok {
+		return
+	}
+	select {
+	case reply.(chan commandReply) <- *r:
+	default:
+	}
+}
+
+// commandError returns the error a command failed with on the owner.
+func commandError(r commandReply) error {
+	if r.Error == "" {
+		return nil
+	}
+	for _, err := range commandErrors {
+		if err.Error() == r.Error {
+			return err
+		}
+	}
+	return types.NewSocketError(r.Code, r.Error)
+}
+
+// updatePeer sets what the sessions of a peer determine: its devices,
+// status and connection.
+func updatePeer(room *types.Room, peer *types.Peer) (int64, error) {
+	_, revision, err := room.UpdatePeer(peer.Email, func(p *types.Peer) {
+		p.Status = peer.Status
+		p.Devices = peer.Devices
+		p.Connection = peer.Connection
+	})
+	return revision, err
+}
+
+// takeOverRoom takes over a room whose owner stopped renewing its lease.
+func (s *SocketServer) takeOverRoom(room *types.Room) {
+	s.adoptRoom(room)
+	s.persistRoom(room)
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"compress/flate"
+	"os"
+	"strconv"
+)
+
+// CompressionConfig controls permessage-deflate. Messages smaller than
+// Threshold bytes are sent uncompressed: for short frames like
+// update_timestamp the deflate overhead outweighs the savings, while the
+// room dumps in user_joined compress very well.
+type CompressionConfig struct {
+	Enabled   bool
+	Threshold int
+	Level     int
+}
+
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		Enabled:   true,
+		Threshold: 512,
+		Level:     flate.BestSpeed,
+	}
+}
+
+func loadCompressionFromEnv() CompressionConfig {
+	config := DefaultCompressionConfig()
+	if os.Getenv("WS_COMPRESSION") == "false" {
+		config.Enabled = false
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_COMPRESSION_THRESHOLD")); err == nil && v >= 0 {
+		config.Threshold = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_COMPRESSION_LEVEL")); err == nil && v >= flate.HuffmanOnly && v <= flate.BestCompression {
+		config.Level = v
+	}
+	return config
+}
@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/storage"
+)
+
+// countingListener counts the bytes the server writes to its connections.
+type countingListener struct {
+	net.Listener
+	written *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, written: l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// trafficPeer is a benchmark connection that counts the payload bytes it
+// receives and reports the chat messages that mark the end of an iteration.
+type trafficPeer struct {
+	conn  *websocket.Conn
+	marks chan string
+}
+
+func dialTrafficPeer(b *testing.B, url, subprotocol string, received *atomic.Int64) *trafficPeer {
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}, EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := &trafficPeer{conn: conn, marks: make(chan string, 16)}
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				close(p.marks)
+				return
+			}
+			received.Add(int64(len(data)))
+			if i := strings.Index(string(data), "mark-"); i >= 0 {
+				p.marks <- string(data[i : i+strings.IndexByte(string(data[i:]), '"')])
+			}
+		}
+	}()
+	return p
+}
+
+func (p *trafficPeer) send(b *testing.B, action string, data map[string]interface{}) {
+	msg, _ := json.Marshal(map[string]interface{}{"action": action, "data": data})
+	if err := p.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func (p *trafficPeer) waitMark(b *testing.B, mark string) {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case got, ok := <-p.marks:
+			if !ok {
+				b.Fatalf("connection closed waiting for %s", mark)
+			}
+			if got == mark {
+				return
+			}
+		case <-timeout:
+			b.Fatalf("timed out waiting for %s", mark)
+		}
+	}
+}
+
+// waitForRoom returns the ID of the first room the server hosts.
+func waitForRoom(b *testing.B, s *SocketServer) string {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		var roomID string
+		s.rooms.Range(func(key, _ interface{}) bool {
+			roomID = key.(string)
+			return false
+		})
+		if roomID != "" {
+			return roomID
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Fatal("timed out waiting for the room")
+	return ""
+}
+
+// BenchmarkRoomTrafficCompression replays the traffic of a watch party, a
+// peer joining and leaving, playback and chat, to a room of legacy and delta
+// clients, with and without permessage-deflate. It reports the payload bytes
+// the clients received, the bytes the server wrote to the wire and the share
+// compression saved.
+func BenchmarkRoomTrafficCompression(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		name := "off"
+		if enabled {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.Setenv("WS_COMPRESSION", fmt.Sprint(enabled))
+			benchmarkRoomTraffic(b)
+		})
+	}
+}
+
+func benchmarkRoomTraffic(b *testing.B) {
+	const peers = 8
+	st := storage.NewMemoryStorage()
+	emails := []string{"joiner@example.com"}
+	for i := 0; i < peers; i++ {
+		emails = append(emails, fmt.Sprintf("peer%d@example.com", i))
+	}
+	addTestUsers(st, emails...)
+
+	s, err := newSocketServer(st, storage.NewMemoryBus())
+	if err != nil {
+		b.Fatal(err)
+	}
+	unlimited := RateLimit{PerSecond: 1e6, Burst: 1e6}
+	s.rateLimits.Connection = unlimited
+	s.actions.Range(func(name, _ interface{}) bool {
+		s.rateLimits.Actions[name.(string)] = unlimited
+		return true
+	})
+	var written, received atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.HandleHTTP)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener = countingListener{Listener: srv.Listener, written: &written}
+	srv.Start()
+	defer srv.Close()
+	defer s.Shutdown()
+
+	room := make([]*trafficPeer, peers)
+	var roomID string
+	for i := range room {
+		room[i] = dialTrafficPeer(b, srv.URL, fmt.Sprintf("goparty.v%d", 1+i%2), &received)
+		email := fmt.Sprintf("peer%d@example.com", i)
+		if i == 0 {
+			room[i].send(b, "create_room", map[string]interface{}{
+				"email":        email,
+				"video_source": "https://videos.example.com/movies/a-rather-long-title/master.m3u8",
+				"timestamp":    map[string]interface{}{"start": 0, "end": 7200, "current": 0},
+			})
+			roomID = waitForRoom(b, s)
+			continue
+		}
+		room[i].send(b, "join_room", map[string]interface{}{"room_id": roomID, "email": email})
+	}
+	joiner := dialTrafficPeer(b, srv.URL, "goparty.v1", &received)
+	sender := room[0]
+	mark := func(i int) string { return fmt.Sprintf("mark-%d", i) }
+	sender.send(b, "chat_message", map[string]interface{}{"room_id": roomID, "email": "peer0@example.com", "message": mark(-1)})
+	for _, p := range room {
+		p.waitMark(b, mark(-1))
+	}
+
+	written.Store(0)
+	received.Store(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		joiner.send(b, "join_room", map[string]interface{}{"room_id": roomID, "email": "joiner@example.com"})
+		joiner.send(b, "leave_room", map[string]interface{}{"room_id": roomID, "email": "joiner@example.com"})
+		sender.send(b, "player_state", map[string]interface{}{"room_id": roomID, "email": "peer0@example.com", "paused": i%2 == 0})
+		for j := 0; j < 3; j++ {
+			sender.send(b, "update_timestamp", map[string]interface{}{"room_id": roomID, "email": "peer0@example.com", "timestamp": float64(i*3+j) * 1.5, "seeking": false})
+		}
+		sender.send(b, "typing_start", map[string]interface{}{"room_id": roomID, "email": "peer0@example.com"})
+		sender.send(b, "chat_message", map[string]interface{}{"room_id": roomID, "email": "peer0@example.com", "message": "that scene was great, " + mark(i)})
+		for _, p := range room {
+			p.waitMark(b, mark(i))
+		}
+	}
+	b.StopTimer()
+	// Let the broadcasts of the last iteration that do not wait for its mark
+	// arrive.
+	time.Sleep(200 * time.Millisecond)
+
+	payload, wire := float64(received.Load()), float64(written.Load())
+	b.ReportMetric(payload/float64(b.N), "payload_B/op")
+	b.ReportMetric(wire/float64(b.N), "wire_B/op")
+	b.ReportMetric((payload-wire)/float64(b.N), "saved_B/op")
+	b.ReportMetric(100*(1-wire/payload), "saved_%")
+}
+
+// TestCompressionIsPerServer starts a server without compression next to one
+// with it. Each negotiates its own.
+func TestCompressionIsPerServer(t *testing.T) {
+	t.Setenv("WS_COMPRESSION", "false")
+	_, plainURL := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+	t.Setenv("WS_COMPRESSION", "")
+	_, compressedURL := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+
+	for url, want := range map[string]bool{plainURL: false, compressedURL: true} {
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); got != want {
+			t.Fatalf("server at %s negotiated compression: %v, want %v", url, got, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+const (
+	// roomLeaseTTL is how long a node that stopped renewing keeps owning
+	// its rooms, i.e. how long a dead node blocks their takeover.
+	roomLeaseTTL           = 15 * time.Second
+	roomLeaseRenewInterval = 5 * time.Second
+)
+
+// Every room has one owner node, the holder of its lease in storage. Only
+// the owner changes the room and writes it to storage; the other nodes
+// forward their changes to it through the bus, see changeRoom. A node keeps renewing the leases of its
+// rooms and takes over the rooms whose owner stopped renewing them.
+
+func roomLeaseKey(roomID string) string {
+	return "lease:room:" + roomID
+}
+
+// acquireRoom acquires or renews the lease of a room.
+func (s *SocketServer) acquireRoom(roomID string) bool {
+	if !s.storage.AcquireLease(roomLeaseKey(roomID), s.node, roomLeaseTTL) {
+		s.owned.Delete(roomID)
+		return false
+	}
+	s.owned.Store(roomID, struct{}{})
+	return true
+}
+
+func (s *SocketServer) ownsRoom(roomID string) bool {
+	_, ok := s.owned.Load(roomID)
+	return ok
+}
+
+func (s *SocketServer) releaseRoom(roomID string) {
+	if _, ok := s.owned.LoadAndDelete(roomID); ok {
+		s.storage.ReleaseLease(roomLeaseKey(roomID), s.node)
+	}
+}
+
+func (s *SocketServer) renewLeases() {
+	ticker := time.NewTicker(roomLeaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.renewRoomLeases()
+		}
+	}
+}
+
+// renewRoomLeases renews the leases of the rooms this node owns and takes
+// over the rooms whose lease expired.
+func (s *SocketServer) renewRoomLeases() {
+	s.rooms.Range(func(key, roomVal interface{}) bool {
+		roomID := key.(string)
+		owned := s.ownsRoom(roomID)
+		switch acquired := s.acquireRoom(roomID); {
+		case acquired && !owned:
+			fmt.Printf("Took over room %s\n", roomID)
+			s.takeOverRoom(roomVal.(*types.Room))
+		case !acquired && owned:
+			fmt.Printf("Lost the lease of room %s\n", roomID)
+		}
+		return true
+	})
+}
+
+// persistPeer writes a peer change of the room to storage, or deletes the room
+// once it closed. Nodes not owning the room leave that to the owner.
+func (s *SocketServer) persistPeer(room *types.Room, email string) {
+	roomID := room.ID.String()
+	if !s.ownsRoom(roomID) {
+		return
+	}
+	if err := s.setPeer(roomID, room, email); err != nil {
+		fmt.Printf("Error persisting room %s: %v\n", roomID, err)
+	}
+	if room.GetState() == types.RoomStateClosed {
+		s.releaseRoom(roomID)
+	}
+}
+
+// persistRoom writes the room to storage, or deletes it once it closed.
+// Nodes not owning the room leave that to the owner.
+func (s *SocketServer) persistRoom(room *types.Room) {
+	roomID := room.ID.String()
+	if !s.ownsRoom(roomID) {
+		return
+	}
+	if err := s.setRoom(roomID, room); err != nil {
+		fmt.Printf("Error persisting room %s: %v\n", roomID, err)
+	}
+	if room.GetState() == types.RoomStateClosed {
+		s.releaseRoom(roomID)
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+const (
+	// lifecycleTickInterval is how often the rooms of a node are checked for
+	// idling and their activity is stored.
+	lifecycleTickInterval = 30 * time.Second
+	// defaultRoomIdleTimeout is how long an active room may go without
+	// activity before it becomes inactive.
+	defaultRoomIdleTimeout = time.Hour
+	// defaultRoomCloseTimeout is how long a room may go without activity
+	// before it closes.
+	defaultRoomCloseTimeout = 6 * time.Hour
+)
+
+// Reasons a room_state_changed event gives for the change.
+const (
+	stateReasonRequested = "requested"
+	stateReasonScheduled = "scheduled"
+	stateReasonIdle      = "idle"
+	stateReasonActivity  = "activity"
+	stateReasonExpired   = "expired"
+	stateReasonEmpty     = "empty"
+)
+
+func loadRoomIdleTimeoutFromEnv() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("ROOM_IDLE_TIMEOUT")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultRoomIdleTimeout
+}
+
+func loadRoomCloseTimeoutFromEnv() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("ROOM_CLOSE_TIMEOUT")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultRoomCloseTimeout
+}
+
+// The owner of a room makes it inactive once it saw no activity for the idle
+// timeout and closes it after the close timeout, whether or not peers are
+// still in it. A room the lifecycle made inactive becomes active again when
+// the peers still in it become active; the reason of its state, which is
+// stored with the room, tells it from a room its creator deactivated, also
+// after a restart or a takeover. Scheduled rooms waiting for their start are
+// left alone.
+
+func (s *SocketServer) runLifecycle() {
+	ticker := time.NewTicker(lifecycleTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case now := <-ticker.C:
+			s.tickLifecycle(now)
+		}
+	}
+}
+
+func (s *SocketServer) tickLifecycle(now time.Time) {
+	s.rooms.Range(func(key, roomVal interface{}) bool {
+		roomID := key.(string)
+		room := roomVal.(*types.Room)
+		if !s.ownsRoom(roomID) {
+			return true
+		}
+		if _, waiting := room.ScheduledStart(); waiting {
+			return true
+		}
+
+		idle := now.Sub(room.LastActive())
+		switch state := room.GetState(); {
+		case s.roomCloseTimeout > 0 && idle >= s.roomCloseTimeout:
+			s.setRoomState(room, types.RoomStateClosed, stateReasonExpired)
+		case state == types.RoomStateActive:
+			if s.roomIdleTimeout > 0 && idle >= s.roomIdleTimeout {
+				s.setRoomState(room, types.RoomStateInactive, stateReasonIdle)
+			}
+		case state == types.RoomStateInactive && room.GetStateReason() == stateReasonIdle && idle < s.roomIdleTimeout:
+			s.setRoomState(room, types.RoomStateActive, stateReasonActivity)
+		}
+
+		if idle < lifecycleTickInterval {
+			s.storeActivity(roomID, room)
+		}
+		return true
+	})
+	s.sweepStaleRooms(now)
+}
+
+func (s *SocketServer) setRoomState(room *types.Room, state types.RoomState, reason string) bool {
+	if err := s.updateRoom(room, types.UpdateRoomRequest{Status: &state}, reason); err != nil {
+		fmt.Printf("Error changing the state of room %s: %v\n", room.ID, err)
+		return false
+	}
+	fmt.Printf("Room %s is now %s (%s)\n", room.ID, state, reason)
+	return true
+}
+
+// storeActivity writes when the room was last active. Activity that does not
+// change the room, like chat, is stored only here, so a restart loses at most
+// one tick of it.
+func (s *SocketServer) storeActivity(roomID string, room *types.Room) {
+	if room.GetState() == types.RoomStateClosed {
+		return
+	}
+	data, err := json.Marshal(room.LastActive())
+	if err != nil {
+		fmt.Printf("Error marshaling activity of room %s: %v\n", roomID, err)
+		return
+	}
+	s.storage.HSet(roomKey(roomID), map[string]string{"last_active": string(data)})
+	s.storage.ZAdd(roomActivityKey, roomID, activityScore(room))
+}
+
+// sweepStaleRooms deletes the stored rooms that went stale without any node
+// hosting them, e.g. because every node that did died. Holding the lease of a
+// room while deleting it keeps a node from restoring it meanwhile.
+func (s *SocketServer) sweepStaleRooms(now time.Time) {
+	cutoff := float64(now.Add(-s.staleRoomAge).Unix())
+	for _, id := range s.storage.ZRangeByScore(roomActivityKey, math.Inf(-1), cutoff) {
+		if _, ok := s.rooms.Load(id); ok {
+			continue
+		}
+		if !s.storage.AcquireLease(roomLeaseKey(id), s.node, roomLeaseTTL) {
+			continue
+		}
+		fmt.Printf("Discarding stale room %s\n", id)
+		s.deleteRoom(id)
+		s.storage.ReleaseLease(roomLeaseKey(id), s.node)
+	}
+}
+
+// sendStateChanged tells the connections of this node that the state of the
+// room changed and why. The other nodes tell theirs.
+func (s *SocketServer) sendStateChanged(room *types.Room, revision int64, previous, state types.RoomState, reason string) {
+	encoded := newEncodedMessage(types.Message{
+		Action: "room_state_changed",
+		Data: map[string]interface{}{
+			"room_id":  room.ID.String(),
+			"revision": revision,
+			"previous": previous,
+			"status":   state,
+			"reason":   reason,
+		},
+	})
+	s.broadcastEncoded(room.ID.String(), func(*client) *encodedMessage { return encoded })
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// waitForField waits until the stored room has the field at value.
+func waitForField(t *testing.T, st storage.Storage, roomID, field, value string) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for st.HGetAll(roomKey(roomID))[field] != value {
+		if time.Now().After(deadline) {
+			t.Fatalf("room %s stored %s=%s, want %s", roomID, field, st.HGetAll(roomKey(roomID))[field], value)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestIdledRoomReactivatesOnAnotherNode idles a room and restores it on
+// another node, which must still know why the room went inactive.
+func TestIdledRoomReactivatesOnAnotherNode(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	first, err := newSocketServer(st, storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idled := openTestRoom(t, first, "a@example.com", true)
+	deactivated := openTestRoom(t, first, "a@example.com", true)
+	room, _ := first.loadRoom(deactivated)
+	if !first.setRoomState(room, types.RoomStateInactive, stateReasonRequested) {
+		t.Fatal("could not deactivate the room")
+	}
+	first.tickLifecycle(time.Now().Add(2 * time.Hour))
+	waitForField(t, st, idled, "state_reason", `"idle"`)
+	waitForField(t, st, deactivated, "state_reason", `"requested"`)
+	first.Shutdown()
+
+	second, _ := newTestNode(t, st, storage.NewMemoryBus())
+	for _, id := range []string{idled, deactivated} {
+		room, ok := second.loadRoom(id)
+		if !ok {
+			t.Fatalf("room %s not restored", id)
+		}
+		if room.GetState() != types.RoomStateInactive {
+			t.Fatalf("room %s restored as %s", id, room.GetState())
+		}
+		room.Touch()
+	}
+	second.tickLifecycle(time.Now())
+
+	if room, _ := second.loadRoom(idled); room.GetState() != types.RoomStateActive || room.GetStateReason() != stateReasonActivity {
+		t.Fatalf("idled room is %s (%s), want active", room.GetState(), room.GetStateReason())
+	}
+	if room, _ := second.loadRoom(deactivated); room.GetState() != types.RoomStateInactive {
+		t.Fatalf("deactivated room is %s, want inactive", room.GetState())
+	}
+}
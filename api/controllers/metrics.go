@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+var errPanic = errors.New("handler panicked")
+
+type actionStats struct {
+	count    int64
+	errors   int64
+	panics   int64
+	duration int64
+}
+
+type ActionStats struct {
+	Count        int64   `json:"count"`
+	Errors       int64   `json:"errors"`
+	Panics       int64   `json:"panics"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+type actionMetrics struct {
+	stats sync.Map
+	// roomEvents counts the events of the rooms this node hosts by kind.
+	roomEvents sync.Map
+}
+
+func (m *actionMetrics) middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *ActionContext) (interface{}, error) {
+		val, _ := m.stats.LoadOrStore(ctx.Message.Action, &actionStats{})
+		stats := val.(*actionStats)
+
+		start := time.Now()
+		result, err := next(ctx)
+		atomic.AddInt64(&stats.count, 1)
+		atomic.AddInt64(&stats.duration, int64(time.Since(start)))
+		if err != nil {
+			atomic.AddInt64(&stats.errors, 1)
+			if errors.Is(err, errPanic) {
+				atomic.AddInt64(&stats.panics, 1)
+			}
+		}
+		return result, err
+	}
+}
+
+func (m *actionMetrics) snapshot() map[string]ActionStats {
+	snapshot := make(map[string]ActionStats)
+	m.stats.Range(func(key, val interface{}) bool {
+		stats := val.(*actionStats)
+		s := ActionStats{
+			Count:  atomic.LoadInt64(&stats.count),
+			Errors: atomic.LoadInt64(&stats.errors),
+			Panics: atomic.LoadInt64(&stats.panics),
+		}
+		if s.Count > 0 {
+			s.AvgLatencyMs = float64(atomic.LoadInt64(&stats.duration)) / float64(s.Count) / float64(time.Millisecond)
+		}
+		snapshot[key.(string)] = s
+		return true
+	})
+	return snapshot
+}
+
+func (m *actionMetrics) countRoomEvent(kind types.RoomEventKind) {
+	val, _ := m.roomEvents.LoadOrStore(kind.String(), new(int64))
+	atomic.AddInt64(val.(*int64), 1)
+}
+
+func (m *actionMetrics) roomEventCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	m.roomEvents.Range(func(key, val interface{}) bool {
+		counts[key.(string)] = atomic.LoadInt64(val.(*int64))
+		return true
+	})
+	return counts
+}
+
+// HandleMetrics serves per action counters collected by the metrics
+// middleware, and the counts of the room events this node saw.
+func (s *SocketServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	if r.Method != http.MethodGet {
+		writer.WriteError(http.StatusMethodNotAllowed, utils.ErrMethodNotAllowed.Error())
+		return
+	}
+	writer.WriteJSON(http.StatusOK, map[string]interface{}{
+		"actions":     s.metrics.snapshot(),
+		"room_events": s.metrics.roomEventCounts(),
+	})
+}
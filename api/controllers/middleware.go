@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+func loggingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *ActionContext) (interface{}, error) {
+		fmt.Printf("Received message from %s: %v with payload %v\n", ctx.Conn.RemoteAddr(), ctx.Message.Action, string(ctx.Message.Data))
+		start := time.Now()
+		result, err := next(ctx)
+		if err != nil {
+			fmt.Printf("Action %s from %s failed after %v: %v\n", ctx.Message.Action, ctx.Conn.RemoteAddr(), time.Since(start), err)
+		}
+		return result, err
+	}
+}
+
+// recoveryMiddleware turns a panicking handler into an internal error so a
+// bug in one action cannot take down the connection or the server.
+func recoveryMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *ActionContext) (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("Panic in action %s: %v\n%s", ctx.Message.Action, r, debug.Stack())
+				result = nil
+				err = types.WrapSocketError(types.CodeInternal, "Internal server error", errPanic)
+			}
+		}()
+		return next(ctx)
+	}
+}
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+const defaultPayloadLimit = 1024
+
+// payloadLimits caps the encoded size of the data field per action. Anything
+// not listed here is limited to defaultPayloadLimit.
+var payloadLimits = map[string]int{
+	"create_room":  16 * 1024,
+	"chat_message": 8 * 1024,
+}
+
+// decodePayload strictly decodes the data of msg into target and runs the
+// payload's own validation.
+func decodePayload(msg types.IncomingMessage, target Payload, required ...string) error {
+	limit, ok := payloadLimits[msg.Action]
+	if !ok {
+		limit = defaultPayloadLimit
+	}
+	if len(msg.Data) > limit {
+		return fmt.Errorf("payload too large")
+	}
+	if err := utils.DecodeStrict(msg.Data, target, required...); err != nil {
+		return err
+	}
+	return target.Validate()
+}
+
+func invalidPayload(context string, err error) error {
+	return types.WrapSocketError(types.CodeInvalidPayload, fmt.Sprintf("%s: %v", context, err), err)
+}
@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+)
+
+const (
+	// defaultTypingTimeout clears a typing indicator when the client never
+	// sends typing_stop (tab closed, network drop, ...).
+	defaultTypingTimeout = 6 * time.Second
+	// presenceFlushInterval coalesces typing and read receipt changes so a
+	// burst of keystrokes results in a single broadcast per room.
+	presenceFlushInterval = 250 * time.Millisecond
+)
+
+type roomPresence struct {
+	mu             sync.Mutex
+	typing         map[string]*time.Timer
+	reads          map[string]int64
+	typingDirty    bool
+	readsDirty     map[string]struct{}
+	flushScheduled bool
+}
+
+func newRoomPresence() *roomPresence {
+	return &roomPresence{
+		typing:     make(map[string]*time.Timer),
+		reads:      make(map[string]int64),
+		readsDirty: make(map[string]struct{}),
+	}
+}
+
+func (s *SocketServer) presenceFor(roomID string) *roomPresence {
+	val, _ := s.presence.LoadOrStore(roomID, newRoomPresence())
+	return val.(*roomPresence)
+}
+
+func (s *SocketServer) handleTyping(conn *websocket.Conn, typingData types.TypingData, typing bool) error {
+	// Presence is only dropped when a room closes, so it is kept for rooms
+	// that exist only.
+	if _, ok := s.rooms.Load(typingData.RoomID); !ok {
+		return types.ErrRoomNotFound
+	}
+	if typing {
+		s.startTyping(typingData.RoomID, typingData.Email)
+	} else {
+		s.stopTyping(typingData.RoomID, typingData.Email)
+	}
+	return nil
+}
+
+func (s *SocketServer) startTyping(roomID, email string) {
+	p := s.presenceFor(roomID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timer, ok := p.typing[email]; ok {
+		timer.Stop()
+	} else {
+		p.typingDirty = true
+		s.scheduleFlush(roomID, p)
+	}
+	// A timer that already fired may still be waiting for p.mu; it only
+	// clears the indicator it was started for. It reads timer under p.mu,
+	// which is held until timer is set.
+	var timer *time.Timer
+	timer = time.AfterFunc(s.typingTimeout, func() {
+		p.mu.Lock()
+		expired := timer
+		p.mu.Unlock()
+		s.expireTyping(roomID, email, expired)
+	})
+	p.typing[email] = timer
+}
+
+func (s *SocketServer) stopTyping(roomID, email string) {
+	s.expireTyping(roomID, email, nil)
+}
+
+// expireTyping clears the typing indicator of a peer. With a timer, only the
+// indicator that timer was started for is cleared.
+func (s *SocketServer) expireTyping(roomID, email string, expired *time.Timer) {
+	val, ok := s.presence.Load(roomID)
+	if !ok {
+		return
+	}
+	p := val.(*roomPresence)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timer, ok := p.typing[email]
+	if !ok || (expired != nil && timer != expired) {
+		return
+	}
+	timer.Stop()
+	delete(p.typing, email)
+	p.typingDirty = true
+	s.scheduleFlush(roomID, p)
+}
+
+func (s *SocketServer) handleChatRead(conn *websocket.Conn, readData types.ChatReadData) error {
+	roomVal, ok := s.rooms.Load(readData.RoomID)
+	if !ok {
+		return types.ErrRoomNotFound
+	}
+	if readData.Seq > s.lastChatSeq(roomVal.(*types.Room).ID.String()) {
+		return types.NewSocketError(types.CodeInvalidPayload, "Invalid read watermark")
+	}
+
+	p := s.presenceFor(readData.RoomID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Watermarks only move forward; late or duplicate receipts are ignored.
+	if readData.Seq <= p.reads[readData.Email] {
+		return nil
+	}
+	p.reads[readData.Email] = readData.Seq
+	p.readsDirty[readData.Email] = struct{}{}
+	s.scheduleFlush(readData.RoomID, p)
+	return nil
+}
+
+// scheduleFlush must be called with p.mu held.
+func (s *SocketServer) scheduleFlush(roomID string, p *roomPresence) {
+	if p.flushScheduled {
+		return
+	}
+	p.flushScheduled = true
+	time.AfterFunc(presenceFlushInterval, func() {
+		s.flushPresence(roomID, p)
+	})
+}
+
+func (s *SocketServer) flushPresence(roomID string, p *roomPresence) {
+	p.mu.Lock()
+	p.flushScheduled = false
+
+	var typingMsg, readMsg *types.Message
+	if p.typingDirty {
+		typing := make([]string, 0, len(p.typing))
+		for email := range p.typing {
+			typing = append(typing, email)
+		}
+		typingMsg = &types.Message{
+			Action: "typing_update",
+			Data: map[string]interface{}{
+				"room":   roomID,
+				"typing": typing,
+			},
+		}
+		p.typingDirty = false
+	}
+	if len(p.readsDirty) > 0 {
+		reads := make(map[string]int64, len(p.readsDirty))
+		for email := range p.readsDirty {
+			reads[email] = p.reads[email]
+		}
+		readMsg = &types.Message{
+			Action: "read_receipts",
+			Data: map[string]interface{}{
+				"room":  roomID,
+				"reads": reads,
+			},
+		}
+		p.readsDirty = make(map[string]struct{})
+	}
+	p.mu.Unlock()
+
+	if typingMsg != nil {
+		s.broadcastToRoom(roomID, *typingMsg)
+	}
+	if readMsg != nil {
+		s.broadcastToRoom(roomID, *readMsg)
+	}
+}
+
+// clearPresence drops the typing indicator and read watermark of a peer that
+// left the room.
+func (s *SocketServer) clearPresence(roomID, email string) {
+	s.stopTyping(roomID, email)
+
+	val, ok := s.presence.Load(roomID)
+	if !ok {
+		return
+	}
+	p := val.(*roomPresence)
+	p.mu.Lock()
+	delete(p.reads, email)
+	delete(p.readsDirty, email)
+	p.mu.Unlock()
+}
+
+func (s *SocketServer) dropPresence(roomID string) {
+	val, ok := s.presence.LoadAndDelete(roomID)
+	if !ok {
+		return
+	}
+	p := val.(*roomPresence)
+	p.mu.Lock()
+	for _, timer := range p.typing {
+		timer.Stop()
+	}
+	p.mu.Unlock()
+}
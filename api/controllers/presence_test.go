@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// newPresenceRoom opens a room with the peers a@example.com and
+// b@example.com, each on its own connection.
+func newPresenceRoom(t *testing.T) (*SocketServer, string, *testClient, *testClient) {
+	t.Helper()
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, url)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	return s, roomID, a, b
+}
+
+func typingPeers(msg testMessage) []interface{} {
+	return msg.Data["typing"].([]interface{})
+}
+
+func TestTypingExpires(t *testing.T) {
+	s, roomID, a, b := newPresenceRoom(t)
+	s.typingTimeout = 2 * presenceFlushInterval
+
+	start := time.Now()
+	a.send("typing_start", "typing", map[string]interface{}{"room_id": roomID, "email": "a@example.com"})
+	if typing := typingPeers(b.expect("typing_update")); len(typing) != 1 || typing[0] != "a@example.com" {
+		t.Fatalf("typing %v, want a@example.com", typing)
+	}
+	if typing := typingPeers(b.expect("typing_update")); len(typing) != 0 {
+		t.Fatalf("typing %v after the timeout, want nobody", typing)
+	}
+	if elapsed := time.Since(start); elapsed < s.typingTimeout {
+		t.Fatalf("typing cleared after %v, want at least %v", elapsed, s.typingTimeout)
+	}
+}
+
+// TestTypingBurstIsCoalesced sends a burst of typing changes, which reach
+// the room as a single broadcast.
+func TestTypingBurstIsCoalesced(t *testing.T) {
+	_, roomID, a, b := newPresenceRoom(t)
+
+	for i := 0; i < 3; i++ {
+		a.send("typing_start", fmt.Sprintf("a%d", i), map[string]interface{}{"room_id": roomID, "email": "a@example.com"})
+		b.send("typing_start", fmt.Sprintf("b%d", i), map[string]interface{}{"room_id": roomID, "email": "b@example.com"})
+	}
+	b.send("typing_stop", "stop", map[string]interface{}{"room_id": roomID, "email": "b@example.com"})
+
+	var updates []testMessage
+	for _, msg := range a.drain(2 * presenceFlushInterval) {
+		if msg.Action == "typing_update" {
+			updates = append(updates, msg)
+		}
+	}
+	if len(updates) != 1 {
+		t.Fatalf("got %d typing updates, want 1", len(updates))
+	}
+	if typing := typingPeers(updates[0]); len(typing) != 1 || typing[0] != "a@example.com" {
+		t.Fatalf("typing %v, want a@example.com", typing)
+	}
+}
+
+func TestReadWatermarkNeverMovesBack(t *testing.T) {
+	s, roomID, a, b := newPresenceRoom(t)
+
+	for i := 0; i < 3; i++ {
+		requestID := fmt.Sprintf("chat%d", i)
+		a.send("chat_message", requestID, map[string]interface{}{"room_id": roomID, "email": "a@example.com", "message": "hi"})
+		a.expectMatch("ack", func(m testMessage) bool { return m.RequestID == requestID })
+	}
+	read := func(seq int) {
+		t.Helper()
+		requestID := fmt.Sprintf("read%d", seq)
+		b.send("chat_read", requestID, map[string]interface{}{"room_id": roomID, "email": "b@example.com", "seq": seq})
+		b.expectMatch("ack", func(m testMessage) bool { return m.RequestID == requestID })
+	}
+
+	read(3)
+	receipt := a.expect("read_receipts")
+	if reads := receipt.Data["reads"].(map[string]interface{}); reads["b@example.com"] != float64(3) {
+		t.Fatalf("reads %v, want b@example.com at 3", reads)
+	}
+	read(1)
+	for _, msg := range a.drain(2 * presenceFlushInterval) {
+		if msg.Action == "read_receipts" {
+			t.Fatalf("watermark moved back: %v", msg.Data["reads"])
+		}
+	}
+	val, _ := s.presence.Load(roomID)
+	if seq := val.(*roomPresence).reads["b@example.com"]; seq != 3 {
+		t.Fatalf("watermark at %d, want 3", seq)
+	}
+}
+
+func TestTypingInUnknownRoom(t *testing.T) {
+	s, _, _, _ := newPresenceRoom(t)
+
+	err := s.handleTyping(nil, types.TypingData{RoomID: "missing", Email: "a@example.com"}, true)
+	if err != types.ErrRoomNotFound {
+		t.Fatalf("got %v, want %v", err, types.ErrRoomNotFound)
+	}
+	if _, ok := s.presence.Load("missing"); ok {
+		t.Fatal("kept presence for a room that does not exist")
+	}
+}
@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+const (
+	// defaultProtocolVersion is used by clients that neither request a
+	// subprotocol nor send a hello.
+	defaultProtocolVersion = 1
+	subprotocolPrefix      = "goparty.v"
+)
+
+//go:embed schema/*.json
+var schemaFiles embed.FS
+
+// protocol describes one version of the socket protocol. The actions a
+// client may send come from the action registry of the server, the events
+// the server emits are listed here.
+type protocol struct {
+	Version int
+	Events  map[string]struct{}
+}
+
+var protocols = map[int]*protocol{}
+
+func registerProtocol(version int, events []string) {
+	p := &protocol{
+		Version: version,
+		Events:  make(map[string]struct{}, len(events)),
+	}
+	for _, e := range events {
+		p.Events[e] = struct{}{}
+	}
+	protocols[version] = p
+}
+
+func init() {
+	registerProtocol(1, []string{
+		"hello", "ack", "error", "user_joined", "user_left", "update_player_state",
+		"update_timestamp", "chat_message", "typing_update", "read_receipts", "session", "resumed",
+		"countdown", "room_state_changed",
+	})
+	// v2 replaces the full room dumps of user_joined and user_left with
+	// revisioned deltas.
+	registerProtocol(2, []string{
+		"hello", "ack", "error", "room_state", "peer_added", "peer_removed", "peer_updated", "room_patch",
+		"update_player_state", "update_timestamp", "chat_message", "typing_update", "read_receipts",
+		"session", "resumed", "countdown", "room_state_changed",
+	})
+}
+
+func (p *protocol) subprotocol() string {
+	return subprotocolPrefix + strconv.Itoa(p.Version)
+}
+
+func supportedVersions() []int {
+	versions := make([]int, 0, len(protocols))
+	for v := range protocols {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// subprotocols lists the Sec-WebSocket-Protocol values offered by the
+// upgrader, newest first. Every version can be combined with MessagePack by
+// appending "+msgpack", e.g. "goparty.v1+msgpack".
+func subprotocols() []string {
+	versions := supportedVersions()
+	names := make([]string, 0, 2*len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		name := protocols[versions[i]].subprotocol()
+		names = append(names, name+msgpackSubprotocolSuffix, name)
+	}
+	return names
+}
+
+// protocolForConn picks the protocol and encoding negotiated during the
+// upgrade, falling back to the default version and JSON.
+func protocolForConn(conn *websocket.Conn) (*protocol, encoding) {
+	name := conn.Subprotocol()
+	enc := encodingJSON
+	if strings.HasSuffix(name, msgpackSubprotocolSuffix) {
+		name = strings.TrimSuffix(name, msgpackSubprotocolSuffix)
+		enc = encodingMsgpack
+	}
+	if strings.HasPrefix(name, subprotocolPrefix) {
+		if v, err := strconv.Atoi(strings.TrimPrefix(name, subprotocolPrefix)); err == nil {
+			if p, ok := protocols[v]; ok {
+				return p, enc
+			}
+		}
+	}
+	return protocols[defaultProtocolVersion], encodingJSON
+}
+
+func (s *SocketServer) handleHello(ctx *ActionContext) (interface{}, error) {
+	hello := ctx.Payload.(*types.HelloData)
+
+	var chosen *protocol
+	for _, v := range hello.Versions {
+		if p, ok := protocols[v]; ok && (chosen == nil || p.Version > chosen.Version) {
+			chosen = p
+		}
+	}
+	if chosen == nil {
+		return nil, types.NewSocketError(types.CodeUnsupportedVersion,
+			fmt.Sprintf("Unsupported protocol version, server supports %v", supportedVersions()))
+	}
+	enc := ctx.client.getEncoding()
+	if hello.Encoding != "" {
+		var ok bool
+		if enc, ok = parseEncoding(hello.Encoding); !ok {
+			return nil, types.NewSocketError(types.CodeInvalidPayload, "Unsupported encoding")
+		}
+	}
+	ctx.client.setProtocol(chosen)
+
+	// The reply still uses the encoding the hello was negotiated in; the new
+	// encoding applies to every message after it.
+	err := ctx.Reply("hello", map[string]interface{}{
+		"version":   chosen.Version,
+		"versions":  supportedVersions(),
+		"encoding":  enc.String(),
+		"encodings": []string{encodingJSON.String(), encodingMsgpack.String()},
+	})
+	ctx.client.setEncoding(enc)
+	return nil, err
+}
+
+type protocolSchema struct {
+	Version int                        `json:"version"`
+	Actions map[string]schemaAction    `json:"actions"`
+	Events  map[string]json.RawMessage `json:"events"`
+}
+
+type schemaAction struct {
+	Data *struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+		Required   []string                   `json:"required"`
+	} `json:"data"`
+}
+
+// loadProtocolSchemas attaches the documented schema to every protocol
+// version and fails when the schema and the registered actions disagree,
+// either about which actions and events exist or about their payload fields.
+func (s *SocketServer) loadProtocolSchemas() error {
+	s.schemas = make(map[int][]byte, len(protocols))
+	for _, v := range supportedVersions() {
+		p := protocols[v]
+		raw, err := schemaFiles.ReadFile(fmt.Sprintf("schema/v%d.json", v))
+		if err != nil {
+			return fmt.Errorf("protocol v%d: missing schema: %v", v, err)
+		}
+		var schema protocolSchema
+		if err := json.Unmarshal(raw, &schema); err != nil {
+			return fmt.Errorf("protocol v%d: invalid schema: %v", v, err)
+		}
+		if schema.Version != v {
+			return fmt.Errorf("protocol v%d: schema declares version %d", v, schema.Version)
+		}
+		actions := make(map[string]struct{})
+		for _, a := range s.actionsForVersion(v) {
+			actions[a.Name] = struct{}{}
+			if err := checkActionSchema(a, schema.Actions[a.Name]); err != nil {
+				return fmt.Errorf("protocol v%d: %v", v, err)
+			}
+		}
+		if err := compareNames("action", actions, keys(schema.Actions)); err != nil {
+			return fmt.Errorf("protocol v%d: %v", v, err)
+		}
+		if err := compareNames("event", p.Events, keys(schema.Events)); err != nil {
+			return fmt.Errorf("protocol v%d: %v", v, err)
+		}
+		s.schemas[v] = raw
+	}
+	return nil
+}
+
+// checkActionSchema compares the JSON fields of the registered payload type
+// and its required keys with the documented data schema.
+func checkActionSchema(a *Action, documented schemaAction) error {
+	if a.NewPayload == nil || documented.Data == nil {
+		if a.NewPayload != nil || documented.Data != nil {
+			return fmt.Errorf("action %q: payload presence differs from schema", a.Name)
+		}
+		return nil
+	}
+
+	fields := make(map[string]struct{})
+	t := reflect.TypeOf(a.NewPayload()).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = struct{}{}
+		}
+	}
+	if err := compareNames(a.Name+" field", fields, keys(documented.Data.Properties)); err != nil {
+		return err
+	}
+
+	required := make(map[string]struct{})
+	for _, r := range a.Required {
+		required[r] = struct{}{}
+	}
+	documentedRequired := make(map[string]struct{})
+	for _, r := range documented.Data.Required {
+		documentedRequired[r] = struct{}{}
+	}
+	return compareNames(a.Name+" required field", required, documentedRequired)
+}
+
+func keys[V any](m map[string]V) map[string]struct{} {
+	set := make(map[string]struct{}, len(m))
+	for k := range m {
+		set[k] = struct{}{}
+	}
+	return set
+}
+
+func compareNames(kind string, registered, documented map[string]struct{}) error {
+	for name := range registered {
+		if _, ok := documented[name]; !ok {
+			return fmt.Errorf("%s %q is not documented", kind, name)
+		}
+	}
+	for name := range documented {
+		if _, ok := registered[name]; !ok {
+			return fmt.Errorf("%s %q is documented but not registered", kind, name)
+		}
+	}
+	return nil
+}
+
+// HandleProtocolSchema serves the machine readable schema of a protocol
+// version, selected with ?version=N and defaulting to the newest one.
+func (s *SocketServer) HandleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	if r.Method != http.MethodGet {
+		writer.WriteError(http.StatusMethodNotAllowed, utils.ErrMethodNotAllowed.Error())
+		return
+	}
+
+	versions := supportedVersions()
+	version := versions[len(versions)-1]
+	if q := r.URL.Query().Get("version"); q != "" {
+		v, err := strconv.Atoi(q)
+		if err != nil {
+			writer.WriteError(http.StatusBadRequest, "invalid version")
+			return
+		}
+		version = v
+	}
+	schema, ok := s.schemas[version]
+	if !ok {
+		writer.WriteError(http.StatusNotFound, "unknown protocol version")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(schema)
+}
@@ -0,0 +1,404 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// schemaValidator checks JSON values against the subset of JSON Schema the
+// protocol schemas use.
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+func loadSchemaValidator(t *testing.T, version int) schemaValidator {
+	t.Helper()
+	raw, err := schemaFiles.ReadFile(fmt.Sprintf("schema/v%d.json", version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root map[string]interface{}
+	if err := decodeJSONNumbers(raw, &root); err != nil {
+		t.Fatal(err)
+	}
+	return schemaValidator{root: root}
+}
+
+// decodeJSONNumbers decodes data keeping numbers as json.Number, which tells
+// integers apart.
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// lookup returns the schema at a path of the schema document, e.g.
+// "events", "chat_message", "data".
+func (v schemaValidator) lookup(path ...string) (map[string]interface{}, bool) {
+	node := v.root
+	for _, key := range path {
+		next, ok := node[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		node = next
+	}
+	return node, true
+}
+
+func (v schemaValidator) section(name string) map[string]interface{} {
+	section, _ := v.lookup(name)
+	return section
+}
+
+func (v schemaValidator) validate(path string, schema map[string]interface{}, value interface{}) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := v.lookup(strings.Split(strings.TrimPrefix(ref, "#/"), "/")...)
+		if !ok {
+			return fmt.Errorf("%s: unresolved $ref %s", path, ref)
+		}
+		return v.validate(path, resolved, value)
+	}
+	if want, ok := schema["type"]; ok && !matchesSchemaType(want, value) {
+		return fmt.Errorf("%s: %s is not of type %v", path, jsonType(value), want)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch val := value.(type) {
+	case string:
+		n := json.Number(fmt.Sprint(utf8.RuneCountInString(val)))
+		if min, ok := schema["minLength"].(json.Number); ok && compareNumbers(n, min) < 0 {
+			return fmt.Errorf("%s: shorter than %s", path, min)
+		}
+		if max, ok := schema["maxLength"].(json.Number); ok && compareNumbers(n, max) > 0 {
+			return fmt.Errorf("%s: longer than %s", path, max)
+		}
+		return checkSchemaFormat(path, schema["format"], val)
+	case json.Number:
+		if min, ok := schema["minimum"].(json.Number); ok && compareNumbers(val, min) < 0 {
+			return fmt.Errorf("%s: %s is below %s", path, val, min)
+		}
+	case []interface{}:
+		if min, ok := schema["minItems"].(json.Number); ok && compareNumbers(json.Number(fmt.Sprint(len(val))), min) < 0 {
+			return fmt.Errorf("%s: fewer than %s items", path, min)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				if err := v.validate(fmt.Sprintf("%s[%d]", path, i), items, item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		return v.validateObject(path, schema, val)
+	}
+	return nil
+}
+
+func (v schemaValidator) validateObject(path string, schema map[string]interface{}, value map[string]interface{}) error {
+	required, _ := schema["required"].([]interface{})
+	for _, key := range required {
+		if _, ok := value[key.(string)]; !ok {
+			return fmt.Errorf("%s: missing %s", path, key)
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for key, field := range value {
+		if property, ok := properties[key].(map[string]interface{}); ok {
+			if err := v.validate(path+"."+key, property, field); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property %s", path, key)
+			}
+		case map[string]interface{}:
+			if err := v.validate(path+"."+key, additional, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func jsonType(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func matchesSchemaType(want interface{}, value interface{}) bool {
+	got := jsonType(value)
+	types, ok := want.([]interface{})
+	if !ok {
+		types = []interface{}{want}
+	}
+	for _, t := range types {
+		if t == got || (t == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func compareNumbers(a, b json.Number) int {
+	x, _ := a.Float64()
+	y, _ := b.Float64()
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func checkSchemaFormat(path string, format interface{}, value string) error {
+	switch format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			return fmt.Errorf("%s: %q is no date-time", path, value)
+		}
+	case "uuid":
+		if _, err := uuid.Parse(value); err != nil {
+			return fmt.Errorf("%s: %q is no uuid", path, value)
+		}
+	}
+	return nil
+}
+
+type actionFixtures struct {
+	Valid   []json.RawMessage `json:"valid"`
+	Invalid []json.RawMessage `json:"invalid"`
+}
+
+func loadActionFixtures(t *testing.T) map[string]actionFixtures {
+	t.Helper()
+	data, err := os.ReadFile("testdata/protocol/actions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures map[string]actionFixtures
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	return fixtures
+}
+
+// TestActionFixturesMatchSchemas checks that the schema of every version
+// accepts the valid payload fixtures of its actions and rejects the invalid
+// ones, and that the server decodes them the same way.
+func TestActionFixturesMatchSchemas(t *testing.T) {
+	s, _ := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+	fixtures := loadActionFixtures(t)
+
+	for _, version := range supportedVersions() {
+		v := loadSchemaValidator(t, version)
+		actions := v.section("actions")
+		for name := range actions {
+			schema, _ := v.lookup("actions", name, "data")
+			action, ok := s.lookupAction(name, version)
+			if !ok {
+				t.Fatalf("v%d: action %s is not registered", version, name)
+			}
+			cases, ok := fixtures[name]
+			if !ok || len(cases.Valid) == 0 {
+				t.Errorf("v%d: no valid fixture for action %s", version, name)
+				continue
+			}
+			for i, raw := range cases.Valid {
+				if err := validateFixture(v, schema, raw); err != nil {
+					t.Errorf("v%d: valid %s fixture %d: %v", version, name, i, err)
+				}
+				if err := decodeFixture(action, raw); err != nil {
+					t.Errorf("v%d: server rejects valid %s fixture %d: %v", version, name, i, err)
+				}
+			}
+			for i, raw := range cases.Invalid {
+				if validateFixture(v, schema, raw) == nil {
+					t.Errorf("v%d: schema accepts invalid %s fixture %d", version, name, i)
+				}
+				if decodeFixture(action, raw) == nil {
+					t.Errorf("v%d: server accepts invalid %s fixture %d", version, name, i)
+				}
+			}
+		}
+	}
+	for name := range fixtures {
+		if _, ok := s.lookupAction(name, supportedVersions()[len(supportedVersions())-1]); !ok {
+			t.Errorf("fixture for unknown action %s", name)
+		}
+	}
+}
+
+func validateFixture(v schemaValidator, schema map[string]interface{}, raw json.RawMessage) error {
+	var value interface{}
+	if err := decodeJSONNumbers(raw, &value); err != nil {
+		return err
+	}
+	return v.validate("data", schema, value)
+}
+
+func decodeFixture(action *Action, raw json.RawMessage) error {
+	payload := action.NewPayload()
+	return decodePayload(types.IncomingMessage{Action: action.Name, Data: raw}, payload, action.Required...)
+}
+
+// TestServerEventsMatchSchemas drives a room with clients of every version
+// and checks every message they receive against the schema of the version.
+func TestServerEventsMatchSchemas(t *testing.T) {
+	for _, version := range supportedVersions() {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			st := storage.NewMemoryStorage()
+			addTestUsers(st, "a@example.com", "b@example.com")
+			_, url := newTestNode(t, st, storage.NewMemoryBus())
+			subprotocol := fmt.Sprintf("goparty.v%d", version)
+
+			a := dialTestClient(t, url, subprotocol)
+			// Public, for the observer to subscribe to.
+			a.send("create_room", "create", map[string]interface{}{
+				"email":        "a@example.com",
+				"video_source": "https://videos.example.com/a.mp4",
+				"timestamp":    map[string]interface{}{"start": 0, "end": 3600, "current": 0},
+				"public":       true,
+			})
+			created := a.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "create" })
+			roomID := created.Data["result"].(map[string]interface{})["room_id"].(string)
+			b := dialTestClient(t, url, subprotocol)
+			observer := dialTestClient(t, url, subprotocol)
+
+			b.send("join_room", "join", map[string]interface{}{"room_id": roomID, "email": "b@example.com"})
+			b.expect("session")
+			observer.send("subscribe_room", "sub", map[string]interface{}{"room_id": roomID})
+			observer.expect("ack")
+			member := map[string]interface{}{"room_id": roomID, "email": "b@example.com"}
+			b.send("typing_start", "", member)
+			b.send("chat_message", "chat", map[string]interface{}{"room_id": roomID, "email": "b@example.com", "message": "hi @a", "id": "m1"})
+			a.expect("chat_message")
+			a.send("chat_read", "read", map[string]interface{}{"room_id": roomID, "email": "a@example.com", "seq": 1})
+			a.send("player_state", "", map[string]interface{}{"room_id": roomID, "email": "a@example.com", "paused": true})
+			a.send("update_timestamp", "", map[string]interface{}{"room_id": roomID, "email": "a@example.com", "timestamp": 12.5, "seeking": true})
+			a.send("ping", "ping", map[string]interface{}{"email": "a@example.com"})
+			a.send("hello", "hello", map[string]interface{}{"versions": []int{version}})
+			a.send("bogus", "bogus", map[string]interface{}{})
+			if version >= deltaProtocolVersion {
+				a.send("room_sync", "", map[string]interface{}{"room_id": roomID, "email": "a@example.com"})
+			}
+			b.send("leave_room", "leave", member)
+			b.expect("ack")
+
+			v := loadSchemaValidator(t, version)
+			envelope := v.section("envelope")
+			seen := make(map[string]bool)
+			for _, c := range []*testClient{a, b, observer} {
+				for _, msg := range c.drain(400 * time.Millisecond) {
+					seen[msg.Action] = true
+					var value map[string]interface{}
+					if err := decodeJSONNumbers([]byte(msg.raw), &value); err != nil {
+						t.Fatal(err)
+					}
+					if err := v.validate("message", envelope, value); err != nil {
+						t.Errorf("%v: %s", err, msg.raw)
+					}
+					schema, ok := v.lookup("events", msg.Action, "data")
+					if !ok {
+						t.Errorf("undocumented event %s: %s", msg.Action, msg.raw)
+						continue
+					}
+					if err := v.validate(msg.Action, schema, value["data"]); err != nil {
+						t.Errorf("%v: %s", err, msg.raw)
+					}
+				}
+			}
+
+			want := []string{"ack", "error", "hello", "chat_message", "typing_update", "read_receipts",
+				"update_player_state", "update_timestamp"}
+			if version >= deltaProtocolVersion {
+				want = append(want, "room_state", "peer_added", "peer_removed")
+			} else {
+				want = append(want, "user_joined", "user_left")
+			}
+			for _, action := range want {
+				if !seen[action] {
+					t.Errorf("no %s event was checked", action)
+				}
+			}
+		})
+	}
+}
+
+// TestRoomMatchesSchema checks that every field of a marshalled room and
+// its peers is documented.
+func TestRoomMatchesSchema(t *testing.T) {
+	room := types.NewRoom(uuid.New(), "a@example.com", "video", types.TimeStamp{End: 60})
+	room.Schedule(time.Now().Add(time.Hour))
+	room.SetRSVP("b@example.com", true)
+	room.AddPeer(&types.Peer{Email: "a@example.com", Connection: "127.0.0.1:1", JoinedAt: time.Now(), Status: types.PeerConnected, Devices: 1})
+	data, err := json.Marshal(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]interface{}
+	if err := decodeJSONNumbers(data, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range supportedVersions() {
+		v := loadSchemaValidator(t, version)
+		roomSchema, _ := v.lookup("$defs", "room")
+		if err := v.validate("room", roomSchema, value); err != nil {
+			t.Errorf("v%d: %v", version, err)
+		}
+		roomProperties, _ := v.lookup("$defs", "room", "properties")
+		peerProperties, _ := v.lookup("$defs", "peer", "properties")
+		for key := range value {
+			if _, ok := roomProperties[key]; !ok {
+				t.Errorf("v%d: room field %s is not documented", version, key)
+			}
+		}
+		for key := range value["peers"].(map[string]interface{})["a@example.com"].(map[string]interface{}) {
+			if _, ok := peerProperties[key]; !ok {
+				t.Errorf("v%d: peer field %s is not documented", version, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/raghavyuva/go-party/utils"
+)
+
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimits configures the token buckets applied in readLoop. Connection
+// caps all traffic of a socket and is checked before a frame is decoded.
+// Every action is additionally capped by the limit it was registered with,
+// unless Actions overrides it. A client that gets limited MaxViolations times
+// within ViolationWindow is disconnected.
+type RateLimits struct {
+	Connection      RateLimit
+	Actions         map[string]RateLimit
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Connection:      RateLimit{PerSecond: 20, Burst: 40},
+		Actions:         map[string]RateLimit{},
+		MaxViolations:   20,
+		ViolationWindow: 10 * time.Second,
+	}
+}
+
+func loadRateLimitsFromEnv() RateLimits {
+	limits := DefaultRateLimits()
+	if v, err := strconv.ParseFloat(os.Getenv("WS_MESSAGES_PER_SECOND"), 64); err == nil && v > 0 {
+		limits.Connection.PerSecond = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_MESSAGE_BURST")); err == nil && v > 0 {
+		limits.Connection.Burst = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_MAX_RATE_VIOLATIONS")); err == nil && v > 0 {
+		limits.MaxViolations = v
+	}
+	return limits
+}
+
+// rateLimitFor returns the limit applied to an action, which is the zero
+// (unlimited) value for unknown actions.
+func (s *SocketServer) rateLimitFor(a *Action) RateLimit {
+	if a == nil {
+		return RateLimit{}
+	}
+	if limit, ok := s.rateLimits.Actions[a.Name]; ok {
+		return limit
+	}
+	return a.RateLimit
+}
+
+// connLimiter is owned by a single readLoop and is not safe for concurrent
+// use.
+type connLimiter struct {
+	limits      RateLimits
+	conn        *utils.TokenBucket
+	actions     map[string]*utils.TokenBucket
+	violations  int
+	windowStart time.Time
+}
+
+func newConnLimiter(limits RateLimits) *connLimiter {
+	return &connLimiter{
+		limits:  limits,
+		conn:    utils.NewTokenBucket(limits.Connection.PerSecond, limits.Connection.Burst),
+		actions: make(map[string]*utils.TokenBucket),
+	}
+}
+
+// allowFrame reports whether a frame of the connection may be decoded now
+// and, if not, how long the client should back off.
+func (l *connLimiter) allowFrame() (bool, time.Duration) {
+	return l.conn.Take()
+}
+
+// allowAction reports whether the action of a frame allowFrame let through
+// may be handled now and, if not, how long the client should back off. A
+// refused action gives the token of its frame back to the connection.
+func (l *connLimiter) allowAction(action string, limit RateLimit) (bool, time.Duration) {
+	if limit.PerSecond <= 0 && limit.Burst <= 0 {
+		return true, 0
+	}
+	bucket, ok := l.actions[action]
+	if !ok {
+		bucket = utils.NewTokenBucket(limit.PerSecond, limit.Burst)
+		l.actions[action] = bucket
+	}
+	ok, wait := bucket.Take()
+	if !ok {
+		l.conn.Refund()
+	}
+	return ok, wait
+}
+
+// recordViolation returns true once the client exceeded its limits too often
+// and should be disconnected.
+func (l *connLimiter) recordViolation() bool {
+	now := time.Now()
+	if now.Sub(l.windowStart) > l.limits.ViolationWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+	return l.limits.MaxViolations > 0 && l.violations >= l.limits.MaxViolations
+}
@@ -0,0 +1,29 @@
+package controllers
+
+import "testing"
+
+func TestConnLimiterRefundsRefusedActions(t *testing.T) {
+	limits := DefaultRateLimits()
+	limits.Connection = RateLimit{PerSecond: 0, Burst: 3}
+	limiter := newConnLimiter(limits)
+	chat := RateLimit{PerSecond: 0, Burst: 1}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allowFrame(); !ok {
+			t.Fatalf("frame %d: refused", i)
+		}
+		ok, _ := limiter.allowAction("chat", chat)
+		if want := i == 0; ok != want {
+			t.Fatalf("action %d: allowed %v, want %v", i, ok, want)
+		}
+	}
+	// The refused chat gave its token back: two frames are left.
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allowFrame(); !ok {
+			t.Fatalf("frame after refund %d: refused", i)
+		}
+	}
+	if ok, _ := limiter.allowFrame(); ok {
+		t.Fatal("frame beyond the burst allowed")
+	}
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// Payload is implemented by every action payload in the types package.
+type Payload interface {
+	Validate() error
+}
+
+// actor is implemented by payloads that act on behalf of a peer, which is
+// what the role checks are based on.
+type actor interface {
+	Actor() (roomID string, email string)
+}
+
+// Role is the minimum relationship between a connection and the payload of
+// an action required to run it.
+type Role int
+
+const (
+	// RoleNone lets any connection run the action.
+	RoleNone Role = iota
+	// RoleSelf requires the payload email to be the identity of the
+	// connection.
+	RoleSelf
+	// RoleMember additionally requires the connection to have joined the
+	// payload room as that identity.
+	RoleMember
+	// RoleCreator additionally requires the peer to have created the room.
+	RoleCreator
+)
+
+// ActionContext is passed through the middleware chain to a handler.
+type ActionContext struct {
+	Conn    *websocket.Conn
+	Message types.IncomingMessage
+	// Payload holds the decoded payload once the action passed decoding.
+	Payload Payload
+	// Room is set for actions that require RoleMember or above.
+	Room *types.Room
+
+	client *client
+	server *SocketServer
+}
+
+// Reply writes an event to the connection that sent the message, tagged with
+// its request ID.
+func (ctx *ActionContext) Reply(action string, data interface{}) error {
+	return ctx.server.sendTo(ctx.Conn, types.Message{
+		Action:    action,
+		RequestID: ctx.Message.RequestID,
+		Data:      data,
+	})
+}
+
+// HandlerFunc returns the result echoed to the client in the ack.
+type HandlerFunc func(ctx *ActionContext) (interface{}, error)
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Action describes a socket action. Registering one is all it takes to expose
+// it: the read loop looks actions up here, applies their rate limit and runs
+// them through the middleware chain.
+type Action struct {
+	Name string
+	// NewPayload returns a pointer to a fresh payload value. Actions without
+	// payload leave it nil.
+	NewPayload func() Payload
+	// Required lists the payload keys that must be present.
+	Required  []string
+	Role      Role
+	RateLimit RateLimit
+	// Versions lists the protocol versions offering the action; empty means
+	// every version.
+	Versions []int
+	// NoAck suppresses the ack for actions that reply on their own.
+	NoAck   bool
+	Handler HandlerFunc
+}
+
+func (a *Action) inVersion(version int) bool {
+	if len(a.Versions) == 0 {
+		return true
+	}
+	for _, v := range a.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterAction adds an action to the server. It panics on invalid or
+// duplicate registrations, which are programming errors.
+func (s *SocketServer) RegisterAction(a Action) {
+	if a.Name == "" || a.Handler == nil {
+		panic("controllers: action needs a name and a handler")
+	}
+	if a.Role != RoleNone {
+		if a.NewPayload == nil {
+			panic(fmt.Sprintf("controllers: action %q requires a payload for its role", a.Name))
+		}
+		if _, ok := a.NewPayload().(actor); !ok {
+			panic(fmt.Sprintf("controllers: payload of action %q does not identify a peer", a.Name))
+		}
+	}
+	if _, loaded := s.actions.LoadOrStore(a.Name, &a); loaded {
+		panic(fmt.Sprintf("controllers: action %q registered twice", a.Name))
+	}
+}
+
+// Use appends middleware. Middleware registered first runs outermost.
+func (s *SocketServer) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+func (s *SocketServer) lookupAction(name string, version int) (*Action, bool) {
+	val, ok := s.actions.Load(name)
+	if !ok {
+		return nil, false
+	}
+	a := val.(*Action)
+	if !a.inVersion(version) {
+		return nil, false
+	}
+	return a, true
+}
+
+func (s *SocketServer) actionsForVersion(version int) []*Action {
+	var actions []*Action
+	s.actions.Range(func(_, val interface{}) bool {
+		if a := val.(*Action); a.inVersion(version) {
+			actions = append(actions, a)
+		}
+		return true
+	})
+	return actions
+}
+
+func (s *SocketServer) handleMessage(c *client, a *Action, msg types.IncomingMessage) {
+	ctx := &ActionContext{
+		Conn:    c.conn,
+		Message: msg,
+		client:  c,
+		server:  s,
+	}
+
+	handler := s.invoke(a)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+
+	result, err := handler(ctx)
+	if err != nil {
+		s.sendError(c.conn, msg, err)
+		return
+	}
+	if !a.NoAck {
+		s.sendAck(c.conn, msg, result)
+	}
+}
+
+// invoke decodes the payload and checks the role before calling the
+// handler, so middleware sees those failures like any other handler error.
+func (s *SocketServer) invoke(a *Action) HandlerFunc {
+	return func(ctx *ActionContext) (interface{}, error) {
+		if a.NewPayload != nil {
+			p := a.NewPayload()
+			if err := decodePayload(ctx.Message, p, a.Required...); err != nil {
+				return nil, invalidPayload(fmt.Sprintf("Invalid %s data", strings.ReplaceAll(a.Name, "_", " ")), err)
+			}
+			ctx.Payload = p
+		}
+		if err := s.checkRole(ctx, a.Role); err != nil {
+			return nil, err
+		}
+		return a.Handler(ctx)
+	}
+}
+
+func (s *SocketServer) checkRole(ctx *ActionContext, role Role) error {
+	if role == RoleNone {
+		return nil
+	}
+	roomID, email := ctx.Payload.(actor).Actor()
+	if err := s.authorize(ctx.Conn, email); err != nil {
+		return err
+	}
+	if role == RoleSelf {
+		return nil
+	}
+
+	roomVal, ok := s.rooms.Load(roomID)
+	if !ok {
+		return types.ErrRoomNotFound
+	}
+	room := roomVal.(*types.Room)
+	if joinedAs, ok := ctx.client.subscription(roomID); !ok || joinedAs != email {
+		return types.ErrPeerNotFound
+	}
+	if role == RoleCreator && room.CreatedBy != email {
+		return types.ErrNotAuthorized
+	}
+	ctx.Room = room
+	return nil
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+func expectPanic(t *testing.T, want string, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if r == nil {
+			t.Fatalf("no panic, want one about %q", want)
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, want) {
+			t.Fatalf("panicked with %v, want %q", r, want)
+		}
+	}()
+	f()
+}
+
+func TestInvalidRegistrationsPanic(t *testing.T) {
+	s, _ := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+	handler := func(*ActionContext) (interface{}, error) { return nil, nil }
+
+	expectPanic(t, "registered twice", func() {
+		s.RegisterAction(Action{Name: "join_room", Handler: handler})
+	})
+	expectPanic(t, "needs a name and a handler", func() {
+		s.RegisterAction(Action{Name: "no_handler"})
+	})
+	expectPanic(t, "requires a payload", func() {
+		s.RegisterAction(Action{Name: "no_payload", Role: RoleSelf, Handler: handler})
+	})
+	expectPanic(t, "does not identify a peer", func() {
+		s.RegisterAction(Action{
+			Name:       "anonymous_payload",
+			NewPayload: func() Payload { return &types.SubscribeRoomData{} },
+			Role:       RoleSelf,
+			Handler:    handler,
+		})
+	})
+}
+
+// TestMiddlewareRunsInOrder registers two middleware. The first runs
+// outermost, around the second and the handler.
+func TestMiddlewareRunsInOrder(t *testing.T) {
+	s, url := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	named := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *ActionContext) (interface{}, error) {
+				record(name + " in")
+				defer record(name + " out")
+				return next(ctx)
+			}
+		}
+	}
+	s.Use(named("first"), named("second"))
+	s.RegisterAction(Action{
+		Name: "test_echo",
+		Handler: func(*ActionContext) (interface{}, error) {
+			record("handler")
+			return nil, nil
+		},
+	})
+
+	c := dialTestClient(t, url)
+	c.send("test_echo", "echo", map[string]interface{}{})
+	c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "echo" })
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"first in", "second in", "handler", "second out", "first out"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("calls %v, want %v", calls, want)
+	}
+}
+
+// TestPanickingHandler runs an action that panics. The client gets an
+// internal error and keeps its connection.
+func TestPanickingHandler(t *testing.T) {
+	s, url := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+	s.RegisterAction(Action{
+		Name:    "test_panic",
+		Handler: func(*ActionContext) (interface{}, error) { panic("boom") },
+	})
+	s.RegisterAction(Action{
+		Name:    "test_echo",
+		Handler: func(*ActionContext) (interface{}, error) { return "pong", nil },
+	})
+
+	c := dialTestClient(t, url)
+	c.send("test_panic", "panic", map[string]interface{}{})
+	msg := c.expectMatch("error", func(m testMessage) bool { return m.RequestID == "panic" })
+	if msg.Data["code"] != string(types.CodeInternal) {
+		t.Fatalf("panic reported as %v, want %s", msg.Data["code"], types.CodeInternal)
+	}
+	c.send("test_echo", "echo", map[string]interface{}{})
+	if ack := c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "echo" }); ack.Data["result"] != "pong" {
+		t.Fatalf("ack %v after the panic, want pong", ack.Data)
+	}
+}
+
+// TestActionsAreRejectedByRole runs an action per role from connections
+// that fall short of it.
+func TestActionsAreRejectedByRole(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com", "c@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	for name, role := range map[string]Role{"test_self": RoleSelf, "test_member": RoleMember, "test_creator": RoleCreator} {
+		s.RegisterAction(Action{
+			Name:       name,
+			NewPayload: func() Payload { return &types.TypingData{} },
+			Required:   []string{"room_id", "email"},
+			Role:       role,
+			Handler:    func(*ActionContext) (interface{}, error) { return nil, nil },
+		})
+	}
+
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, url)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	// c acts as itself, but in a room of its own.
+	c := dialTestClient(t, url)
+	c.createTestRoom("c@example.com")
+	stranger := dialTestClient(t, url)
+
+	tests := []struct {
+		action string
+		client *testClient
+		email  string
+		code   types.ErrorCode
+	}{
+		{"test_self", stranger, "a@example.com", types.CodeNotAuthorized},
+		{"test_self", b, "a@example.com", types.CodeNotAuthorized},
+		{"test_self", c, "c@example.com", ""},
+		{"test_member", c, "c@example.com", types.CodeNotInRoom},
+		{"test_member", b, "b@example.com", ""},
+		{"test_creator", b, "b@example.com", types.CodeNotAuthorized},
+		{"test_creator", a, "a@example.com", ""},
+	}
+	for i, tt := range tests {
+		requestID := tt.action + string(rune('a'+i))
+		tt.client.send(tt.action, requestID, map[string]interface{}{"room_id": roomID, "email": tt.email})
+		if tt.code == "" {
+			tt.client.expectMatch("ack", func(m testMessage) bool { return m.RequestID == requestID })
+			continue
+		}
+		msg := tt.client.expectMatch("error", func(m testMessage) bool { return m.RequestID == requestID })
+		if msg.Data["code"] != string(tt.code) {
+			t.Fatalf("%s as %s got %v, want %s", tt.action, tt.email, msg.Data["code"], tt.code)
+		}
+	}
+}
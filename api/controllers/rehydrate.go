@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+const (
+	// rehydrateGracePeriod is how long the peers of a room restored from
+	// storage have to join it again before they are removed, unless another
+	// node reports them connected. They lost their connections and resume
+	// tokens with the process that persisted the room.
+	rehydrateGracePeriod = time.Minute
+	// defaultStaleRoomAge is how long a persisted room may go unchanged
+	// before it is no longer restored.
+	defaultStaleRoomAge = 12 * time.Hour
+)
+
+func loadStaleRoomAgeFromEnv() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("STALE_ROOM_AGE")); err == nil && v > 0 {
+		return v
+	}
+	return defaultStaleRoomAge
+}
+
+// rehydrateRooms restores the rooms persisted by a previous process and
+// deletes the ones that went stale.
+func (s *SocketServer) rehydrateRooms() {
+	now := time.Now()
+	s.sweepStaleRooms(now)
+	cutoff := float64(now.Add(-s.staleRoomAge).Unix())
+	count := 0
+	for _, id := range s.storage.ZRangeByScore(roomActivityKey, cutoff, math.Inf(1)) {
+		if _, ok := s.loadRoom(id); ok {
+			count++
+		}
+	}
+	fmt.Printf("Rehydrated %d rooms from storage\n", count)
+}
+
+// loadRoom returns the room from memory, falling back to storage for rooms
+// this process does not know yet.
+func (s *SocketServer) loadRoom(id string) (*types.Room, bool) {
+	if roomVal, ok := s.rooms.Load(id); ok {
+		return roomVal.(*types.Room), true
+	}
+	return s.restoreRoom(id)
+}
+
+// restoreRoom loads a persisted room and takes it over unless another node
+// owns it. The copy of a room another node owns is only as new as the owner
+// last stored it, so it asks the owner for the room. Closed and stale rooms
+// are deleted from storage instead. Rooms without peers are kept: rooms
+// created over the REST API wait for theirs.
+func (s *SocketServer) restoreRoom(id string) (*types.Room, bool) {
+	if s.shuttingDown() {
+		return nil, false
+	}
+	room, err := s.GetRoom(id)
+	if err != nil {
+		if !errors.Is(err, types.ErrRoomNotFound) {
+			fmt.Printf("Error restoring room %s: %v\n", id, err)
+		}
+		return nil, false
+	}
+	if room.ID.String() != id || room.GetState() == types.RoomStateClosed ||
+		time.Since(lastActivity(room)) > s.staleRoomAge {
+		fmt.Printf("Discarding stale room %s\n", id)
+		s.deleteRoom(id)
+		return nil, false
+	}
+
+	if roomVal, loaded := s.rooms.LoadOrStore(id, room); loaded {
+		return roomVal.(*types.Room), true
+	}
+	s.watchRoom(room)
+	if s.acquireRoom(id) {
+		s.adoptRoom(room)
+	} else {
+		s.requestRoom(id)
+	}
+	if start, ok := room.ScheduledStart(); ok {
+		fmt.Printf("Restored room %s scheduled for %s\n", id, start.Format(time.RFC3339))
+	}
+	return room, true
+}
+
+// adoptRoom marks the peers without a session on this node as reconnecting
+// and asks the other nodes for the ones they hold. The owner of the room
+// removes those nobody reported once the grace period is over.
+func (s *SocketServer) adoptRoom(room *types.Room) {
+	roomID := room.ID.String()
+	for email := range room.GetPeers() {
+		s.withRemotePeer(roomID, email, func() {
+			reconnecting := &types.Peer{Email: email, Status: types.PeerReconnecting}
+			if err := s.changeRoom(room, roomChange{Kind: changePeerUpdated, Peer: reconnecting}); err != nil {
+				fmt.Printf("Error adopting peer %s of room %s: %v\n", email, roomID, err)
+			}
+		})
+	}
+	s.publishRoomChange(roomID, roomChange{Kind: changePeersRequested})
+	time.AfterFunc(rehydrateGracePeriod, func() { s.expireOrphans(room) })
+}
+
+// expireOrphans removes the peers of a restored room that neither joined it
+// again nor are connected to another node. The room closes if none are.
+func (s *SocketServer) expireOrphans(room *types.Room) {
+	if s.shuttingDown() {
+		return
+	}
+	roomID := room.ID.String()
+	if roomVal, ok := s.rooms.Load(roomID); !ok || roomVal.(*types.Room) != room || !s.ownsRoom(roomID) {
+		return
+	}
+	for email := range room.GetPeers() {
+		ps := s.lockPeer(roomID, email)
+		peer, err := room.GetPeer(email)
+		if len(ps.sessions) > 0 || err != nil || peer.Status != types.PeerReconnecting {
+			if len(ps.sessions) == 0 {
+				ps.removed = true
+				s.sessions.Delete(sessionKey(roomID, email))
+			}
+			ps.mu.Unlock()
+			continue
+		}
+		s.syncPeer(ps, room, email)
+		ps.mu.Unlock()
+	}
+}
@@ -19,333 +19,281 @@ func (s *SocketServer) CreateRoom(conn *websocket.Conn, createData types.CreateR
 		return nil, utils.NewHTTPError("Invalid user data", http.StatusInternalServerError)
 	}
 
-	id := uuid.New()
+	room := newRoom(user.Email, createData)
+	id := room.ID
 
-	room := types.NewRoom(
-		id,
-		user.Email,
-		createData.VideoSource,
-		createData.Timestamp,
-	)
-
-	s.conns.Store(conn, createData.Email)
+	c, ok := s.clientFor(conn)
+	if !ok {
+		return nil, types.ErrNotAuthorized
+	}
 
 	initialPeer := &types.Peer{
 		Email:      createData.Email,
 		JoinedAt:   time.Now(),
 		Connection: conn.RemoteAddr().String(),
 		LastPing:   time.Now(),
+		Status:     types.PeerConnected,
 	}
 
 	fmt.Printf("Created room: %v\n", room)
 
-	if err := room.AddPeer(initialPeer); err != nil {
-		s.conns.Delete(conn)
+	s.rooms.Store(id.String(), room)
+	var created func()
+	posted := s.watchNewRoom(room)
+	defer func() { posted <- created }()
+	s.acquireRoom(id.String())
+	if err := s.joinPeer(c, room, initialPeer); err != nil {
+		room.Close()
+		s.rooms.Delete(id.String())
+		s.releaseRoom(id.String())
 		return nil, fmt.Errorf("failed to add initial peer: %v", err)
 	}
 
 	fmt.Printf("Added initial peer: %v\n", initialPeer)
 
+	if !s.ownsRoom(id.String()) {
+		return room, nil
+	}
 	if err := s.setRoom(id.String(), room); err != nil {
-		s.conns.Delete(conn)
+		s.leavePeer(c, room, createData.Email)
 		return nil, fmt.Errorf("failed to store room: %v", err)
 	}
-	s.rooms.Store(id.String(), room)
 
 	fmt.Printf("Stored room: %v\n", room)
-	s.broadcastToRoom(id.String(), types.Message{
-		Action: "user_joined",
-		Data: map[string]interface{}{
-			"peer":  initialPeer,
-			"peers": room.GetPeers(),
-			"room":  room,
-		},
-	})
+	created = s.roomCreatedWebhook(room)
 	return room, nil
 }
 
-func (s *SocketServer) ValidateCreateRoomRequest(msg types.Message) (types.CreateRoomRequest, error) {
-	data, ok := msg.Data.(map[string]interface{})
-	if !ok {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid request format")
-	}
-
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid email")
-	}
-
-	timestampData, ok := data["timestamp"].(map[string]interface{})
-	if !ok {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid timestamp data")
-	}
-
-	start, ok := timestampData["start"].(float64)
-	if !ok || start < 0 {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid start timestamp")
-	}
-
-	end, ok := timestampData["end"].(float64)
-	if !ok || end == 0 {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid end timestamp")
-	}
-
-	current, ok := timestampData["current"].(float64)
-	if !ok || current < start || current > end {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid current timestamp")
+func newRoom(createdBy string, createData types.CreateRoomRequest) *types.Room {
+	room := types.NewRoom(
+		uuid.New(),
+		createdBy,
+		createData.VideoSource,
+		createData.Timestamp,
+	)
+	room.ChatPolicy = createData.ChatPolicy
+	room.Public = createData.Public
+	if createData.ScheduledFor != nil {
+		room.Schedule(*createData.ScheduledFor)
 	}
+	return room
+}
 
-	videoSource, ok := data["video_source"].(string)
-	if !ok || videoSource == "" {
-		return types.CreateRoomRequest{}, fmt.Errorf("invalid video source")
+// openRoom hosts a room created without a first peer and stores it.
+func (s *SocketServer) openRoom(room *types.Room) error {
+	id := room.ID.String()
+	s.rooms.Store(id, room)
+	var created func()
+	posted := s.watchNewRoom(room)
+	defer func() { posted <- created }()
+	if !s.acquireRoom(id) {
+		return nil
+	}
+	if err := s.setRoom(id, room); err != nil {
+		room.Close()
+		s.rooms.Delete(id)
+		s.releaseRoom(id)
+		return fmt.Errorf("failed to store room: %v", err)
 	}
+	created = s.roomCreatedWebhook(room)
+	return nil
+}
 
-	return types.CreateRoomRequest{
-		Email:       email,
-		VideoSource: videoSource,
-		Timestamp: types.TimeStamp{
-			Start:   start,
-			End:     end,
-			Current: current,
-		},
-	}, nil
+// updateRoom applies an update to the room on its owner, which tells every
+// node.
+func (s *SocketServer) updateRoom(room *types.Room, update types.UpdateRoomRequest, reason string) error {
+	return s.changeRoom(room, roomChange{Kind: changeRoomUpdated, Update: &update, Reason: reason})
 }
 
-func (s *SocketServer) GetRoom(id string) (*types.Room, error) {
-	roomStr := s.storage.Get("room:" + id)
-	if roomStr == "" {
-		return nil, types.ErrRoomNotFound
+// applyRoomUpdate applies an update to the copy of the room on this node and
+// returns the revision of the room after it. reason tells why the status
+// changed, if the update changes it.
+func (s *SocketServer) applyRoomUpdate(room *types.Room, update types.UpdateRoomRequest, reason string) (int64, error) {
+	patch, revision, err := room.Update(update, reason)
+	if err != nil || len(patch) == 0 {
+		return revision, err
 	}
-
-	var room *types.Room
-	if err := json.Unmarshal([]byte(roomStr), &room); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal room: %v", err)
+	// The updates the lifecycle makes to idle rooms must not keep them alive.
+	if reason != stateReasonIdle && reason != stateReasonExpired {
+		room.Touch()
 	}
-
-	return room, nil
+	return revision, nil
 }
 
-func (s *SocketServer) setRoom(id string, room *types.Room) error {
-	data, err := json.Marshal(room)
-	if err != nil {
-		return fmt.Errorf("failed to marshal room: %v", err)
+func (s *SocketServer) handleJoinRoom(conn *websocket.Conn, data types.JoinRoomData) (*types.Room, error) {
+	room, ok := s.loadRoom(data.RoomID)
+	if !ok {
+		return nil, types.ErrRoomNotFound
 	}
 
-	s.storage.Set("room:"+id, string(data))
-
-	return nil
-}
-
-func (s *SocketServer) formatAndValidateJoinRoomData(msg types.Message) (types.JoinRoomData, error) {
-	data, ok := msg.Data.(map[string]interface{})
+	c, ok := s.clientFor(conn)
 	if !ok {
-		return types.JoinRoomData{}, fmt.Errorf("invalid data format")
+		return nil, types.ErrNotAuthorized
 	}
 
-	roomID, ok := data["room_id"].(string)
-	if !ok || roomID == "" {
-		return types.JoinRoomData{}, fmt.Errorf("invalid room_id")
+	newPeer := &types.Peer{
+		Email:      data.Email,
+		JoinedAt:   time.Now(),
+		Connection: conn.RemoteAddr().String(),
+		LastPing:   time.Now(),
+		Status:     types.PeerConnected,
 	}
 
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.JoinRoomData{}, fmt.Errorf("invalid email")
+	if err := s.joinPeer(c, room, newPeer); err != nil {
+		return nil, err
 	}
-
-	return types.JoinRoomData{RoomID: roomID, Email: email}, nil
+	return room, nil
 }
 
-func (s *SocketServer) formatAndValidateLeaveRoomData(msg types.Message) (types.JoinRoomData, error) {
-	data, ok := msg.Data.(map[string]interface{})
+func (s *SocketServer) handleLeaveRoom(conn *websocket.Conn, roomID string, email string) error {
+	roomVal, ok := s.rooms.Load(roomID)
 	if !ok {
-		return types.JoinRoomData{}, fmt.Errorf("invalid data format")
+		return types.ErrRoomNotFound
 	}
 
-	roomID, ok := data["room_id"].(string)
-	if !ok || roomID == "" {
-		return types.JoinRoomData{}, fmt.Errorf("invalid room_id")
+	room := roomVal.(*types.Room)
+	c, ok := s.clientFor(conn)
+	if !ok {
+		return types.ErrPeerNotFound
 	}
 
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.JoinRoomData{}, fmt.Errorf("invalid email")
+	if err := s.leavePeer(c, room, email); err != nil {
+		fmt.Printf("Error removing peer: %v\n", err)
+		return err
 	}
-
-	return types.JoinRoomData{RoomID: roomID, Email: email}, nil
+	return nil
 }
 
-func (s *SocketServer) validatePlayerStateData(msg types.Message) (types.PlayerStateData, error) {
-	data, ok := msg.Data.(map[string]interface{})
-	if !ok {
-		return types.PlayerStateData{}, fmt.Errorf("invalid data format")
-	}
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.PlayerStateData{}, fmt.Errorf("invalid email")
-	}
-	paused, ok := data["paused"].(bool)
-	if !ok {
-		return types.PlayerStateData{}, fmt.Errorf("invalid state")
-	}
-	roomId, ok := data["room_id"].(string)
-	if !ok || roomId == "" {
-		fmt.Printf("roomId: %v\n", roomId)
-		return types.PlayerStateData{}, fmt.Errorf("invalid room_id")
+// removedPeer announces a removed peer to the connections of this node. The
+// room closes with its last peer; its observers are told and unsubscribed.
+func (s *SocketServer) removedPeer(room *types.Room, email string, revision int64) {
+	roomID := room.ID.String()
+	s.clearPresence(roomID, email)
+	if s.closeIfEmpty(room) {
+		return
 	}
+	s.broadcastPeerRemoved(room, revision, email)
+}
 
-	return types.PlayerStateData{RoomID: roomId, Email: email, State: paused}, nil
+// closeIfEmpty closes the room on its owner once everybody left it and tells
+// whether it did. A scheduled room waits for its start even when everybody
+// left early. The other nodes close their copies when the owner tells them,
+// as their copies may lag behind.
+func (s *SocketServer) closeIfEmpty(room *types.Room) bool {
+	if _, waiting := room.ScheduledStart(); !room.IsEmpty() || waiting || !s.ownsRoom(room.ID.String()) {
+		return false
+	}
+	closed := types.RoomStateClosed
+	err := s.changeRoom(room, roomChange{
+		Kind:    changeRoomUpdated,
+		Update:  &types.UpdateRoomRequest{Status: &closed},
+		Reason:  stateReasonEmpty,
+		IfEmpty: true,
+	})
+	return err == nil
 }
 
-func (s *SocketServer) validateVideoSyncData(msg types.Message) (types.VideoSyncData, error) {
-	data, ok := msg.Data.(map[string]interface{})
-	if !ok {
-		return types.VideoSyncData{}, fmt.Errorf("invalid data format")
-	}
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.VideoSyncData{}, fmt.Errorf("invalid email")
-	}
-	timestamp, ok := data["timestamp"].(float64)
-	if !ok {
-		return types.VideoSyncData{}, fmt.Errorf("invalid timestamp")
-	}
-	seeking, ok := data["seeking"].(bool)
-	if !ok {
-		return types.VideoSyncData{}, fmt.Errorf("invalid seeking")
-	}
-	roomId, ok := data["room_id"].(string)
-	if !ok || roomId == "" {
-		return types.VideoSyncData{}, fmt.Errorf("invalid room_id")
+// closeRoom announces that the room closed and drops the copy of this node.
+// The sessions still in the room end and their connections are unsubscribed,
+// like the observers of the room.
+func (s *SocketServer) closeRoom(room *types.Room, revision int64, patch map[string]interface{}) {
+	roomID := room.ID.String()
+	s.broadcastRoomPatch(room, revision, patch)
+	s.dropPresence(roomID)
+	s.chatPolicies.Delete(roomID)
+
+	for email := range room.GetPeers() {
+		ps, ok := s.loadPeer(roomID, email)
+		if !ok {
+			continue
+		}
+		var clients []*client
+		for _, sess := range append([]*session(nil), ps.sessions...) {
+			clients = append(clients, sess.client)
+			ps.remove(sess)
+		}
+		ps.removed = true
+		s.sessions.Delete(sessionKey(roomID, email))
+		ps.mu.Unlock()
+
+		for _, c := range clients {
+			c.unsubscribe(roomID)
+			s.releaseIdentity(c)
+		}
 	}
 
-	return types.VideoSyncData{RoomID: roomId, Email: email, Timestamp: timestamp, Seeking: seeking}, nil
+	room.Close()
+	s.rooms.Delete(roomID)
+	s.commands.Delete(roomID)
+	s.dropObservers(roomID)
 }
 
-func (s *SocketServer) validateChatMessageData(msg types.Message) (types.ChatMessageData, error) {
-	data, ok := msg.Data.(map[string]interface{})
-	if !ok {
-		return types.ChatMessageData{}, fmt.Errorf("invalid data format")
-	}
-	email, ok := data["email"].(string)
-	if !ok || email == "" {
-		return types.ChatMessageData{}, fmt.Errorf("invalid email")
-	}
-	message, ok := data["message"].(string)
-	if !ok || message == "" {
-		return types.ChatMessageData{}, fmt.Errorf("invalid message")
-	}
-	roomId, ok := data["room_id"].(string)
-	if !ok || roomId == "" {
-		return types.ChatMessageData{}, fmt.Errorf("invalid room_id")
+// authorize checks that the connection acts on behalf of the email it joined
+// or created a room with.
+func (s *SocketServer) authorize(conn *websocket.Conn, email string) error {
+	connEmail, ok := s.conns.Load(conn)
+	if !ok || connEmail.(string) != email {
+		return types.ErrNotAuthorized
 	}
+	return nil
+}
 
-	return types.ChatMessageData{RoomID: roomId, Email: email, Message: message}, nil
+// sendError reports err to the client together with its error code, the
+// action that caused it and the request ID supplied by the client, if any.
+func (s *SocketServer) sendError(conn *websocket.Conn, msg types.IncomingMessage, err error) {
+	s.sendErrorWithDetails(conn, msg, err, nil)
 }
 
-func (s *SocketServer) handleJoinRoom(conn *websocket.Conn, data types.JoinRoomData) {
-	roomVal, ok := s.rooms.Load(data.RoomID)
-	if !ok {
-		s.sendError(conn, "Room not found")
-		return
+func (s *SocketServer) sendErrorWithDetails(conn *websocket.Conn, msg types.IncomingMessage, err error, details map[string]interface{}) {
+	data := map[string]interface{}{
+		"code":    types.ErrorCodeFor(err),
+		"message": err.Error(),
 	}
-
-	room := roomVal.(*types.Room)
-
-	newPeer := &types.Peer{
-		Email:      data.Email,
-		JoinedAt:   time.Now(),
-		Connection: conn.RemoteAddr().String(),
-		LastPing:   time.Now(),
+	if msg.Action != "" {
+		data["action"] = msg.Action
 	}
-
-	if err := room.AddPeer(newPeer); err != nil {
-		switch err {
-		case types.ErrRoomFull:
-			s.sendError(conn, "Room is full")
-		case types.ErrRoomInactive:
-			s.sendError(conn, "Room is not active")
-		case types.ErrPeerExists:
-			s.sendError(conn, "Already in room")
-		default:
-			s.sendError(conn, fmt.Sprintf("Failed to join room: %v", err))
-		}
-		return
+	if msg.RequestID != "" {
+		data["request_id"] = msg.RequestID
 	}
-
-	s.conns.Store(conn, data.Email)
-
-	if err := s.setRoom(data.RoomID, room); err != nil {
-		room.RemovePeer(data.Email)
-		s.conns.Delete(conn)
-		s.sendError(conn, "Failed to update room data")
-		return
+	for k, v := range details {
+		data[k] = v
 	}
 
-	s.broadcastToRoom(room.ID.String(), types.Message{
-		Action: "user_joined",
-		Data: map[string]interface{}{
-			"peer":  newPeer,
-			"peers": room.GetPeers(),
-			"room":  room,
-		},
+	s.sendTo(conn, types.Message{
+		Action:    "error",
+		RequestID: msg.RequestID,
+		Data:      data,
 	})
 }
 
-func (s *SocketServer) handleLeaveRoom(conn *websocket.Conn, roomID string, email string) {
-	roomVal, ok := s.rooms.Load(roomID)
-	if !ok {
+// sendAck confirms a successfully handled action to the client that sent it.
+// Acks are only sent when the client asked for correlation by setting a
+// request_id.
+func (s *SocketServer) sendAck(conn *websocket.Conn, msg types.IncomingMessage, result interface{}) {
+	if msg.RequestID == "" {
 		return
 	}
-
-	room := roomVal.(*types.Room)
-
-	if err := room.RemovePeer(email); err != nil {
-		fmt.Printf("Error removing peer: %v\n", err)
-		return
-	}
-
-	s.conns.Delete(conn)
-
-	if room.IsEmpty() {
-		room.SetState(types.RoomStateClosed)
-		room.Close()
-		s.rooms.Delete(roomID)
-		s.storage.Delete("room:" + roomID)
-		return
-	}
-
-	if err := s.setRoom(roomID, room); err != nil {
-		fmt.Printf("Error updating room after peer left: %v\n", err)
-	}
-
-	s.broadcastToRoom(roomID, types.Message{
-		Action: "user_left",
+	s.sendTo(conn, types.Message{
+		Action:    "ack",
+		RequestID: msg.RequestID,
 		Data: map[string]interface{}{
-			"email": email,
-			"peers": room.GetPeers(),
-			"room":  room,
+			"action": msg.Action,
+			"result": result,
 		},
 	})
 }
 
-func (s *SocketServer) sendError(conn *websocket.Conn, message string) {
-	errMsg := types.Message{
-		Action: "error",
-		Data: map[string]interface{}{
-			"message": message,
-		},
-	}
-
-	data, _ := json.Marshal(errMsg)
-	conn.WriteMessage(websocket.TextMessage, data)
+func (s *SocketServer) sendRateLimited(conn *websocket.Conn, msg types.IncomingMessage, retryAfter time.Duration) {
+	s.sendErrorWithDetails(conn, msg, types.NewSocketError(types.CodeRateLimited, "Rate limit exceeded"), map[string]interface{}{
+		"retry_after_ms": retryAfter.Milliseconds(),
+	})
 }
 
-func (s *SocketServer) handlePlayerState(conn *websocket.Conn, playerStateData types.PlayerStateData) {
+func (s *SocketServer) handlePlayerState(conn *websocket.Conn, playerStateData types.PlayerStateData) error {
 	roomID := playerStateData.RoomID
 	_, ok := s.rooms.Load(roomID)
 	if !ok {
-		s.sendError(conn, "Room not found")
-		return
+		return types.ErrRoomNotFound
 	}
 
 	msg := types.Message{
@@ -357,14 +305,14 @@ func (s *SocketServer) handlePlayerState(conn *websocket.Conn, playerStateData t
 		},
 	}
 	s.broadcastToRoom(roomID, msg)
+	return nil
 }
 
-func (s *SocketServer) handleVideoSync(conn *websocket.Conn, videoSyncData types.VideoSyncData) {
+func (s *SocketServer) handleVideoSync(conn *websocket.Conn, videoSyncData types.VideoSyncData) error {
 	roomID := videoSyncData.RoomID
 	_, ok := s.rooms.Load(roomID)
 	if !ok {
-		s.sendError(conn, "Room not found")
-		return
+		return types.ErrRoomNotFound
 	}
 
 	msg := types.Message{
@@ -377,23 +325,38 @@ func (s *SocketServer) handleVideoSync(conn *websocket.Conn, videoSyncData types
 		},
 	}
 	s.broadcastToRoom(roomID, msg)
+	return nil
 }
 
-func (s *SocketServer) handleChatMessage(conn *websocket.Conn, chatMessageData types.ChatMessageData) {
+func (s *SocketServer) handleChatMessage(conn *websocket.Conn, chatMessageData types.ChatMessageData) (int64, error) {
 	roomID := chatMessageData.RoomID
-	_, ok := s.rooms.Load(roomID)
+	roomVal, ok := s.rooms.Load(roomID)
 	if !ok {
-		s.sendError(conn, "Room not found")
-		return
+		return 0, types.ErrRoomNotFound
+	}
+	room := roomVal.(*types.Room)
+
+	if err := s.filterChatMessage(room, &chatMessageData); err != nil {
+		return 0, types.WrapSocketError(types.ErrorCodeFor(err), fmt.Sprintf("Message rejected: %v", err), err)
 	}
 
+	// Sending a message implies the sender stopped typing.
+	s.stopTyping(roomID, chatMessageData.Email)
+
+	seq, err := s.storage.Incr(roomChatSeqKey(roomID))
+	if err != nil {
+		return 0, types.WrapSocketError(types.CodeInternal, "Failed to number the message", err)
+	}
 	msg := types.Message{
 		Action: "chat_message",
 		Data: map[string]interface{}{
-			"email":   chatMessageData.Email,
-			"message": chatMessageData.Message,
-			"room":    chatMessageData.RoomID,
+			"email":    chatMessageData.Email,
+			"message":  chatMessageData.Message,
+			"room":     chatMessageData.RoomID,
+			"seq":      seq,
+			"mentions": chatMessageData.Mentions,
 		},
 	}
 	s.broadcastToRoom(roomID, msg)
+	return seq, nil
 }
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+// Every node watches the events of the rooms it hosts, whether the change was
+// made on this node or applied from another one: it announces them to its own
+// connections, stores them and posts their webhooks if it owns the room, and
+// counts them.
+
+// watchRoom subscribes to the events of a room this node starts hosting. The
+// watch ends when the room closes.
+func (s *SocketServer) watchRoom(room *types.Room) {
+	go s.watchEvents(room, room.Subscribe())
+}
+
+// watchNewRoom watches a room being created. Its events wait until the
+// creation is settled and the posting of its room.created webhook is sent on
+// the channel returned, nil if there is none, which then goes first.
+func (s *SocketServer) watchNewRoom(room *types.Room) chan<- func() {
+	posted := make(chan func(), 1)
+	events := room.Subscribe()
+	go func() {
+		if created := <-posted; created != nil && !s.shuttingDown() {
+			created()
+		}
+		s.watchEvents(room, events)
+	}()
+	return posted
+}
+
+func (s *SocketServer) watchEvents(room *types.Room, events <-chan types.RoomEvent) {
+	for {
+		for ev := range events {
+			s.dispatchRoomEvent(room, ev)
+		}
+		if room.GetState() == types.RoomStateClosed {
+			return
+		}
+		fmt.Printf("Fell behind the events of room %s, resubscribing\n", room.ID)
+		events = room.Subscribe()
+		s.reconcileRoom(room)
+	}
+}
+
+// reconcileRoom catches up with a room whose events this node lost.
+// Connections notice the gap in the revisions and sync; storage gets the
+// current room, the presence of peers that left is dropped, and a room that
+// emptied meanwhile closes.
+func (s *SocketServer) reconcileRoom(room *types.Room) {
+	if s.shuttingDown() {
+		return
+	}
+	roomID := room.ID.String()
+	s.persistRoom(room)
+	if val, ok := s.presence.Load(roomID); ok {
+		p := val.(*roomPresence)
+		p.mu.Lock()
+		emails := make(map[string]struct{}, len(p.typing)+len(p.reads))
+		for email := range p.typing {
+			emails[email] = struct{}{}
+		}
+		for email := range p.reads {
+			emails[email] = struct{}{}
+		}
+		p.mu.Unlock()
+		for email := range emails {
+			if _, err := room.GetPeer(email); err != nil {
+				s.clearPresence(roomID, email)
+			}
+		}
+	}
+	s.closeIfEmpty(room)
+}
+
+func (s *SocketServer) dispatchRoomEvent(room *types.Room, ev types.RoomEvent) {
+	// Shutdown drops the copies of this node without closing the rooms,
+	// which stay stored for the other nodes and the next start.
+	if s.shuttingDown() {
+		return
+	}
+	s.metrics.countRoomEvent(ev.Kind)
+	s.roomWebhooks(room, ev)
+
+	switch ev.Kind {
+	case types.RoomPeerJoined:
+		s.broadcastPeerAdded(room, ev.Revision, ev.Peer)
+		s.persistPeer(room, ev.Email)
+	case types.RoomPeerUpdated:
+		reconnected := ev.Previous.Status == types.PeerReconnecting && ev.Peer.Status == types.PeerConnected
+		s.broadcastPeerUpdated(room, ev.Revision, ev.Peer, reconnected)
+		s.persistPeer(room, ev.Email)
+	case types.RoomPeerLeft:
+		// Stored before removedPeer closes an emptied room, whose events then
+		// delete it.
+		s.persistPeer(room, ev.Email)
+		s.removedPeer(room, ev.Email, ev.Revision)
+	case types.RoomStateChanged:
+		s.sendStateChanged(room, ev.Revision, ev.PreviousState, ev.State, ev.Reason)
+	case types.RoomUpdated:
+		if ev.Patch["status"] == types.RoomStateClosed {
+			s.closeRoom(room, ev.Revision, ev.Patch)
+		} else {
+			s.broadcastRoomPatch(room, ev.Revision, ev.Patch)
+		}
+		s.persistRoom(room)
+	}
+}
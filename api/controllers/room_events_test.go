@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// TestSlowDispatchLosesNoEvents stalls the broadcasts of a room on a
+// connection that cannot be written to while the room changes more often
+// than its subscription buffers.
+func TestSlowDispatchLosesNoEvents(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	c := dialTestClient(t, url, "goparty.v2")
+	roomID := c.createTestRoom("a@example.com")
+	room, _ := s.loadRoom(roomID)
+
+	var stalled *client
+	s.clients.Range(func(_, val interface{}) bool {
+		stalled = val.(*client)
+		return false
+	})
+	stalled.writeMu.Lock()
+	const updates = 600
+	for i := 0; i < updates; i++ {
+		source := fmt.Sprintf("https://videos.example.com/%d.mp4", i)
+		if err := s.updateRoom(room, types.UpdateRoomRequest{VideoSource: &source}, stateReasonRequested); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := room.Revision()
+	stalled.writeMu.Unlock()
+
+	revision := int64(0)
+	for revision < last {
+		patch := c.expect("room_patch")
+		next := int64(patch.Data["revision"].(float64))
+		if revision != 0 && next != revision+1 {
+			t.Fatalf("got revision %d after %d", next, revision)
+		}
+		revision = next
+	}
+	waitForField(t, st, roomID, "revision", fmt.Sprint(last))
+}
+
+func TestReconcileRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, _ := newTestNode(t, st, storage.NewMemoryBus())
+	// Nothing watches the room, as if this node lost all of its events. The
+	// node owns the room, so it closes it once it emptied.
+	room := newRoom("a@example.com", types.CreateRoomRequest{VideoSource: "v", Timestamp: types.TimeStamp{End: 60}})
+	roomID := room.ID.String()
+	s.rooms.Store(roomID, room)
+	s.acquireRoom(roomID)
+	joinTestPeer(t, room, "a@example.com")
+	joinTestPeer(t, room, "b@example.com")
+
+	s.startTyping(roomID, "b@example.com")
+	s.startTyping(roomID, "a@example.com")
+	room.RemovePeer("b@example.com")
+	s.reconcileRoom(room)
+
+	p := s.presenceFor(roomID)
+	p.mu.Lock()
+	_, aTyping := p.typing["a@example.com"]
+	_, bTyping := p.typing["b@example.com"]
+	p.mu.Unlock()
+	if !aTyping || bTyping {
+		t.Fatalf("typing a=%v b=%v, want only a", aTyping, bTyping)
+	}
+	if room.GetState() == types.RoomStateClosed {
+		t.Fatal("closed a room that still has a peer")
+	}
+
+	room.RemovePeer("a@example.com")
+	s.reconcileRoom(room)
+	if room.GetState() != types.RoomStateClosed {
+		t.Fatalf("emptied room is %s, want closed", room.GetState())
+	}
+}
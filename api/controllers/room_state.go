@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"github.com/raghavyuva/go-party/types"
+)
+
+// deltaProtocolVersion is the first protocol version that receives room
+// changes as deltas tagged with the room revision. Older versions keep
+// getting user_joined and user_left with the full room attached.
+const deltaProtocolVersion = 2
+
+func usesDeltas(c *client) bool {
+	return c.getProtocol().Version >= deltaProtocolVersion
+}
+
+// broadcastRoomChange sends delta to the connections of the room that use
+// deltas and legacy to the others. A legacy message without action is not
+// sent at all. Both are encoded lazily, so a room without legacy clients
+// never marshals the full room.
+func (s *SocketServer) broadcastRoomChange(room *types.Room, delta, legacy types.Message) {
+	deltaMsg := newEncodedMessage(delta)
+	var legacyMsg *encodedMessage
+	if legacy.Action != "" {
+		legacyMsg = newEncodedMessage(legacy)
+	}
+	s.broadcastEncoded(room.ID.String(), func(c *client) *encodedMessage {
+		if usesDeltas(c) {
+			return deltaMsg
+		}
+		return legacyMsg
+	})
+}
+
+func (s *SocketServer) broadcastPeerAdded(room *types.Room, revision int64, peer *types.Peer) {
+	s.broadcastRoomChange(room, types.Message{
+		Action: "peer_added",
+		Data: map[string]interface{}{
+			"room_id":  room.ID.String(),
+			"revision": revision,
+			"peer":     peer,
+		},
+	}, types.Message{
+		Action: "user_joined",
+		Data: map[string]interface{}{
+			"peer":  peer,
+			"peers": room.GetPeers(),
+			"room":  room,
+		},
+	})
+}
+
+func (s *SocketServer) broadcastPeerRemoved(room *types.Room, revision int64, email string) {
+	s.broadcastRoomChange(room, types.Message{
+		Action: "peer_removed",
+		Data: map[string]interface{}{
+			"room_id":  room.ID.String(),
+			"revision": revision,
+			"email":    email,
+		},
+	}, types.Message{
+		Action: "user_left",
+		Data: map[string]interface{}{
+			"email": email,
+			"peers": room.GetPeers(),
+			"room":  room,
+		},
+	})
+}
+
+// broadcastPeerUpdated announces a change to a peer, e.g. its connection
+// status or device count.
+func (s *SocketServer) broadcastPeerUpdated(room *types.Room, revision int64, peer *types.Peer, reconnected bool) {
+	var legacy types.Message
+	if reconnected {
+		// Legacy clients are not told about peers that drop and resume; the
+		// full room of user_joined brings them up to date once it is back.
+		legacy = types.Message{
+			Action: "user_joined",
+			Data: map[string]interface{}{
+				"peer":  peer,
+				"peers": room.GetPeers(),
+				"room":  room,
+			},
+		}
+	}
+	s.broadcastRoomChange(room, types.Message{
+		Action: "peer_updated",
+		Data: map[string]interface{}{
+			"room_id":  room.ID.String(),
+			"revision": revision,
+			"peer":     peer,
+		},
+	}, legacy)
+}
+
+// broadcastRoomPatch announces changed room attributes. patch is keyed by
+// the JSON names of the room fields. Legacy clients have no equivalent
+// event and get nothing. A changed chat policy is left out: clients must not
+// learn it, but still get the revision it produced.
+func (s *SocketServer) broadcastRoomPatch(room *types.Room, revision int64, patch map[string]interface{}) {
+	if _, ok := patch["chat_policy"]; ok {
+		visible := make(map[string]interface{}, len(patch))
+		for field, value := range patch {
+			if field != "chat_policy" {
+				visible[field] = value
+			}
+		}
+		patch = visible
+	}
+	s.broadcastRoomChange(room, types.Message{
+		Action: "room_patch",
+		Data: map[string]interface{}{
+			"room_id":  room.ID.String(),
+			"revision": revision,
+			"patch":    patch,
+		},
+	}, types.Message{})
+}
+
+// sendRoomState gives a connection that uses deltas the snapshot to apply
+// them to. Clients call room_sync to get one after missing a revision.
+func (s *SocketServer) sendRoomState(ctx *ActionContext, room *types.Room) error {
+	if !usesDeltas(ctx.client) {
+		return nil
+	}
+	return ctx.Reply("room_state", map[string]interface{}{
+		"room_id": room.ID.String(),
+		"room":    room,
+	})
+}
+
+func (s *SocketServer) handleRoomSync(ctx *ActionContext) (interface{}, error) {
+	return nil, s.sendRoomState(ctx, ctx.Room)
+}
@@ -0,0 +1,425 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// A room is stored under several keys, so that a peer joining or leaving
+// writes only its own record instead of the whole room:
+//
+//	room:<id>               hash of the room fields, each JSON encoded
+//	room:<id>:peers         set of the peer emails
+//	room:<id>:peer:<email>  JSON of the peer
+//	rooms:activity          sorted set of the room ids by last activity
+//	rooms:directory         the same for the public active rooms only
+//
+// Rooms stored by older versions as one JSON blob at room:<id> are migrated
+// at startup, and the directory is built for the rooms stored before it. The
+// blob of a room being migrated is kept at room:<id>:legacy until the room
+// is stored again.
+
+const (
+	roomActivityKey  = "rooms:activity"
+	roomDirectoryKey = "rooms:directory"
+
+	// roomSchemaKey records that the stored rooms use the layout above.
+	roomSchemaKey      = "rooms:schema"
+	roomSchemaVersion  = "3"
+	roomMigrationLease = "lease:migrate:rooms"
+	roomMigrationTTL   = time.Minute
+
+	// maxStorageAttempts bounds the retries of a storage update that keeps
+	// conflicting with concurrent writes.
+	maxStorageAttempts = 10
+)
+
+func roomKey(roomID string) string {
+	return "room:" + roomID
+}
+
+func roomLegacyKey(roomID string) string {
+	return "room:" + roomID + ":legacy"
+}
+
+func roomPeersKey(roomID string) string {
+	return "room:" + roomID + ":peers"
+}
+
+func roomPeerKey(roomID, email string) string {
+	return "room:" + roomID + ":peer:" + email
+}
+
+// roomChatSeqKey holds the sequence number of the last chat message of the
+// room. Every node numbers the messages it relays from it.
+func roomChatSeqKey(roomID string) string {
+	return "room:" + roomID + ":chat_seq"
+}
+
+// lastChatSeq returns the sequence number of the last chat message of the
+// room, 0 before the first.
+func (s *SocketServer) lastChatSeq(roomID string) int64 {
+	seq, _ := strconv.ParseInt(s.storage.Get(roomChatSeqKey(roomID)), 10, 64)
+	return seq
+}
+
+// lastActivity is when the room was last active, or when it starts if it is
+// a scheduled room waiting for that.
+func lastActivity(room *types.Room) time.Time {
+	if start, ok := room.ScheduledStart(); ok && start.After(room.LastActive()) {
+		return start
+	}
+	return room.LastActive()
+}
+
+func activityScore(room *types.Room) float64 {
+	return float64(lastActivity(room).Unix())
+}
+
+// indexRoom files the room in the activity index and, while it is public and
+// active, in the directory.
+func (s *SocketServer) indexRoom(id string, room *types.Room) {
+	score := activityScore(room)
+	s.storage.ZAdd(roomActivityKey, id, score)
+	if room.IsPublic() && room.GetState() == types.RoomStateActive {
+		s.storage.ZAdd(roomDirectoryKey, id, score)
+	} else {
+		s.storage.ZRem(roomDirectoryKey, id)
+	}
+}
+
+func (s *SocketServer) GetRoom(id string) (*types.Room, error) {
+	fields := s.storage.HGetAll(roomKey(id))
+	if len(fields) == 0 {
+		return nil, types.ErrRoomNotFound
+	}
+
+	peers := make(map[string]json.RawMessage)
+	for _, email := range s.storage.SMembers(roomPeersKey(id)) {
+		if peer := s.storage.Get(roomPeerKey(id, email)); peer != "" {
+			peers[email] = json.RawMessage(peer)
+		}
+	}
+	return decodeRoom(fields, peers)
+}
+
+// decodeRoom builds a room from the fields of its hash and the JSON of its
+// peers.
+func decodeRoom(fields map[string]string, peers map[string]json.RawMessage) (*types.Room, error) {
+	doc := make(map[string]json.RawMessage, len(fields)+1)
+	for field, value := range fields {
+		doc[field] = json.RawMessage(value)
+	}
+	peersData, err := json.Marshal(peers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal peers: %v", err)
+	}
+	doc["peers"] = peersData
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal room: %v", err)
+	}
+	var room *types.Room
+	if err := json.Unmarshal(data, &room); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal room: %v", err)
+	}
+	return room, nil
+}
+
+// setRoom writes the whole room to storage, or deletes it once it closed.
+// Peers that are stored but no longer in the room are removed.
+func (s *SocketServer) setRoom(id string, room *types.Room) error {
+	if room.GetState() == types.RoomStateClosed {
+		s.deleteRoom(id)
+		return nil
+	}
+
+	revision, fields, err := roomFields(room)
+	if err != nil {
+		return err
+	}
+	if stored, err := s.storeRoomFields(id, revision, fields); err != nil || !stored {
+		return err
+	}
+
+	emails := s.storage.SMembers(roomPeersKey(id))
+	for email := range room.GetPeers() {
+		emails = append(emails, email)
+	}
+	for _, email := range emails {
+		if err := s.storePeer(id, room, email, revision); err != nil {
+			return err
+		}
+	}
+	s.indexRoom(id, room)
+	return nil
+}
+
+// roomFields returns the fields of the hash of the room, without its peers,
+// and the revision they were taken at.
+func roomFields(room *types.Room) (int64, map[string]string, error) {
+	// The snapshot is at least as new as the revision read before it.
+	revision := room.Revision()
+	data, err := json.Marshal(room)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal room: %v", err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, nil, fmt.Errorf("failed to split room: %v", err)
+	}
+	delete(doc, "peers")
+	fields := make(map[string]string, len(doc)+1)
+	for field, value := range doc {
+		fields[field] = string(value)
+	}
+	// The chat policy and the state reason are no part of the JSON of the room
+	// that clients see.
+	if chatPolicy := room.GetChatPolicy(); chatPolicy != nil {
+		policy, err := json.Marshal(chatPolicy)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal chat policy: %v", err)
+		}
+		fields["chat_policy"] = string(policy)
+	}
+	if reason := room.GetStateReason(); reason != "" {
+		data, err := json.Marshal(reason)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal state reason: %v", err)
+		}
+		fields["state_reason"] = string(data)
+	}
+	fields["revision"] = fmt.Sprint(revision)
+	return revision, fields, nil
+}
+
+// setPeer writes one peer of the room to storage, or removes it once it left,
+// along with the room fields every peer change moves.
+func (s *SocketServer) setPeer(id string, room *types.Room, email string) error {
+	if room.GetState() == types.RoomStateClosed {
+		s.deleteRoom(id)
+		return nil
+	}
+	revision := room.Revision()
+	fields := make(map[string]string, 4)
+	for field, value := range map[string]interface{}{
+		"revision":    revision,
+		"status":      room.GetState(),
+		"updated_on":  room.UpdatedOn(),
+		"last_active": room.LastActive(),
+	} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %v", field, err)
+		}
+		fields[field] = string(data)
+	}
+	if stored, err := s.storeRoomFields(id, revision, fields); err != nil || !stored {
+		return err
+	}
+	if err := s.storePeer(id, room, email, revision); err != nil {
+		return err
+	}
+	s.indexRoom(id, room)
+	return nil
+}
+
+// Writers of the same room race: the watch of its events, a takeover, or an
+// owner that has not noticed yet that it lost the lease. Every record stored
+// carries the revision of the room it was taken at, and a write that finds a
+// newer one in storage keeps it instead, so whatever order the writes land in,
+// storage ends up with the newest. The room fields go first: a snapshot older
+// than them writes no peers, so it cannot bring back a peer that left since.
+
+// storedRevision returns the revision a stored record was taken at, 0 if
+// there is none.
+func storedRevision(value string) int64 {
+	revision, _ := strconv.ParseInt(value, 10, 64)
+	return revision
+}
+
+// storeRoomFields writes fields of the room taken at revision unless storage
+// holds a newer snapshot of the room, and tells whether it wrote them.
+func (s *SocketServer) storeRoomFields(id string, revision int64, fields map[string]string) (bool, error) {
+	stored := false
+	err := s.retryStorage(func() error {
+		return s.storage.HUpdate(roomKey(id), func(current map[string]string) (map[string]string, error) {
+			if stored = storedRevision(current["revision"]) <= revision; !stored {
+				return nil, nil
+			}
+			return fields, nil
+		})
+	})
+	return stored, err
+}
+
+// storedPeer is the record of a peer in storage.
+type storedPeer struct {
+	*types.Peer
+	Revision int64 `json:"revision"`
+}
+
+// storePeer writes the record and membership of one peer as of revision. The
+// peer is read while storage watches its key, and a newer record found there
+// is kept, so a slower concurrent write never replaces a newer snapshot.
+func (s *SocketServer) storePeer(id string, room *types.Room, email string, revision int64) error {
+	stored := ""
+	err := s.retryStorage(func() error {
+		return s.storage.Update(roomPeerKey(id, email), func(current string) (string, error) {
+			var record struct {
+				Revision int64 `json:"revision"`
+			}
+			if current != "" && json.Unmarshal([]byte(current), &record) == nil && record.Revision > revision {
+				stored = current
+				return current, nil
+			}
+			peer, err := room.GetPeer(email)
+			if err != nil {
+				stored = ""
+				return "", nil
+			}
+			data, err := json.Marshal(storedPeer{Peer: peer, Revision: revision})
+			if err != nil {
+				return "", fmt.Errorf("failed to marshal peer: %v", err)
+			}
+			stored = string(data)
+			return stored, nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// The membership follows the record storage kept.
+	if stored != "" {
+		s.storage.SAdd(roomPeersKey(id), email)
+	} else {
+		s.storage.SRem(roomPeersKey(id), email)
+	}
+	return nil
+}
+
+func (s *SocketServer) deleteRoom(id string) {
+	for _, email := range s.storage.SMembers(roomPeersKey(id)) {
+		s.storage.Delete(roomPeerKey(id, email))
+	}
+	s.storage.Delete(roomPeersKey(id))
+	s.storage.Delete(roomChatSeqKey(id))
+	s.storage.Delete(roomKey(id))
+	s.storage.ZRem(roomActivityKey, id)
+	s.storage.ZRem(roomDirectoryKey, id)
+}
+
+// retryStorage runs a storage update again while it conflicts with
+// concurrent writes. Every attempt recomputes the value from the one current
+// then.
+func (s *SocketServer) retryStorage(update func() error) error {
+	var err error
+	for attempt := 0; attempt < maxStorageAttempts; attempt++ {
+		if err = update(); !errors.Is(err, storage.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// migrateRooms rewrites the rooms stored as one JSON blob into the current
+// layout, or files the rooms stored before the directory in it. One node
+// migrates while the others wait for the next start. The schema is only
+// recorded once every room was migrated, so the next start retries the
+// others.
+func (s *SocketServer) migrateRooms() {
+	previous := s.storage.Get(roomSchemaKey)
+	if previous == roomSchemaVersion {
+		return
+	}
+	if !s.storage.AcquireLease(roomMigrationLease, s.node, roomMigrationTTL) {
+		return
+	}
+	defer s.storage.ReleaseLease(roomMigrationLease, s.node)
+
+	count, failed := 0, 0
+	// A migration that stopped halfway left the blobs it moved aside.
+	for _, key := range s.storage.Keys("room:*:legacy") {
+		id := strings.TrimSuffix(strings.TrimPrefix(key, "room:"), ":legacy")
+		if s.storage.Get(roomKey(id)) != "" {
+			// The blob is still in place and migrated below.
+			s.storage.Delete(key)
+			continue
+		}
+		var room *types.Room
+		err := json.Unmarshal([]byte(s.storage.Get(key)), &room)
+		if err == nil {
+			err = s.migrateRoom(id, room)
+		}
+		if err != nil {
+			fmt.Printf("Error migrating room %s: %v\n", id, err)
+			failed++
+			continue
+		}
+		count++
+	}
+
+	for _, key := range s.storage.Keys("room:*") {
+		if strings.Count(key, ":") != 1 {
+			continue
+		}
+		id := strings.TrimPrefix(key, "room:")
+		if previous != "" {
+			room, err := s.GetRoom(id)
+			if err != nil {
+				fmt.Printf("Error migrating room %s: %v\n", id, err)
+				failed++
+				continue
+			}
+			s.indexRoom(id, room)
+			count++
+			continue
+		}
+		data := s.storage.Get(key)
+		if data == "" {
+			continue
+		}
+		var room *types.Room
+		if err := json.Unmarshal([]byte(data), &room); err != nil {
+			fmt.Printf("Error migrating room %s: %v\n", key, err)
+			failed++
+			continue
+		}
+		// The hash of the room takes the key of the blob.
+		s.storage.Set(roomLegacyKey(id), data)
+		s.storage.Delete(key)
+		if err := s.migrateRoom(id, room); err != nil {
+			fmt.Printf("Error migrating room %s: %v\n", id, err)
+			s.storage.Delete(key)
+			s.storage.Set(key, data)
+			s.storage.Delete(roomLegacyKey(id))
+			failed++
+			continue
+		}
+		count++
+	}
+	if failed > 0 {
+		fmt.Printf("Migrated %d rooms to the current storage layout, %d failed and are retried at the next start\n", count, failed)
+		return
+	}
+	s.storage.Set(roomSchemaKey, roomSchemaVersion)
+	fmt.Printf("Migrated %d rooms to the current storage layout\n", count)
+}
+
+// migrateRoom stores a room whose blob was moved to roomLegacyKey and drops
+// the blob once the room is stored.
+func (s *SocketServer) migrateRoom(id string, room *types.Room) error {
+	if err := s.setRoom(id, room); err != nil {
+		return err
+	}
+	s.storage.Delete(roomLegacyKey(id))
+	return nil
+}
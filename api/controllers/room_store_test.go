@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+func joinTestPeer(t *testing.T, room *types.Room, email string) {
+	t.Helper()
+	peer := &types.Peer{Email: email, Connection: "127.0.0.1:1", JoinedAt: time.Now(), Status: types.PeerConnected, Devices: 1}
+	if _, err := room.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStaleSnapshotKeepsNewerRoom writes a newer snapshot of a room and then
+// an older one, as a slow writer would.
+func TestStaleSnapshotKeepsNewerRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, err := newSocketServer(st, storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	room := newRoom("a@example.com", types.CreateRoomRequest{
+		VideoSource: "https://videos.example.com/a.mp4",
+		Timestamp:   types.TimeStamp{End: 3600},
+	})
+	id := room.ID.String()
+	joinTestPeer(t, room, "a@example.com")
+	if err := s.setRoom(id, room); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := s.GetRoom(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joinTestPeer(t, room, "b@example.com")
+	room.RemovePeer("a@example.com")
+	if err := s.setRoom(id, room); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setRoom(id, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setPeer(id, stale, "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s.GetRoom(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Revision() != room.Revision() {
+		t.Fatalf("stored revision %d, want %d", stored.Revision(), room.Revision())
+	}
+	if _, err := stored.GetPeer("b@example.com"); err != nil {
+		t.Fatalf("the stale snapshot removed b: %v", err)
+	}
+	if stored.PeerCount() != 1 {
+		t.Fatalf("stored room has %d peers, want 1", stored.PeerCount())
+	}
+}
+
+// failingStorage fails the updates of hashes, as a storage going down
+// halfway through would.
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) HUpdate(string, func(map[string]string) (map[string]string, error)) error {
+	return errors.New("storage unavailable")
+}
+
+// storeLegacyRoom stores a room of a@example.com as one JSON blob under key,
+// like the first versions did.
+func storeLegacyRoom(t *testing.T, st storage.Storage, key func(string) string) string {
+	t.Helper()
+	room := newRoom("a@example.com", types.CreateRoomRequest{
+		VideoSource: "https://videos.example.com/a.mp4",
+		Timestamp:   types.TimeStamp{End: 3600},
+	})
+	joinTestPeer(t, room, "a@example.com")
+	data, err := json.Marshal(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set(key(room.ID.String()), string(data))
+	return room.ID.String()
+}
+
+func startTestServer(t *testing.T, st storage.Storage) *SocketServer {
+	t.Helper()
+	s, err := newSocketServer(st, storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func expectMigrated(t *testing.T, st storage.Storage, id string) {
+	t.Helper()
+	s := startTestServer(t, st)
+	defer s.Shutdown()
+	room, err := s.GetRoom(id)
+	if err != nil {
+		t.Fatalf("room not migrated: %v", err)
+	}
+	if _, err := room.GetPeer("a@example.com"); err != nil {
+		t.Fatalf("peer not migrated: %v", err)
+	}
+	if st.Get(roomLegacyKey(id)) != "" || st.Get(roomSchemaKey) != roomSchemaVersion {
+		t.Fatal("migration did not complete")
+	}
+}
+
+// TestMigrationKeepsRoomsItCannotStore migrates a room while the storage
+// fails. The blob stays for the next start, which migrates it.
+func TestMigrationKeepsRoomsItCannotStore(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	id := storeLegacyRoom(t, st, roomKey)
+	blob := st.Get(roomKey(id))
+
+	startTestServer(t, failingStorage{st}).Shutdown()
+	if st.Get(roomKey(id)) != blob {
+		t.Fatal("the blob of the room was lost")
+	}
+	if st.Get(roomLegacyKey(id)) != "" {
+		t.Fatal("the blob was left aside")
+	}
+	if st.Get(roomSchemaKey) != "" {
+		t.Fatal("the schema was recorded with a room not migrated")
+	}
+
+	expectMigrated(t, st, id)
+}
+
+// TestMigrationResumes migrates a room whose blob an earlier migration moved
+// aside before it stopped.
+func TestMigrationResumes(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	id := storeLegacyRoom(t, st, roomLegacyKey)
+
+	expectMigrated(t, st, id)
+}
@@ -0,0 +1,431 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+const (
+	defaultRoomPageSize = 20
+	maxRoomPageSize     = 100
+
+	// maxRoomScan bounds how many rooms of the directory one page reads
+	// looking for rooms that match its filters. A page that stops there is
+	// short and continues at its next_offset.
+	maxRoomScan = 5 * maxRoomPageSize
+)
+
+// roomView is how the REST API shows a room: the fields of Room.MarshalJSON
+// without the chat policy and the connection details of the peers, which it
+// drops by decoding that JSON.
+type roomView struct {
+	ID          string              `json:"id"`
+	URL         string              `json:"url"`
+	VideoSource string              `json:"video_source"`
+	Timestamp   types.TimeStamp     `json:"timestamp"`
+	CreatedBy   string              `json:"created_by"`
+	CreatedOn   time.Time           `json:"created_on"`
+	MaxCapacity int32               `json:"max_capacity"`
+	Public      bool                `json:"public"`
+	Status      types.RoomState     `json:"status"`
+	Revision    int64               `json:"revision"`
+	UpdatedOn   time.Time           `json:"updated_on"`
+	LastActive  time.Time           `json:"last_active"`
+	PeerCount   int                 `json:"peer_count"`
+	Peers       map[string]peerView `json:"peers,omitempty"`
+	// ScheduledFor and RSVPs are set for scheduled rooms.
+	ScheduledFor *time.Time           `json:"scheduled_for,omitempty"`
+	RSVPs        map[string]time.Time `json:"rsvps,omitempty"`
+}
+
+type peerView struct {
+	Email    string           `json:"email"`
+	JoinedAt time.Time        `json:"joined_at"`
+	Status   types.PeerStatus `json:"status"`
+	Devices  int              `json:"devices"`
+}
+
+func newRoomView(room *types.Room, withPeers bool) (roomView, error) {
+	var view roomView
+	data, err := json.Marshal(room)
+	if err != nil {
+		return view, fmt.Errorf("failed to marshal room: %v", err)
+	}
+	if err := json.Unmarshal(data, &view); err != nil {
+		return view, fmt.Errorf("failed to unmarshal room: %v", err)
+	}
+	view.PeerCount = len(view.Peers)
+	if !withPeers {
+		view.Peers = nil
+	}
+	return view, nil
+}
+
+// findRoom returns a room for the REST API: the copy of this node if it has
+// one, the stored room otherwise. Unlike loadRoom it does not take the room
+// over, reading a room is no reason to host it.
+func (s *SocketServer) findRoom(id string) (*types.Room, error) {
+	if roomVal, ok := s.rooms.Load(id); ok {
+		return roomVal.(*types.Room), nil
+	}
+	return s.GetRoom(id)
+}
+
+// roomFilter holds the query parameters of the room directory.
+type roomFilter struct {
+	limit       int
+	offset      int
+	minPeers    int
+	maxPeers    int
+	createdBy   string
+	videoSource string
+}
+
+func parseRoomFilter(r *http.Request) (roomFilter, error) {
+	query := r.URL.Query()
+	filter := roomFilter{
+		limit:       defaultRoomPageSize,
+		maxPeers:    math.MaxInt,
+		createdBy:   query.Get("created_by"),
+		videoSource: query.Get("video_source"),
+	}
+	for name, target := range map[string]*int{
+		"limit":     &filter.limit,
+		"offset":    &filter.offset,
+		"min_peers": &filter.minPeers,
+		"max_peers": &filter.maxPeers,
+	} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid %s", name)
+		}
+		*target = n
+	}
+	if filter.limit == 0 || filter.limit > maxRoomPageSize {
+		return filter, fmt.Errorf("limit must be between 1 and %d", maxRoomPageSize)
+	}
+	return filter, nil
+}
+
+func (f roomFilter) matches(room roomView) bool {
+	if !room.Public || room.Status != types.RoomStateActive {
+		return false
+	}
+	if room.PeerCount < f.minPeers || room.PeerCount > f.maxPeers {
+		return false
+	}
+	if f.createdBy != "" && room.CreatedBy != f.createdBy {
+		return false
+	}
+	return f.videoSource == "" || room.VideoSource == f.videoSource
+}
+
+// roomSummary returns the view of a stored room without its peers, reading
+// only the room fields and counting the peers.
+func (s *SocketServer) roomSummary(id string) (roomView, error) {
+	var view roomView
+	fields := s.storage.HGetAll(roomKey(id))
+	if len(fields) == 0 {
+		return view, types.ErrRoomNotFound
+	}
+	doc := make(map[string]json.RawMessage, len(fields))
+	for field, value := range fields {
+		doc[field] = json.RawMessage(value)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return view, fmt.Errorf("failed to marshal room: %v", err)
+	}
+	if err := json.Unmarshal(data, &view); err != nil {
+		return view, fmt.Errorf("failed to unmarshal room: %v", err)
+	}
+	view.PeerCount = s.storage.SCard(roomPeersKey(id))
+	return view, nil
+}
+
+// HandleListRooms lists the public active rooms, the most recently active
+// first. It pages through the directory index rather than the rooms: offset
+// and next_offset are positions in the directory, and total is its size.
+func (s *SocketServer) HandleListRooms(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	filter, err := parseRoomFilter(r)
+	if err != nil {
+		writer.WriteError(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	total := s.storage.ZCard(roomDirectoryKey)
+	rooms := make([]roomView, 0, filter.limit)
+	position := filter.offset
+	for scanned := 0; len(rooms) < filter.limit && scanned < maxRoomScan; {
+		ids := s.storage.ZRevRangeByScore(roomDirectoryKey, math.Inf(1), math.Inf(-1), position, filter.limit)
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			if len(rooms) == filter.limit {
+				break
+			}
+			position++
+			scanned++
+			view, err := s.roomSummary(id)
+			if err != nil {
+				if !errors.Is(err, types.ErrRoomNotFound) {
+					fmt.Printf("Error loading room %s: %v\n", id, err)
+				}
+				continue
+			}
+			if filter.matches(view) {
+				rooms = append(rooms, view)
+			}
+		}
+	}
+
+	page := map[string]interface{}{
+		"rooms":  rooms,
+		"total":  total,
+		"limit":  filter.limit,
+		"offset": filter.offset,
+	}
+	if position < total {
+		page["next_offset"] = position
+	}
+	writer.WriteJSON(http.StatusOK, page)
+}
+
+// roomFromPath returns the view of the room named by the {id} of the request
+// path, or writes the error response. Anybody may see a public room; others
+// only show to their creator and peers, authenticated with HTTP basic auth,
+// and are not found for everybody else.
+func (s *SocketServer) roomFromPath(writer *utils.ResponseWriter, r *http.Request) (roomView, bool) {
+	room, err := s.findRoom(r.PathValue("id"))
+	var view roomView
+	if err == nil {
+		view, err = newRoomView(room, true)
+	}
+	if err != nil && !errors.Is(err, types.ErrRoomNotFound) {
+		fmt.Printf("Error loading room %s: %v\n", r.PathValue("id"), err)
+		writer.WriteError(http.StatusInternalServerError, "Internal server error")
+		return view, false
+	}
+	if err != nil || view.Status == types.RoomStateClosed {
+		writer.WriteError(http.StatusNotFound, types.ErrRoomNotFound.Error())
+		return view, false
+	}
+	if view.Public {
+		return view, true
+	}
+	user, err := authenticate(s.storage, r)
+	if err != nil {
+		writeRoomError(writer, err)
+		return view, false
+	}
+	if _, member := view.Peers[user.Email]; !member && view.CreatedBy != user.Email {
+		writer.WriteError(http.StatusNotFound, types.ErrRoomNotFound.Error())
+		return view, false
+	}
+	return view, true
+}
+
+// roomVisibleTo applies the rule of roomFromPath to a room the caller acts on
+// as email: a private room only shows to its creator and peers.
+func roomVisibleTo(room *types.Room, email string) bool {
+	if room.IsPublic() || room.CreatedBy == email {
+		return true
+	}
+	_, err := room.GetPeer(email)
+	return err == nil
+}
+
+func (s *SocketServer) HandleGetRoom(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	view, ok := s.roomFromPath(writer, r)
+	if !ok {
+		return
+	}
+	writer.WriteJSON(http.StatusOK, view)
+}
+
+// HandleGetRoomPeers lists the peers of a room in the order they joined.
+func (s *SocketServer) HandleGetRoomPeers(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	view, ok := s.roomFromPath(writer, r)
+	if !ok {
+		return
+	}
+	peers := make([]peerView, 0, len(view.Peers))
+	for _, peer := range view.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if !peers[i].JoinedAt.Equal(peers[j].JoinedAt) {
+			return peers[i].JoinedAt.Before(peers[j].JoinedAt)
+		}
+		return peers[i].Email < peers[j].Email
+	})
+	writer.WriteJSON(http.StatusOK, map[string]interface{}{
+		"room_id": view.ID,
+		"peers":   peers,
+	})
+}
+
+// roomHTTPError turns the errors of room operations into HTTP errors.
+func roomHTTPError(err error) error {
+	var httpErr *utils.HTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		return err
+	case errors.Is(err, types.ErrRoomNotFound):
+		return utils.NewHTTPError(err.Error(), http.StatusNotFound)
+	case errors.Is(err, types.ErrNotAuthorized):
+		return utils.NewHTTPError(err.Error(), http.StatusForbidden)
+	case errors.Is(err, types.ErrInvalidTransition), errors.Is(err, types.ErrRoomClosed), errors.Is(err, types.ErrNotScheduled):
+		return utils.NewHTTPError(err.Error(), http.StatusConflict)
+	}
+	return err
+}
+
+func writeRoomError(writer *utils.ResponseWriter, err error) {
+	var httpErr *utils.HTTPError
+	if errors.As(roomHTTPError(err), &httpErr) {
+		writer.WriteError(httpErr.StatusCode, httpErr.Message)
+		return
+	}
+	fmt.Printf("Error handling room request: %v\n", err)
+	writer.WriteError(http.StatusInternalServerError, "Internal server error")
+}
+
+// managedRoom returns the room named by the {id} of the request path if the
+// request comes from its creator. This node hosts the room from then on, like
+// it does for the rooms its sockets join.
+func (s *SocketServer) managedRoom(r *http.Request) (*types.Room, error) {
+	user, err := authenticate(s.storage, r)
+	if err != nil {
+		return nil, err
+	}
+	room, ok := s.loadRoom(r.PathValue("id"))
+	if !ok || room.GetState() == types.RoomStateClosed {
+		return nil, types.ErrRoomNotFound
+	}
+	if room.CreatedBy != user.Email {
+		return nil, types.ErrNotAuthorized
+	}
+	return room, nil
+}
+
+// HandleCreateRoom creates a room without joining it. Its creator joins it
+// over the socket like everybody else.
+func (s *SocketServer) HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	utils.HandleRequest[types.CreateRoomRequest, roomView](w, r, http.MethodPost, func(req types.CreateRoomRequest) (roomView, error) {
+		user, err := authenticate(s.storage, r)
+		if err != nil {
+			return roomView{}, err
+		}
+		if req.Email == "" {
+			req.Email = user.Email
+		}
+		if req.Email != user.Email {
+			return roomView{}, roomHTTPError(types.ErrNotAuthorized)
+		}
+		if err := req.Validate(); err != nil {
+			return roomView{}, utils.NewHTTPError(err.Error(), http.StatusBadRequest)
+		}
+
+		room := newRoom(user.Email, req)
+		if err := s.openRoom(room); err != nil {
+			return roomView{}, err
+		}
+		fmt.Printf("Created room: %v\n", room)
+		return newRoomView(room, true)
+	})
+}
+
+// HandleUpdateRoom changes the attributes or the status of a room and
+// broadcasts the change to its peers as a room_patch.
+func (s *SocketServer) HandleUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	utils.HandleRequest[types.UpdateRoomRequest, roomView](w, r, http.MethodPatch, func(req types.UpdateRoomRequest) (roomView, error) {
+		if err := req.Validate(); err != nil {
+			return roomView{}, utils.NewHTTPError(err.Error(), http.StatusBadRequest)
+		}
+		room, err := s.managedRoom(r)
+		if err != nil {
+			return roomView{}, roomHTTPError(err)
+		}
+		if err := s.updateRoom(room, req, stateReasonRequested); err != nil {
+			return roomView{}, roomHTTPError(err)
+		}
+		return newRoomView(room, true)
+	})
+}
+
+// HandleDeleteRoom closes a room, ending the sessions still in it. A body
+// of {"status": 1} deactivates the room instead.
+func (s *SocketServer) HandleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	req := types.DeleteRoomRequest{Status: types.RoomStateClosed}
+	// The body is optional; chunked requests have no length to tell.
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writer.WriteError(http.StatusBadRequest, utils.ErrInvalidJSON.Error())
+		return
+	}
+	if req.Status != types.RoomStateClosed && req.Status != types.RoomStateInactive {
+		writer.WriteError(http.StatusBadRequest, "invalid status")
+		return
+	}
+
+	room, err := s.managedRoom(r)
+	if err == nil {
+		err = s.updateRoom(room, types.UpdateRoomRequest{Status: &req.Status}, stateReasonRequested)
+	}
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	view, err := newRoomView(room, false)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	writer.WriteJSON(http.StatusOK, view)
+}
+
+// HandleRSVP records that the authenticated user attends a scheduled room,
+// or no longer does on DELETE. Like HandleGetRoom, it does not find private
+// rooms for users other than their creator and peers.
+func (s *SocketServer) HandleRSVP(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	user, err := authenticate(s.storage, r)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	room, ok := s.loadRoom(r.PathValue("id"))
+	if !ok || room.GetState() == types.RoomStateClosed || !roomVisibleTo(room, user.Email) {
+		writeRoomError(writer, types.ErrRoomNotFound)
+		return
+	}
+	if err := s.rsvpRoom(room, user.Email, r.Method != http.MethodDelete); err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	view, err := newRoomView(room, false)
+	if err != nil {
+		writeRoomError(writer, err)
+		return
+	}
+	writer.WriteJSON(http.StatusOK, view)
+}
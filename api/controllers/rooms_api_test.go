@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+func openTestRoom(t *testing.T, s *SocketServer, createdBy string, public bool) string {
+	t.Helper()
+	room := newRoom(createdBy, types.CreateRoomRequest{
+		VideoSource: "https://videos.example.com/a.mp4",
+		Timestamp:   types.TimeStamp{End: 3600},
+		Public:      public,
+	})
+	if err := s.openRoom(room); err != nil {
+		t.Fatal(err)
+	}
+	return room.ID.String()
+}
+
+// getJSON requests url as email, anonymously if email is empty, and decodes
+// the response into v.
+func getJSON(t *testing.T, url, email string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != "" {
+		req.SetBasicAuth(email, "")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type roomPage struct {
+	Rooms      []roomView `json:"rooms"`
+	Total      int        `json:"total"`
+	NextOffset *int       `json:"next_offset"`
+}
+
+func TestListRoomsPagesTheDirectory(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	public := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		public[openTestRoom(t, s, "a@example.com", true)] = true
+	}
+	openTestRoom(t, s, "a@example.com", false)
+
+	var first, second roomPage
+	if code := getJSON(t, url+"/api/v1/rooms?limit=2", "", &first); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if len(first.Rooms) != 2 || first.Total != 3 || first.NextOffset == nil || *first.NextOffset != 2 {
+		t.Fatalf("first page: %d rooms of %d, next %v", len(first.Rooms), first.Total, first.NextOffset)
+	}
+	getJSON(t, url+"/api/v1/rooms?limit=2&offset=2", "", &second)
+	if len(second.Rooms) != 1 || second.NextOffset != nil {
+		t.Fatalf("second page: %d rooms, next %v", len(second.Rooms), second.NextOffset)
+	}
+	for _, room := range append(first.Rooms, second.Rooms...) {
+		if !public[room.ID] {
+			t.Fatalf("listed room %s is not one of the public rooms", room.ID)
+		}
+		delete(public, room.ID)
+	}
+
+	var filtered roomPage
+	getJSON(t, url+"/api/v1/rooms?created_by=b@example.com", "", &filtered)
+	if len(filtered.Rooms) != 0 || filtered.NextOffset != nil {
+		t.Fatalf("filtered page: %d rooms, next %v", len(filtered.Rooms), filtered.NextOffset)
+	}
+}
+
+func TestListRoomsIndexesRoomsStoredBefore(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, err := newSocketServer(st, storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := openTestRoom(t, s, "a@example.com", true)
+	s.Shutdown()
+	st.ZRem(roomDirectoryKey, id)
+	st.Set(roomSchemaKey, "2")
+
+	_, url := newTestNode(t, st, storage.NewMemoryBus())
+	var page roomPage
+	getJSON(t, url+"/api/v1/rooms", "", &page)
+	if len(page.Rooms) != 1 || page.Rooms[0].ID != id {
+		t.Fatalf("listed %v, want room %s", page.Rooms, id)
+	}
+}
+
+func TestGetPrivateRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com", "b@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	private := openTestRoom(t, s, "a@example.com", false)
+	public := openTestRoom(t, s, "a@example.com", true)
+
+	tests := []struct {
+		path  string
+		email string
+		code  int
+	}{
+		{"/api/v1/rooms/" + public, "", http.StatusOK},
+		{"/api/v1/rooms/" + public + "/peers", "", http.StatusOK},
+		{"/api/v1/rooms/" + private, "", http.StatusUnauthorized},
+		{"/api/v1/rooms/" + private + "/peers", "", http.StatusUnauthorized},
+		{"/api/v1/rooms/" + private, "b@example.com", http.StatusNotFound},
+		{"/api/v1/rooms/" + private + "/peers", "b@example.com", http.StatusNotFound},
+		{"/api/v1/rooms/" + private, "a@example.com", http.StatusOK},
+		{"/api/v1/rooms/" + private + "/peers", "a@example.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := getJSON(t, url+tt.path, tt.email, nil); code != tt.code {
+			t.Errorf("GET %s as %q: got %d, want %d", tt.path, tt.email, code, tt.code)
+		}
+	}
+
+	room, _ := s.loadRoom(private)
+	joinTestPeer(t, room, "b@example.com")
+	if code := getJSON(t, url+"/api/v1/rooms/"+private+"/peers", "b@example.com", nil); code != http.StatusOK {
+		t.Fatalf("peer got %d, want 200", code)
+	}
+}
+
+func TestRSVPToPrivateRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com", "b@example.com")
+	s, _ := newTestNode(t, st, storage.NewMemoryBus())
+	room := openScheduledRoom(t, s, false, time.Now().Add(time.Hour))
+	roomID := room.ID.String()
+
+	if code, _ := rsvp(t, s, http.MethodPost, roomID, "b@example.com"); code != http.StatusNotFound {
+		t.Fatalf("stranger got %d, want 404", code)
+	}
+	if code, _ := rsvp(t, s, http.MethodPost, roomID, "a@example.com"); code != http.StatusOK {
+		t.Fatalf("creator got %d, want 200", code)
+	}
+	joinTestPeer(t, room, "b@example.com")
+	code, view := rsvp(t, s, http.MethodPost, roomID, "b@example.com")
+	if code != http.StatusOK || len(view.RSVPs) != 2 {
+		t.Fatalf("peer got %d with RSVPs %v, want 200 with the creator and the peer", code, view.RSVPs)
+	}
+}
+
+// TestDeleteRoomWithChunkedBody deletes rooms with requests of unknown
+// length, which may or may not carry a body.
+func TestDeleteRoomWithChunkedBody(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, _ := newTestNode(t, st, storage.NewMemoryBus())
+
+	tests := []struct {
+		body   string
+		code   int
+		status types.RoomState
+	}{
+		{"", http.StatusOK, types.RoomStateClosed},
+		{fmt.Sprintf(`{"status": %d}`, types.RoomStateInactive), http.StatusOK, types.RoomStateInactive},
+		{`{"status":`, http.StatusBadRequest, types.RoomStateActive},
+	}
+	for _, tt := range tests {
+		roomID := openTestRoom(t, s, "a@example.com", true)
+		room, _ := s.loadRoom(roomID)
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/rooms/"+roomID, strings.NewReader(tt.body))
+		req.ContentLength = -1
+		req.SetPathValue("id", roomID)
+		req.SetBasicAuth("a@example.com", "")
+		rec := httptest.NewRecorder()
+		s.HandleDeleteRoom(rec, req)
+		if rec.Code != tt.code || room.GetState() != tt.status {
+			t.Errorf("DELETE with body %q: got %d and a %s room, want %d and %s", tt.body, rec.Code, room.GetState(), tt.code, tt.status)
+		}
+	}
+}
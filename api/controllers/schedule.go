@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/raghavyuva/go-party/types"
+)
+
+// scheduleTickInterval is how often the scheduled rooms of a node are checked
+// for countdowns and starts.
+const scheduleTickInterval = time.Second
+
+// countdownMarks are the seconds before the start of a scheduled room at
+// which its connections get a countdown event.
+var countdownMarks = []int64{3600, 1800, 600, 300, 60, 30, 10, 5, 4, 3, 2, 1}
+
+// A scheduled room waits inactive for its start. Every node counts down to it
+// for its own connections; the owner of the room starts it, which the other
+// nodes learn as a room update.
+
+func (s *SocketServer) runSchedules() {
+	ticker := time.NewTicker(scheduleTickInterval)
+	defer ticker.Stop()
+	// marks remembers the countdown mark each room was last announced at.
+	marks := make(map[string]int64)
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case now := <-ticker.C:
+			s.tickSchedules(now, marks)
+		}
+	}
+}
+
+func (s *SocketServer) tickSchedules(now time.Time, marks map[string]int64) {
+	waiting := make(map[string]struct{})
+	s.rooms.Range(func(key, roomVal interface{}) bool {
+		roomID := key.(string)
+		room := roomVal.(*types.Room)
+		start, ok := room.ScheduledStart()
+		if !ok {
+			return true
+		}
+		waiting[roomID] = struct{}{}
+
+		left := start.Sub(now)
+		if left <= 0 {
+			if s.ownsRoom(roomID) {
+				s.startScheduledRoom(room)
+			}
+			return true
+		}
+		mark, ok := countdownMark(left)
+		if ok && marks[roomID] != mark {
+			marks[roomID] = mark
+			s.sendCountdown(room, start, left)
+		}
+		return true
+	})
+	for roomID := range marks {
+		if _, ok := waiting[roomID]; !ok {
+			delete(marks, roomID)
+		}
+	}
+}
+
+// countdownMark returns the smallest mark at or above the seconds left.
+func countdownMark(left time.Duration) (int64, bool) {
+	seconds := int64(math.Ceil(left.Seconds()))
+	for i := len(countdownMarks) - 1; i >= 0; i-- {
+		if countdownMarks[i] >= seconds {
+			return countdownMarks[i], true
+		}
+	}
+	return 0, false
+}
+
+// sendCountdown tells the connections of this node how long until the room
+// starts. The other nodes tell theirs.
+func (s *SocketServer) sendCountdown(room *types.Room, start time.Time, left time.Duration) {
+	encoded := newEncodedMessage(types.Message{
+		Action: "countdown",
+		Data: map[string]interface{}{
+			"room_id":      room.ID.String(),
+			"starts_at":    start,
+			"seconds_left": int64(math.Ceil(left.Seconds())),
+		},
+	})
+	s.broadcastEncoded(room.ID.String(), func(*client) *encodedMessage { return encoded })
+}
+
+// startScheduledRoom activates a room whose start came and starts playback
+// for everybody in it, from where the creator set it up.
+func (s *SocketServer) startScheduledRoom(room *types.Room) {
+	roomID := room.ID.String()
+	status := types.RoomStateActive
+	if err := s.updateRoom(room, types.UpdateRoomRequest{Status: &status}, stateReasonScheduled); err != nil {
+		fmt.Printf("Error starting scheduled room %s: %v\n", roomID, err)
+		return
+	}
+	fmt.Printf("Started scheduled room %s\n", roomID)
+
+	s.broadcastToRoom(roomID, types.Message{
+		Action: "update_timestamp",
+		Data: map[string]interface{}{
+			"email":     room.CreatedBy,
+			"timestamp": room.GetTimestamp().Current,
+			"seeking":   true,
+			"room":      roomID,
+		},
+	})
+	s.broadcastToRoom(roomID, types.Message{
+		Action: "update_player_state",
+		Data: map[string]interface{}{
+			"email": room.CreatedBy,
+			"state": false,
+			"room":  roomID,
+		},
+	})
+}
+
+// rsvpRoom records on the owner of the room whether a user attends it. The
+// owner tells every node.
+func (s *SocketServer) rsvpRoom(room *types.Room, email string, going bool) error {
+	return s.changeRoom(room, roomChange{Kind: changeRSVP, Email: email, Going: going})
+}
+
+func (s *SocketServer) applyRSVP(room *types.Room, email string, going bool) (int64, error) {
+	_, revision, err := room.SetRSVP(email, going)
+	return revision, err
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// openScheduledRoom opens a room of a@example.com starting at start.
+func openScheduledRoom(t *testing.T, s *SocketServer, public bool, start time.Time) *types.Room {
+	t.Helper()
+	room := newRoom("a@example.com", types.CreateRoomRequest{
+		VideoSource:  "https://videos.example.com/a.mp4",
+		Timestamp:    types.TimeStamp{End: 3600, Current: 42},
+		Public:       public,
+		ScheduledFor: &start,
+	})
+	if err := s.openRoom(room); err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+// rsvp sends an RSVP of email to s, or takes it back with DELETE, and returns
+// the status and the room it answered with.
+func rsvp(t *testing.T, s *SocketServer, method, roomID, email string) (int, roomView) {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/rooms/"+roomID+"/rsvp", nil)
+	req.SetPathValue("id", roomID)
+	req.SetBasicAuth(email, "")
+	rec := httptest.NewRecorder()
+	s.HandleRSVP(rec, req)
+	var view roomView
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, view
+}
+
+func TestCreateScheduledRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	a := dialTestClient(t, url)
+	a.send("create_room", "create", map[string]interface{}{
+		"email":         "a@example.com",
+		"video_source":  "https://videos.example.com/a.mp4",
+		"timestamp":     map[string]interface{}{"start": 0, "end": 3600, "current": 0},
+		"scheduled_for": start.Format(time.RFC3339),
+	})
+	ack := a.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "create" })
+	roomID := ack.Data["result"].(map[string]interface{})["room_id"].(string)
+	room, _ := s.loadRoom(roomID)
+	if at, ok := room.ScheduledStart(); !ok || !at.Equal(start) || room.GetState() != types.RoomStateInactive {
+		t.Fatalf("room is %s, scheduled for %v (%v), want inactive until %v", room.GetState(), at, ok, start)
+	}
+	// Peers join the room before it starts.
+	if code := dialTestClient(t, url).join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+
+	// The schedule is stored with the room.
+	restored, err := s.GetRoom(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at, ok := restored.ScheduledStart(); !ok || !at.Equal(start) {
+		t.Fatalf("restored room scheduled for %v (%v), want %v", at, ok, start)
+	}
+}
+
+func TestCountdownMark(t *testing.T) {
+	tests := []struct {
+		left time.Duration
+		mark int64
+		ok   bool
+	}{
+		{2 * time.Hour, 0, false},
+		{time.Hour, 3600, true},
+		{time.Hour - 500*time.Millisecond, 3600, true},
+		{59 * time.Second, 60, true},
+		{30 * time.Second, 30, true},
+		{4200 * time.Millisecond, 5, true},
+		{500 * time.Millisecond, 1, true},
+	}
+	for _, tt := range tests {
+		if mark, ok := countdownMark(tt.left); mark != tt.mark || ok != tt.ok {
+			t.Errorf("countdownMark(%v) = %d, %v, want %d, %v", tt.left, mark, ok, tt.mark, tt.ok)
+		}
+	}
+}
+
+// TestCountdownOncePerMark ticks the schedules three times before a start.
+// The peers get a countdown for every mark the start comes closer to.
+func TestCountdownOncePerMark(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	start := time.Now().Add(time.Hour)
+	room := openScheduledRoom(t, s, true, start)
+	b := dialTestClient(t, url)
+	if code := b.join(room.ID.String(), "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+
+	marks := make(map[string]int64)
+	for _, before := range []time.Duration{59 * time.Second, 58 * time.Second, 30 * time.Second} {
+		s.tickSchedules(start.Add(-before), marks)
+	}
+	var left []float64
+	for _, msg := range b.drain(100 * time.Millisecond) {
+		// The ticks of the server itself count down from an hour.
+		if seconds := msg.Data["seconds_left"]; msg.Action == "countdown" && seconds.(float64) < 3000 {
+			left = append(left, seconds.(float64))
+		}
+	}
+	if len(left) != 2 || left[0] != 59 || left[1] != 30 {
+		t.Fatalf("countdowns at %v, want 59 and 30 seconds", left)
+	}
+}
+
+func TestScheduledRoomStarts(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	start := time.Now().Add(time.Hour)
+	room := openScheduledRoom(t, s, true, start)
+	b := dialTestClient(t, url)
+	if code := b.join(room.ID.String(), "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+
+	s.tickSchedules(start, make(map[string]int64))
+	if room.GetState() != types.RoomStateActive || room.GetStateReason() != stateReasonScheduled {
+		t.Fatalf("room is %s (%s), want active", room.GetState(), room.GetStateReason())
+	}
+	if _, ok := room.ScheduledStart(); ok {
+		t.Fatal("the room still waits for its start")
+	}
+	if msg := b.expect("update_timestamp"); msg.Data["timestamp"] != float64(42) || msg.Data["seeking"] != true {
+		t.Fatalf("playback starts at %v, want 42", msg.Data)
+	}
+	if msg := b.expect("update_player_state"); msg.Data["state"] != false {
+		t.Fatalf("player state %v, want playing", msg.Data["state"])
+	}
+}
+
+// TestRSVP answers and takes back an RSVP, once on the owner of the room and
+// once forwarded to it by another node.
+func TestRSVP(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "b@example.com", "c@example.com")
+	bus := storage.NewMemoryBus()
+	owner, _ := newTestNode(t, st, bus)
+	other, _ := newTestNode(t, st, bus)
+	room := openScheduledRoom(t, owner, true, time.Now().Add(time.Hour))
+	roomID := room.ID.String()
+	if _, ok := other.loadRoom(roomID); !ok {
+		t.Fatal("the other node could not restore the room")
+	}
+
+	if code, view := rsvp(t, owner, http.MethodPost, roomID, "b@example.com"); code != http.StatusOK || len(view.RSVPs) != 1 {
+		t.Fatalf("RSVP got %d with %v, want b@example.com", code, view.RSVPs)
+	}
+	code, view := rsvp(t, other, http.MethodPost, roomID, "c@example.com")
+	if _, ok := view.RSVPs["c@example.com"]; code != http.StatusOK || !ok || len(view.RSVPs) != 2 {
+		t.Fatalf("forwarded RSVP got %d with %v, want b and c", code, view.RSVPs)
+	}
+	if code, view := rsvp(t, owner, http.MethodDelete, roomID, "b@example.com"); code != http.StatusOK || len(view.RSVPs) != 1 {
+		t.Fatalf("taking back got %d with %v, want c@example.com only", code, view.RSVPs)
+	}
+}
+
+func TestRSVPToUnscheduledRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "b@example.com")
+	s, _ := newTestNode(t, st, storage.NewMemoryBus())
+	roomID := openTestRoom(t, s, "a@example.com", true)
+
+	if code, _ := rsvp(t, s, http.MethodPost, roomID, "b@example.com"); code != http.StatusConflict {
+		t.Fatalf("RSVP got %d, want 409", code)
+	}
+	if code := types.ErrorCodeFor(types.ErrNotScheduled); code != types.CodeInvalidPayload {
+		t.Fatalf("ErrNotScheduled is reported as %s, want %s", code, types.CodeInvalidPayload)
+	}
+}
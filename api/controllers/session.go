@@ -0,0 +1,472 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+)
+
+const (
+	defaultResumeGracePeriod = 30 * time.Second
+	// maxMissedEvents bounds what is buffered for a detached session. A
+	// client that missed more gets the full room on resume instead.
+	maxMissedEvents = 256
+)
+
+// session binds a connection to a peer of a room. A peer has one session per
+// device it joined with. When a connection drops its session is detached
+// instead of ended: broadcasts to it are buffered and a resume with its token
+// within the grace period picks up where it left off.
+//
+// The fields are guarded by the mutex of the peerSessions holding it.
+type session struct {
+	token  string
+	roomID string
+	email  string
+	// client is the connection bound to the session, or the last one while
+	// detached. Missed events were picked for its protocol version.
+	client   *client
+	detached bool
+	// replaying is set while a resume writes the missed events outside the
+	// lock. Broadcasts are buffered meanwhile, to follow them in order; the
+	// buffer is not bounded then, as the replay keeps draining it.
+	replaying bool
+	expiry    *time.Timer
+	missed    []*encodedMessage
+	overflow  bool
+}
+
+// peerSessions holds the sessions of one peer of a room. Its mutex also
+// serialises adding and removing the peer, so the peer joins the room with
+// its first session and leaves it with its last.
+type peerSessions struct {
+	mu       sync.Mutex
+	sessions []*session
+	// removed is set once the last session ended and the entry was dropped
+	// from the server; a new session needs a new entry.
+	removed bool
+}
+
+func sessionKey(roomID, email string) string {
+	return roomID + "\x00" + email
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func loadResumeGracePeriodFromEnv() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("RESUME_GRACE_PERIOD")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultResumeGracePeriod
+}
+
+// lockPeer returns the locked sessions of a peer, creating the entry when
+// the peer has none.
+func (s *SocketServer) lockPeer(roomID, email string) *peerSessions {
+	for {
+		val, _ := s.sessions.LoadOrStore(sessionKey(roomID, email), &peerSessions{})
+		ps := val.(*peerSessions)
+		ps.mu.Lock()
+		if !ps.removed {
+			return ps
+		}
+		ps.mu.Unlock()
+	}
+}
+
+// loadPeer returns the locked sessions of a peer if it has any.
+func (s *SocketServer) loadPeer(roomID, email string) (*peerSessions, bool) {
+	val, ok := s.sessions.Load(sessionKey(roomID, email))
+	if !ok {
+		return nil, false
+	}
+	ps := val.(*peerSessions)
+	ps.mu.Lock()
+	if ps.removed {
+		ps.mu.Unlock()
+		return nil, false
+	}
+	return ps, true
+}
+
+func (ps *peerSessions) find(c *client) *session {
+	for _, sess := range ps.sessions {
+		if sess.client == c {
+			return sess
+		}
+	}
+	return nil
+}
+
+func (ps *peerSessions) remove(sess *session) bool {
+	for i, other := range ps.sessions {
+		if other == sess {
+			ps.sessions = append(ps.sessions[:i], ps.sessions[i+1:]...)
+			if sess.expiry != nil {
+				sess.expiry.Stop()
+				sess.expiry = nil
+			}
+			sess.missed = nil
+			return true
+		}
+	}
+	return false
+}
+
+// attached returns the sessions of the peer that have a live connection.
+func (ps *peerSessions) attached() []*session {
+	var live []*session
+	for _, sess := range ps.sessions {
+		if !sess.detached {
+			live = append(live, sess)
+		}
+	}
+	return live
+}
+
+// syncPeer brings the peer of the room in line with its sessions after one
+// was added, detached, resumed or removed. It removes the peer with its last
+// session. The change is made on the owner of the room, which tells every
+// node. The caller holds ps.mu; the bus never waits for it, so the reply to
+// a forwarded change gets through meanwhile.
+func (s *SocketServer) syncPeer(ps *peerSessions, room *types.Room, email string) (*types.Peer, error) {
+	roomID := room.ID.String()
+	if len(ps.sessions) == 0 {
+		ps.removed = true
+		s.sessions.Delete(sessionKey(roomID, email))
+		err := s.changeRoom(room, roomChange{Kind: changePeerRemoved, Email: email})
+		if err != nil && !errors.Is(err, types.ErrPeerNotFound) {
+			fmt.Printf("Error removing peer %s from room %s: %v\n", email, roomID, err)
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	live := ps.attached()
+	status, connection := types.PeerReconnecting, ""
+	if len(live) > 0 {
+		status = types.PeerConnected
+		connection = live[len(live)-1].client.conn.RemoteAddr().String()
+	}
+	current, err := room.GetPeer(email)
+	if err != nil {
+		return nil, nil
+	}
+	if current.Devices == len(live) && current.Status == status && current.Connection == connection {
+		return current, nil
+	}
+
+	update := &types.Peer{Email: email, Devices: len(live), Status: status, Connection: connection}
+	if err := s.changeRoom(room, roomChange{Kind: changePeerUpdated, Peer: update}); err != nil {
+		fmt.Printf("Error updating peer %s of room %s: %v\n", email, roomID, err)
+		return nil, err
+	}
+	peer, _ := room.GetPeer(email)
+	return peer, nil
+}
+
+// joinPeer adds a session for c to the room. The peer joins with its first
+// session; further sessions are additional devices of the same peer. A
+// connection can hold one session per room, and joins all its rooms as the
+// same peer.
+func (s *SocketServer) joinPeer(c *client, room *types.Room, peer *types.Peer) error {
+	roomID := room.ID.String()
+	if email, ok := s.conns.Load(c.conn); ok && email.(string) != "" && email.(string) != peer.Email {
+		return types.ErrNotAuthorized
+	}
+	sess := &session{roomID: roomID, email: peer.Email, client: c}
+	if s.resumeGracePeriod > 0 {
+		token, err := newResumeToken()
+		if err != nil {
+			return types.WrapSocketError(types.CodeInternal, "Failed to issue resume token", err)
+		}
+		sess.token = token
+	}
+
+	ps := s.lockPeer(roomID, peer.Email)
+	if ps.find(c) != nil {
+		ps.mu.Unlock()
+		return types.ErrPeerExists
+	}
+	peer.Devices = 1
+	err := s.changeRoom(room, roomChange{Kind: changePeerAdded, Peer: peer})
+	if err == nil {
+		ps.sessions = append(ps.sessions, sess)
+	} else if errors.Is(err, types.ErrPeerExists) {
+		ps.sessions = append(ps.sessions, sess)
+		if _, err = s.syncPeer(ps, room, peer.Email); err != nil {
+			ps.remove(sess)
+		}
+	}
+	if len(ps.sessions) == 0 {
+		ps.removed = true
+		s.sessions.Delete(sessionKey(roomID, peer.Email))
+	}
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.conns.Store(c.conn, sess.email)
+	s.removeObserver(roomID, c)
+	c.subscribe(roomID, sess.email)
+	return nil
+}
+
+// sendSession gives the client the resume token of its session in the room.
+// Nothing is sent when resumption is disabled.
+func (s *SocketServer) sendSession(ctx *ActionContext, roomID, email string) error {
+	ps, ok := s.loadPeer(roomID, email)
+	if !ok {
+		return nil
+	}
+	var token string
+	if sess := ps.find(ctx.client); sess != nil {
+		token = sess.token
+	}
+	ps.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+	return ctx.Reply("session", map[string]interface{}{
+		"room_id":         roomID,
+		"resume_token":    token,
+		"grace_period_ms": s.resumeGracePeriod.Milliseconds(),
+	})
+}
+
+// leavePeer ends the session of c in the room. It returns ErrPeerNotFound
+// when c has none.
+func (s *SocketServer) leavePeer(c *client, room *types.Room, email string) error {
+	ps, ok := s.loadPeer(room.ID.String(), email)
+	if !ok {
+		return types.ErrPeerNotFound
+	}
+	sess := ps.find(c)
+	if sess == nil {
+		ps.mu.Unlock()
+		return types.ErrPeerNotFound
+	}
+	ps.remove(sess)
+	s.syncPeer(ps, room, email)
+	ps.mu.Unlock()
+
+	c.unsubscribe(room.ID.String())
+	s.releaseIdentity(c)
+	return nil
+}
+
+// detachPeer keeps the session of c in the room after c dropped. Without a
+// grace period the session ends right away.
+func (s *SocketServer) detachPeer(c *client, room *types.Room, email string) {
+	if s.shuttingDown() {
+		return
+	}
+	if s.resumeGracePeriod <= 0 {
+		s.leavePeer(c, room, email)
+		return
+	}
+	ps, ok := s.loadPeer(room.ID.String(), email)
+	if !ok {
+		return
+	}
+	sess := ps.find(c)
+	if sess == nil || sess.detached {
+		ps.mu.Unlock()
+		return
+	}
+	sess.detached = true
+	sess.expiry = time.AfterFunc(s.resumeGracePeriod, func() { s.expireSession(room, sess) })
+	peer, _ := s.syncPeer(ps, room, email)
+	ps.mu.Unlock()
+
+	if peer != nil && peer.Status == types.PeerReconnecting {
+		s.stopTyping(room.ID.String(), email)
+	}
+	fmt.Printf("Session of %s in room %s detached\n", email, room.ID)
+}
+
+func (s *SocketServer) expireSession(room *types.Room, sess *session) {
+	if s.shuttingDown() {
+		return
+	}
+	ps, ok := s.loadPeer(sess.roomID, sess.email)
+	if !ok {
+		return
+	}
+	if !sess.detached || !ps.remove(sess) {
+		ps.mu.Unlock()
+		return
+	}
+	s.syncPeer(ps, room, sess.email)
+	ps.mu.Unlock()
+
+	fmt.Printf("Session of %s in room %s expired\n", sess.email, sess.roomID)
+}
+
+// replay writes the events a resumed session missed to c, then the ones
+// buffered for it meanwhile, until none are left and broadcasts reach c again.
+// A session detached meanwhile keeps what is buffered for its next resume.
+func (s *SocketServer) replay(sess *session, c *client, missed []*encodedMessage) error {
+	for {
+		var err error
+		for _, msg := range missed {
+			if err = c.writeEncoded(msg); err != nil {
+				break
+			}
+		}
+
+		ps, ok := s.loadPeer(sess.roomID, sess.email)
+		if !ok {
+			return err
+		}
+		if sess.client != c || !sess.replaying {
+			ps.mu.Unlock()
+			return err
+		}
+		if err != nil {
+			// The events not written are lost; the next resume gets the
+			// full room instead.
+			sess.replaying = false
+			sess.missed, sess.overflow = nil, true
+			ps.mu.Unlock()
+			return err
+		}
+		if sess.detached || len(sess.missed) == 0 {
+			sess.replaying = false
+			ps.mu.Unlock()
+			return nil
+		}
+		missed = sess.missed
+		sess.missed = nil
+		ps.mu.Unlock()
+	}
+}
+
+// peerClients returns the live connections of a peer. Detached sessions and
+// the ones being replayed to get the message picked for them buffered
+// instead.
+func (s *SocketServer) peerClients(roomID, email string, pick func(c *client) *encodedMessage) []*client {
+	ps, ok := s.loadPeer(roomID, email)
+	if !ok {
+		return nil
+	}
+	defer ps.mu.Unlock()
+
+	var clients []*client
+	for _, sess := range ps.sessions {
+		if !sess.detached && !sess.replaying {
+			clients = append(clients, sess.client)
+			continue
+		}
+		msg := pick(sess.client)
+		switch {
+		case msg == nil || sess.overflow:
+		case len(sess.missed) >= maxMissedEvents && !sess.replaying:
+			sess.missed = nil
+			sess.overflow = true
+		default:
+			sess.missed = append(sess.missed, msg)
+		}
+	}
+	return clients
+}
+
+// handleResume rebinds a session to the connection sending the resume and
+// replays the events it missed. The resumed reply carries the rotated token;
+// it includes the full room when the missed events could not be replayed.
+func (s *SocketServer) handleResume(ctx *ActionContext) (interface{}, error) {
+	data := ctx.Payload.(*types.ResumeData)
+	roomVal, ok := s.rooms.Load(data.RoomID)
+	if !ok {
+		return nil, types.ErrSessionExpired
+	}
+	room := roomVal.(*types.Room)
+	if email, ok := s.conns.Load(ctx.Conn); ok && email.(string) != "" && email.(string) != data.Email {
+		return nil, types.ErrNotAuthorized
+	}
+	token, err := newResumeToken()
+	if err != nil {
+		return nil, types.WrapSocketError(types.CodeInternal, "Failed to issue resume token", err)
+	}
+
+	ps, ok := s.loadPeer(data.RoomID, data.Email)
+	if !ok {
+		return nil, types.ErrSessionExpired
+	}
+	var sess *session
+	for _, candidate := range ps.sessions {
+		if candidate.token != "" && subtle.ConstantTimeCompare([]byte(candidate.token), []byte(data.ResumeToken)) == 1 {
+			sess = candidate
+		}
+	}
+	if sess == nil {
+		ps.mu.Unlock()
+		return nil, types.ErrSessionExpired
+	}
+	if other := ps.find(ctx.client); other != nil && other != sess {
+		ps.mu.Unlock()
+		return nil, types.ErrPeerExists
+	}
+
+	var previous *client
+	if !sess.detached && sess.client != ctx.client {
+		previous = sess.client
+	}
+	missed, overflow := sess.missed, sess.overflow
+	// Missed events were picked for the protocol version of the old
+	// connection and are useless to a client speaking another one.
+	if sess.client.getProtocol().Version != ctx.client.getProtocol().Version {
+		missed, overflow = nil, true
+	}
+	if sess.expiry != nil {
+		sess.expiry.Stop()
+		sess.expiry = nil
+	}
+	sess.client = ctx.client
+	sess.detached = false
+	sess.replaying = true
+	sess.token = token
+	sess.missed, sess.overflow = nil, false
+	s.conns.Store(ctx.Conn, data.Email)
+	s.removeObserver(data.RoomID, ctx.client)
+	ctx.client.subscribe(data.RoomID, data.Email)
+	if previous != nil {
+		previous.unsubscribe(data.RoomID)
+	}
+	s.syncPeer(ps, room, data.Email)
+
+	reply := map[string]interface{}{
+		"room_id":      data.RoomID,
+		"resume_token": token,
+		"replayed":     len(missed),
+	}
+	if overflow {
+		reply["room"] = room
+	}
+	ps.mu.Unlock()
+
+	err = ctx.Reply("resumed", reply)
+	if err == nil {
+		err = s.replay(sess, ctx.client, missed)
+	}
+	if previous != nil {
+		s.closeConn(previous.conn, websocket.CloseNormalClosure, "session resumed on another connection")
+		previous.conn.Close()
+	}
+	return nil, err
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// joinForToken joins the room as email and returns the resume token of the
+// session.
+func (c *testClient) joinForToken(roomID, email string) string {
+	c.t.Helper()
+	c.send("join_room", "join", map[string]interface{}{"room_id": roomID, "email": email})
+	session := c.expectMatch("session", func(m testMessage) bool { return m.RequestID == "join" })
+	c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "join" })
+	return session.Data["resume_token"].(string)
+}
+
+// newResumeRoom opens a room of a@example.com that b@example.com joined, and
+// returns the resume token of b.
+func newResumeRoom(t *testing.T, grace time.Duration) (*SocketServer, string, string, *testClient, *testClient, string) {
+	t.Helper()
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	s.resumeGracePeriod = grace
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, url)
+	return s, url, roomID, a, b, b.joinForToken(roomID, "b@example.com")
+}
+
+// waitForPeer waits until the peer is in the room with the status, or gone
+// from it if gone is set.
+func waitForPeer(t *testing.T, s *SocketServer, roomID, email string, status types.PeerStatus, gone bool) {
+	t.Helper()
+	room, _ := s.loadRoom(roomID)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		peer, err := room.GetPeer(email)
+		if gone && err != nil || !gone && err == nil && peer.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %s is %v (%v)", email, peer, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func resume(c *testClient, roomID, email, token string) {
+	c.t.Helper()
+	c.send("resume", "resume", map[string]interface{}{"room_id": roomID, "email": email, "resume_token": token})
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	s, url, roomID, a, b, token := newResumeRoom(t, time.Minute)
+	b.conn.Close()
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerReconnecting, false)
+
+	chat := func(message string) {
+		t.Helper()
+		a.send("chat_message", message, map[string]interface{}{"room_id": roomID, "email": "a@example.com", "message": message})
+		a.expectMatch("ack", func(m testMessage) bool { return m.RequestID == message })
+	}
+	for i := 0; i < 3; i++ {
+		chat(fmt.Sprintf("missed %d", i))
+	}
+
+	resumed := dialTestClient(t, url)
+	resume(resumed, roomID, "b@example.com", token)
+	reply := resumed.expect("resumed")
+	if replayed := reply.Data["replayed"].(float64); replayed < 3 {
+		t.Fatalf("replayed %v events, want the 3 messages at least", replayed)
+	}
+	if reply.Data["resume_token"] == token {
+		t.Fatal("the resume token was not rotated")
+	}
+	chat("live")
+	for _, want := range []string{"missed 0", "missed 1", "missed 2", "live"} {
+		if msg := resumed.expect("chat_message"); msg.Data["message"] != want {
+			t.Fatalf("got message %v, want %q", msg.Data["message"], want)
+		}
+	}
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerConnected, false)
+
+	// The token is used up.
+	again := dialTestClient(t, url)
+	resume(again, roomID, "b@example.com", token)
+	if msg := again.expect("error"); msg.Data["code"] != string(types.CodeSessionExpired) {
+		t.Fatalf("reused token got %v, want %s", msg.Data["code"], types.CodeSessionExpired)
+	}
+}
+
+func TestResumeWithExpiredToken(t *testing.T) {
+	s, url, roomID, _, b, token := newResumeRoom(t, 50*time.Millisecond)
+	b.conn.Close()
+	waitForPeer(t, s, roomID, "b@example.com", "", true)
+
+	resumed := dialTestClient(t, url)
+	resume(resumed, roomID, "b@example.com", token)
+	if msg := resumed.expect("error"); msg.Data["code"] != string(types.CodeSessionExpired) {
+		t.Fatalf("expired token got %v, want %s", msg.Data["code"], types.CodeSessionExpired)
+	}
+}
+
+// TestResumeWithForeignToken resumes the session of b@example.com with a
+// token it does not hold, or as another peer.
+func TestResumeWithForeignToken(t *testing.T) {
+	s, url, roomID, a, b, token := newResumeRoom(t, time.Minute)
+	b.conn.Close()
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerReconnecting, false)
+
+	tests := []struct {
+		name  string
+		c     *testClient
+		email string
+		code  types.ErrorCode
+	}{
+		{"the token of b as a", dialTestClient(t, url), "a@example.com", types.CodeSessionExpired},
+		{"the session of b from the connection of a", a, "b@example.com", types.CodeNotAuthorized},
+	}
+	for _, tt := range tests {
+		resume(tt.c, roomID, tt.email, token)
+		if msg := tt.c.expect("error"); msg.Data["code"] != string(tt.code) {
+			t.Fatalf("resuming with %s got %v, want %s", tt.name, msg.Data["code"], tt.code)
+		}
+	}
+	forged := dialTestClient(t, url)
+	resume(forged, roomID, "b@example.com", token[:len(token)-1]+"x")
+	if msg := forged.expect("error"); msg.Data["code"] != string(types.CodeSessionExpired) {
+		t.Fatalf("forged token got %v, want %s", msg.Data["code"], types.CodeSessionExpired)
+	}
+
+	// The session is still there for its own token.
+	resumed := dialTestClient(t, url)
+	resume(resumed, roomID, "b@example.com", token)
+	resumed.expect("resumed")
+}
+
+// newDevicesRoom opens a room of a@example.com that b@example.com joined
+// from two connections.
+func newDevicesRoom(t *testing.T, grace time.Duration) (*SocketServer, string, *testClient, *testClient, *testClient) {
+	t.Helper()
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	s.resumeGracePeriod = grace
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b, tab := dialTestClient(t, url), dialTestClient(t, url)
+	for _, c := range []*testClient{b, tab} {
+		if code := c.join(roomID, "b@example.com"); code != "" {
+			t.Fatalf("join failed with %s", code)
+		}
+	}
+	room, _ := s.loadRoom(roomID)
+	if peer, err := room.GetPeer("b@example.com"); err != nil || peer.Devices != 2 {
+		t.Fatalf("peer is %v (%v), want 2 devices", peer, err)
+	}
+	return s, roomID, a, b, tab
+}
+
+func waitForDevices(t *testing.T, s *SocketServer, roomID, email string, devices int) {
+	t.Helper()
+	room, _ := s.loadRoom(roomID)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		peer, err := room.GetPeer(email)
+		if err == nil && peer.Devices == devices {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %s is %v (%v), want %d devices", email, peer, err, devices)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBroadcastReachesEveryDevice(t *testing.T) {
+	_, roomID, a, b, tab := newDevicesRoom(t, time.Minute)
+
+	a.send("chat_message", "chat", map[string]interface{}{"room_id": roomID, "email": "a@example.com", "message": "hi"})
+	for _, c := range []*testClient{b, tab} {
+		if msg := c.expect("chat_message"); msg.Data["message"] != "hi" {
+			t.Fatalf("got message %v, want hi", msg.Data["message"])
+		}
+	}
+}
+
+func TestLeavingFromOneDeviceKeepsThePeer(t *testing.T) {
+	s, roomID, a, b, tab := newDevicesRoom(t, time.Minute)
+
+	b.send("leave_room", "leave", map[string]interface{}{"room_id": roomID, "email": "b@example.com"})
+	b.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "leave" })
+	waitForDevices(t, s, roomID, "b@example.com", 1)
+
+	a.send("chat_message", "chat", map[string]interface{}{"room_id": roomID, "email": "a@example.com", "message": "hi"})
+	tab.expect("chat_message")
+	for _, msg := range b.drain(100 * time.Millisecond) {
+		if msg.Action == "chat_message" {
+			t.Fatal("the device that left still gets the broadcasts of the room")
+		}
+	}
+}
+
+// TestPeerLeavesWithLastDevice drops the devices of a peer one by one. The
+// peer stays while one is connected or may still resume.
+func TestPeerLeavesWithLastDevice(t *testing.T) {
+	s, roomID, _, b, tab := newDevicesRoom(t, 100*time.Millisecond)
+
+	b.conn.Close()
+	waitForDevices(t, s, roomID, "b@example.com", 1)
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerConnected, false)
+	time.Sleep(2 * s.resumeGracePeriod)
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerConnected, false)
+
+	tab.conn.Close()
+	waitForPeer(t, s, roomID, "b@example.com", types.PeerReconnecting, false)
+	waitForPeer(t, s, roomID, "b@example.com", "", true)
+}
+
+func TestPeerLeavesWithLastDeviceWithoutResume(t *testing.T) {
+	s, roomID, _, b, tab := newDevicesRoom(t, 0)
+
+	b.conn.Close()
+	waitForDevices(t, s, roomID, "b@example.com", 1)
+	tab.conn.Close()
+	waitForPeer(t, s, roomID, "b@example.com", "", true)
+}
@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,14 +8,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"github.com/raghavyuva/go-party/storage"
 	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
 )
 
 const (
-	maxMessageSize = 10 * 1024 * 1024
+	maxMessageSize = 32 * 1024
 	pingInterval   = 10 * time.Second
 	pingTimeout    = 60 * time.Second
 	
@@ -24,19 +25,53 @@ const (
 	pongWait  = 60 * time.Second
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 type SocketServer struct {
-	conns    *sync.Map
-	rooms    *sync.Map
-	storage  storage.Storage
-	shutdown chan struct{}
+	conns     *sync.Map
+	clients   *sync.Map
+	rooms     *sync.Map
+	presence  *sync.Map
+	sessions  *sync.Map
+	observers *sync.Map
+	storage   storage.Storage
+	shutdown  chan struct{}
+
+	// bus fans broadcasts out to the other nodes; node tells the events
+	// of this node apart.
+	bus  storage.Bus
+	node string
+	// owned holds the IDs of the rooms this node holds the lease of.
+	owned *sync.Map
+	// commands holds the locks serialising the changes to the rooms this
+	// node owns; replies the channels awaiting the replies to the changes
+	// it forwarded.
+	commands *sync.Map
+	replies  *sync.Map
+	// relay queues the messages of other nodes for the connections of this
+	// one.
+	relay *relayQueue
+
+	actions    *sync.Map
+	middleware []Middleware
+	metrics    *actionMetrics
+
+	chatFilters []ChatFilter
+	// chatPolicies caches the filter pipelines of the room chat policies.
+	chatPolicies *sync.Map
+	rateLimits   RateLimits
+	compression  CompressionConfig
+	// upgrader offers the protocol versions and the compression of this
+	// server.
+	upgrader websocket.Upgrader
+	// schemas holds the documented schema of every protocol version.
+	schemas map[int][]byte
+
+	resumeGracePeriod time.Duration
+	typingTimeout     time.Duration
+	staleRoomAge      time.Duration
+	roomIdleTimeout   time.Duration
+	roomCloseTimeout  time.Duration
+
+	webhooks *webhookDispatcher
 }
 
 func NewSocketServer() (*SocketServer, error) {
@@ -47,24 +82,74 @@ func NewSocketServer() (*SocketServer, error) {
 	address := os.Getenv("REDIS_ADDRESS")
 	password := os.Getenv("REDIS_PASSWORD")
 	fmt.Printf("Using Redis at %s with password %s\n", address, password)
-	storage := storage.NewRedisStorage(storage.RedisOpts{
+	redisOpts := storage.RedisOpts{
 		Address:  address,
 		Password: password,
 		DB:       0,
-	})
+	}
+	return newSocketServer(storage.NewRedisStorage(redisOpts), newBusFromEnv(redisOpts))
+}
 
+// newSocketServer starts a server on the given storage and bus.
+func newSocketServer(storage storage.Storage, bus storage.Bus) (*SocketServer, error) {
 	server := &SocketServer{
-		conns:    &sync.Map{},
-		rooms:    &sync.Map{},
-		storage:  storage,
-		shutdown: make(chan struct{}),
+		conns:     &sync.Map{},
+		clients:   &sync.Map{},
+		rooms:     &sync.Map{},
+		presence:  &sync.Map{},
+		sessions:  &sync.Map{},
+		observers: &sync.Map{},
+		storage:   storage,
+		shutdown:  make(chan struct{}),
+		bus:       bus,
+		node:      uuid.New().String(),
+		owned:     &sync.Map{},
+		commands:  &sync.Map{},
+		replies:   &sync.Map{},
+		relay:     newRelayQueue(),
+		actions:   &sync.Map{},
+		metrics:   &actionMetrics{},
+
+		chatPolicies: &sync.Map{},
+	}
+	server.chatFilters = NewChatFilters(loadChatPolicyFromEnv())
+	server.rateLimits = loadRateLimitsFromEnv()
+	server.compression = loadCompressionFromEnv()
+	server.resumeGracePeriod = loadResumeGracePeriodFromEnv()
+	server.typingTimeout = defaultTypingTimeout
+	server.staleRoomAge = loadStaleRoomAgeFromEnv()
+	server.roomIdleTimeout = loadRoomIdleTimeoutFromEnv()
+	server.roomCloseTimeout = loadRoomCloseTimeoutFromEnv()
+	server.webhooks = newWebhookDispatcher(loadWebhooksFromEnv(), server.shutdown)
+
+	server.Use(loggingMiddleware, server.metrics.middleware, recoveryMiddleware)
+	server.registerBuiltinActions()
+	if err := server.loadProtocolSchemas(); err != nil {
+		return nil, err
+	}
+	server.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		Subprotocols:      subprotocols(),
+		EnableCompression: server.compression.Enabled,
 	}
+	server.migrateRooms()
+	// Subscribed first, so the owners of the rooms restored can answer.
+	go server.relayMessages()
+	server.bus.Subscribe(roomsChannel, server.handleRoomEvent)
+	server.rehydrateRooms()
+	go server.renewLeases()
+	go server.runSchedules()
+	go server.runLifecycle()
 
 	return server, nil
 }
 
 func (s *SocketServer) HandleHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading connection: %v", err)
 		return
@@ -73,66 +158,121 @@ func (s *SocketServer) HandleHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("New incoming connection from client:", conn.RemoteAddr())
 	
 	conn.SetReadLimit(maxMessageSize)
+	if s.compression.Enabled {
+		conn.SetCompressionLevel(s.compression.Level)
+	}
 	// conn.SetReadDeadline(time.Now().Add(pongWait))
 	// conn.SetPongHandler(func(string) error {
 	// 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	// 	return nil
 	// })
 	
+	c := newClient(conn, s.compression.Threshold)
 	s.conns.Store(conn, "")
+	s.clients.Store(conn, c)
 	defer s.handleDisconnect(conn)
-	s.readLoop(conn)
+	s.readLoop(c)
 }
 
-func (s *SocketServer) readLoop(conn *websocket.Conn) {
+func (s *SocketServer) readLoop(c *client) {
+	conn := c.conn
+	limiter := newConnLimiter(s.rateLimits)
 	for {
-		_, message, err := conn.ReadMessage()
+		frameType, frame, err := conn.ReadMessage()
 		if err != nil {
 			fmt.Printf("Error reading message: %v\n", err)
-			s.sendError(conn, "Failed to read message")
+			s.sendError(conn, types.IncomingMessage{}, types.NewSocketError(types.CodeInvalidMessage, "Failed to read message"))
 			return
 		}
+		if ok, retryAfter := limiter.allowFrame(); !ok {
+			if s.rateLimited(c, limiter, types.IncomingMessage{}, retryAfter) {
+				return
+			}
+			continue
+		}
+		message, err := decodeFrame(frameType, frame)
+		if err != nil {
+			fmt.Printf("Error decoding binary frame: %v\n", err)
+			s.sendError(conn, types.IncomingMessage{}, types.NewSocketError(types.CodeInvalidMessage, "Invalid message format"))
+			continue
+		}
 
-		var msg types.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
+		var msg types.IncomingMessage
+		if err := utils.DecodeStrict(message, &msg, "action"); err != nil {
 			fmt.Printf("Error unmarshaling message: %v\n", err)
-			s.sendError(conn, "Invalid message format")
+			s.sendError(conn, types.IncomingMessage{}, types.NewSocketError(types.CodeInvalidMessage, "Invalid message format"))
+			continue
+		}
+		if len(msg.RequestID) > types.MaxClientFieldLength {
+			s.sendError(conn, types.IncomingMessage{Action: msg.Action}, types.NewSocketError(types.CodeInvalidMessage, "request_id too long"))
 			continue
 		}
 
-		fmt.Printf("Received message from %s: %v with payload %v\n", conn.RemoteAddr(), msg.Action, msg.Data)
+		action, known := s.lookupAction(msg.Action, c.getProtocol().Version)
+		if ok, retryAfter := limiter.allowAction(msg.Action, s.rateLimitFor(action)); !ok {
+			if s.rateLimited(c, limiter, msg, retryAfter) {
+				return
+			}
+			continue
+		}
 		
-		switch msg.Action {
-		case "create_room", "join_room", "leave_room", "ping", "player_state", "update_timestamp", "chat_message":
-			s.handleMessage(conn, msg)
-		default:
-			s.sendError(conn, "Unknown message action")
+		if !known {
+			s.sendError(conn, msg, types.NewSocketError(types.CodeUnknownAction, "Unknown message action"))
+			continue
 		}
+		s.handleMessage(c, action, msg)
 	}
 }
 
+// rateLimited tells the client to back off, or disconnects it once it
+// exceeded its limits too often. It reports whether it disconnected.
+func (s *SocketServer) rateLimited(c *client, limiter *connLimiter, msg types.IncomingMessage, retryAfter time.Duration) bool {
+	if limiter.recordViolation() {
+		fmt.Printf("Disconnecting %s: rate limit persistently exceeded\n", c.conn.RemoteAddr())
+		s.closeConn(c.conn, websocket.ClosePolicyViolation, "rate limit exceeded")
+		return true
+	}
+	s.sendRateLimited(c.conn, msg, retryAfter)
+	return false
+}
+
 func (s *SocketServer) handleDisconnect(conn *websocket.Conn) {
-	if email, ok := s.conns.Load(conn); ok {
-		s.rooms.Range(func(roomID, roomVal interface{}) bool {
-			room := roomVal.(*types.Room)
-			if _, exists := room.GetPeers()[email.(string)]; exists {
-				s.handleLeaveRoom(conn, roomID.(string), email.(string))
+	if c, ok := s.clientFor(conn); ok {
+		for roomID, email := range c.subscriptions() {
+			if email == "" {
+				s.removeObserver(roomID, c)
+				continue
 			}
-			return true
-		})
-		s.conns.Delete(conn)
+			if roomVal, ok := s.rooms.Load(roomID); ok {
+				s.detachPeer(c, roomVal.(*types.Room), email)
+			}
+		}
 	}
+	s.conns.Delete(conn)
+	s.clients.Delete(conn)
 	conn.Close()
 }
 
+// broadcastToRoom sends msg to every connection of the room, on this node and
+// on the others.
 func (s *SocketServer) broadcastToRoom(roomID string, msg types.Message) {
+	if roomVal, ok := s.rooms.Load(roomID); ok {
+		roomVal.(*types.Room).Touch()
+	}
+	encoded := newEncodedMessage(msg)
+	s.broadcastEncoded(roomID, func(*client) *encodedMessage { return encoded })
+	s.publishMessage(roomID, msg)
+}
+
+// broadcastEncoded sends every connection of the room on this node, peers
+// and observers, the message pick returns for it. Connections pick returns nil for are skipped.
+func (s *SocketServer) broadcastEncoded(roomID string, pick func(c *client) *encodedMessage) {
 	roomVal, ok := s.rooms.Load(roomID)
 	if !ok {
 		fmt.Printf("Room %s not found\n", roomID)
 		return
 	}
 	room := roomVal.(*types.Room)
-	data, _ := json.Marshal(msg)
 
 	fmt.Printf("\n=== Starting Broadcast ===\n")
 	fmt.Printf("Room ID: %s\n", roomID)
@@ -161,38 +301,42 @@ func (s *SocketServer) broadcastToRoom(roomID string, msg types.Message) {
 	fmt.Println("\nAttempting to send messages:")
 	room.ForEachPeer(func(email string, peer *types.Peer) bool {
 		fmt.Printf("\nLooking for connections for peer: %s\n", email)
-		matchFound := false
-
-		s.conns.Range(func(conn, connEmail interface{}) bool {
-			if connEmail.(string) == email {
-				matchFound = true
-				fmt.Printf("Found match! Sending to %s at %s\n",
-					email,
-					conn.(*websocket.Conn).RemoteAddr())
-				
-				conn.(*websocket.Conn).SetWriteDeadline(time.Now().Add(writeWait))
-				if err := conn.(*websocket.Conn).WriteMessage(websocket.TextMessage, data); err != nil {
+		clients := s.peerClients(roomID, email, pick)
+
+		for _, c := range clients {
+			fmt.Printf("Found match! Sending to %s at %s\n",
+				email,
+				c.conn.RemoteAddr())
+
+			if encoded := pick(c); encoded != nil {
+				if err := c.writeEncoded(encoded); err != nil {
 					log.Printf("Error broadcasting to %s: %v", email, err)
 				}
 			}
-			return true
-		})
+		}
 
-		if !matchFound {
+		if len(clients) == 0 {
 			fmt.Printf("No connection found for peer: %s\n", email)
 		}
 		return true
 	})
+	s.sendToObservers(roomID, pick)
 	fmt.Printf("\n=== Broadcast Complete ===\n")
 }
 
 func (s *SocketServer) Shutdown() {
 	close(s.shutdown)
+	s.bus.Close()
 
+	// The rooms stay open for their peers on the other nodes; only the
+	// copies of this node are dropped and its leases released.
 	s.rooms.Range(func(_, roomVal interface{}) bool {
-		room := roomVal.(*types.Room)
-		room.SetState(types.RoomStateClosed)
-		room.Close()
+		roomVal.(*types.Room).Close()
+		return true
+	})
+
+	s.owned.Range(func(roomID, _ interface{}) bool {
+		s.releaseRoom(roomID.(string))
 		return true
 	})
 
@@ -202,72 +346,12 @@ func (s *SocketServer) Shutdown() {
 	})
 }
 
-func (s *SocketServer) handleMessage(conn *websocket.Conn, msg types.Message) {
-	switch msg.Action {
-	case "create_room":
-		createData, err := s.ValidateCreateRoomRequest(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid create room request: %v", err))
-			return
-		}
-		_, err = s.CreateRoom(conn, createData)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Failed to create room: %v", err))
-			return
-		}
-
-	case "join_room":
-		joinData, err := s.formatAndValidateJoinRoomData(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid join room data: %v", err))
-			return
-		}
-		s.handleJoinRoom(conn, joinData)
-
-	case "leave_room":
-		leaveData, err := s.formatAndValidateLeaveRoomData(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid leave room data: %v", err))
-			return
-		}
-		s.handleLeaveRoom(conn, leaveData.RoomID, leaveData.Email)
-
-	case "ping":
-		data, ok := msg.Data.(map[string]interface{})
-		if !ok {
-			s.sendError(conn, "Invalid data format")
-			return
-		}
-		email, ok := data["email"].(string)
-		if !ok || email == "" {
-			s.sendError(conn, "Invalid email")
-			return
-		}
-		s.handlePing(email)
-
-	case "player_state":
-		playerStateData, err := s.validatePlayerStateData(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid player state data: %v", err))
-			return
-		}
-		s.handlePlayerState(conn, playerStateData)
-
-	case "update_timestamp":
-		updateTimestampData, err := s.validateVideoSyncData(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid update timestamp data: %v", err))
-			return
-		}
-		s.handleVideoSync(conn, updateTimestampData)
-
-	case "chat_message":
-		chatMessageData, err := s.validateChatMessageData(msg)
-		if err != nil {
-			s.sendError(conn, fmt.Sprintf("Invalid chat message data: %v", err))
-			return
-		}
-		s.handleChatMessage(conn, chatMessageData)
+func (s *SocketServer) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/storage"
+)
+
+// testTimeout bounds how long a test waits for a message.
+const testTimeout = 3 * time.Second
+
+// newTestNode starts a node on st and bus, serving sockets and the REST API
+// of the room tests. Environment variables set with t.Setenv before apply.
+func newTestNode(t *testing.T, st storage.Storage, bus storage.Bus) (*SocketServer, string) {
+	t.Helper()
+	s, err := newSocketServer(st, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.HandleHTTP)
+	mux.HandleFunc("GET /api/v1/rooms", s.HandleListRooms)
+	mux.HandleFunc("GET /api/v1/rooms/{id}", s.HandleGetRoom)
+	mux.HandleFunc("GET /api/v1/rooms/{id}/peers", s.HandleGetRoomPeers)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		s.Shutdown()
+		srv.Close()
+	})
+	return s, srv.URL
+}
+
+func addTestUsers(st storage.Storage, emails ...string) {
+	for _, email := range emails {
+		st.Set("user:"+email, `{"email":"`+email+`"}`)
+	}
+}
+
+type testMessage struct {
+	Action    string                 `json:"action"`
+	RequestID string                 `json:"request_id"`
+	Data      map[string]interface{} `json:"data"`
+	raw       string
+}
+
+// testClient is a socket connection that records what the server sends.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan testMessage
+}
+
+func dialTestClient(t *testing.T, url string, subprotocols ...string) *testClient {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: conn, messages: make(chan testMessage, 1024)}
+	go func() {
+		defer close(c.messages)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg := testMessage{raw: string(data)}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Errorf("undecodable message %s: %v", data, err)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+func (c *testClient) send(action, requestID string, data interface{}) {
+	c.t.Helper()
+	msg, err := json.Marshal(map[string]interface{}{"action": action, "request_id": requestID, "data": data})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect skips messages until one with the action arrives and returns it.
+func (c *testClient) expect(action string) testMessage {
+	c.t.Helper()
+	return c.expectMatch(action, func(testMessage) bool { return true })
+}
+
+// expectMatch skips messages until one with the action that match accepts
+// arrives and returns it.
+func (c *testClient) expectMatch(action string, match func(testMessage) bool) testMessage {
+	c.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %s", action)
+			}
+			if msg.Action == action && match(msg) {
+				return msg
+			}
+		case <-deadline:
+			c.t.Fatalf("timed out waiting for %s", action)
+		}
+	}
+}
+
+// drain returns the messages received until none arrived for idle.
+func (c *testClient) drain(idle time.Duration) []testMessage {
+	var messages []testMessage
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, msg)
+		case <-time.After(idle):
+			return messages
+		}
+	}
+}
+
+// createTestRoom creates a room as email and returns its ID.
+func (c *testClient) createTestRoom(email string) string {
+	c.t.Helper()
+	c.send("create_room", "create", map[string]interface{}{
+		"email":        email,
+		"video_source": "https://videos.example.com/a.mp4",
+		"timestamp":    map[string]interface{}{"start": 0, "end": 3600, "current": 0},
+	})
+	ack := c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "create" })
+	return ack.Data["result"].(map[string]interface{})["room_id"].(string)
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// roomObservers holds the connections subscribed to a room without being
+// peers of it. They get the broadcasts of the room like its peers do.
+type roomObservers struct {
+	mu      sync.Mutex
+	clients map[*client]struct{}
+}
+
+func (c *client) subscribe(roomID, email string) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.rooms[roomID] = email
+}
+
+func (c *client) unsubscribe(roomID string) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	delete(c.rooms, roomID)
+}
+
+// subscription returns the email the connection joined the room as, which
+// is empty when it only observes the room.
+func (c *client) subscription(roomID string) (string, bool) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	email, ok := c.rooms[roomID]
+	return email, ok
+}
+
+// subscriptions returns a copy of the rooms the connection is subscribed to.
+func (c *client) subscriptions() map[string]string {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	rooms := make(map[string]string, len(c.rooms))
+	for roomID, email := range c.rooms {
+		rooms[roomID] = email
+	}
+	return rooms
+}
+
+// isMember reports whether the connection is a peer of any room.
+func (c *client) isMember() bool {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	for _, email := range c.rooms {
+		if email != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseIdentity forgets the email of a connection that is no longer a peer
+// of any room, so it may join the next one as someone else.
+func (s *SocketServer) releaseIdentity(c *client) {
+	if c.isMember() {
+		return
+	}
+	if _, ok := s.conns.Load(c.conn); ok {
+		s.conns.Store(c.conn, "")
+	}
+}
+
+func (s *SocketServer) addObserver(roomID string, c *client) {
+	val, _ := s.observers.LoadOrStore(roomID, &roomObservers{clients: make(map[*client]struct{})})
+	o := val.(*roomObservers)
+	o.mu.Lock()
+	o.clients[c] = struct{}{}
+	o.mu.Unlock()
+}
+
+func (s *SocketServer) removeObserver(roomID string, c *client) {
+	val, ok := s.observers.Load(roomID)
+	if !ok {
+		return
+	}
+	o := val.(*roomObservers)
+	o.mu.Lock()
+	delete(o.clients, c)
+	o.mu.Unlock()
+}
+
+func (s *SocketServer) observersOf(roomID string) []*client {
+	val, ok := s.observers.Load(roomID)
+	if !ok {
+		return nil
+	}
+	o := val.(*roomObservers)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	clients := make([]*client, 0, len(o.clients))
+	for c := range o.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// dropObservers unsubscribes the observers of a room that closed.
+func (s *SocketServer) dropObservers(roomID string) {
+	val, ok := s.observers.LoadAndDelete(roomID)
+	if !ok {
+		return
+	}
+	o := val.(*roomObservers)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for c := range o.clients {
+		c.unsubscribe(roomID)
+	}
+}
+
+func (s *SocketServer) sendToObservers(roomID string, pick func(c *client) *encodedMessage) {
+	for _, c := range s.observersOf(roomID) {
+		if encoded := pick(c); encoded != nil {
+			if err := c.writeEncoded(encoded); err != nil {
+				log.Printf("Error broadcasting to observer %s: %v", c.conn.RemoteAddr(), err)
+			}
+		}
+	}
+}
+
+// canObserve tells whether a connection may observe a room. Like the room
+// API, it shows anybody a public room and others only to their creator and
+// peers: the connection must have joined or created a room as one of them.
+func (s *SocketServer) canObserve(conn *websocket.Conn, room *types.Room) bool {
+	if room.IsPublic() {
+		return true
+	}
+	email, ok := s.conns.Load(conn)
+	return ok && roomVisibleTo(room, email.(string))
+}
+
+// handleSubscribeRoom lets a connection observe a room: it receives the
+// broadcasts of the room without joining it. Subscribing again is a no-op.
+// A private room the connection may not observe is not found.
+func (s *SocketServer) handleSubscribeRoom(ctx *ActionContext) (interface{}, error) {
+	data := ctx.Payload.(*types.SubscribeRoomData)
+	room, ok := s.loadRoom(data.RoomID)
+	if !ok || !s.canObserve(ctx.Conn, room) {
+		return nil, types.ErrRoomNotFound
+	}
+	if email, ok := ctx.client.subscription(data.RoomID); ok && email != "" {
+		return nil, types.ErrPeerExists
+	}
+
+	ctx.client.subscribe(data.RoomID, "")
+	s.addObserver(data.RoomID, ctx.client)
+	// The room may have closed in between, after its observers were dropped.
+	if _, ok := s.rooms.Load(data.RoomID); !ok {
+		s.removeObserver(data.RoomID, ctx.client)
+		ctx.client.unsubscribe(data.RoomID)
+		return nil, types.ErrRoomNotFound
+	}
+
+	s.sendRoomState(ctx, room)
+	return map[string]interface{}{"room_id": data.RoomID, "room": room}, nil
+}
+
+func (s *SocketServer) handleUnsubscribeRoom(ctx *ActionContext) (interface{}, error) {
+	data := ctx.Payload.(*types.SubscribeRoomData)
+	email, ok := ctx.client.subscription(data.RoomID)
+	if !ok {
+		return nil, types.ErrPeerNotFound
+	}
+	if email != "" {
+		return nil, types.NewSocketError(types.CodeAlreadyInRoom, "Peers leave rooms with leave_room")
+	}
+	s.removeObserver(data.RoomID, ctx.client)
+	ctx.client.unsubscribe(data.RoomID)
+	return map[string]interface{}{"room_id": data.RoomID}, nil
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+// TestSubscribeToPrivateRoom observes a private room. Only connections acting
+// as its creator or one of its peers find it.
+func TestSubscribeToPrivateRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com", "c@example.com")
+	_, url := newTestNode(t, st, storage.NewMemoryBus())
+
+	a := dialTestClient(t, url)
+	roomID := a.createTestRoom("a@example.com")
+	b := dialTestClient(t, url)
+	if code := b.join(roomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	subscribe := map[string]interface{}{"room_id": roomID}
+
+	outsider := dialTestClient(t, url)
+	otherRoomID := outsider.createTestRoom("c@example.com")
+	for name, c := range map[string]*testClient{"a stranger": dialTestClient(t, url), "the creator of another room": outsider} {
+		c.send("subscribe_room", "sub", subscribe)
+		msg := c.expectMatch("error", func(m testMessage) bool { return m.RequestID == "sub" })
+		if msg.Data["code"] != string(types.CodeRoomNotFound) {
+			t.Fatalf("%s subscribed and got %v, want %s", name, msg.Data["code"], types.CodeRoomNotFound)
+		}
+	}
+
+	// The creator and the peer observe the room from another room they are
+	// in.
+	creator := dialTestClient(t, url)
+	creator.createTestRoom("a@example.com")
+	peer := dialTestClient(t, url)
+	if code := peer.join(otherRoomID, "b@example.com"); code != "" {
+		t.Fatalf("join failed with %s", code)
+	}
+	for _, c := range []*testClient{creator, peer} {
+		c.send("subscribe_room", "sub", subscribe)
+		c.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "sub" })
+	}
+}
+
+func TestSubscribeToPublicRoom(t *testing.T) {
+	st := storage.NewMemoryStorage()
+	s, url := newTestNode(t, st, storage.NewMemoryBus())
+	roomID := openTestRoom(t, s, "a@example.com", true)
+
+	stranger := dialTestClient(t, url)
+	stranger.send("subscribe_room", "sub", map[string]interface{}{"room_id": roomID})
+	stranger.expectMatch("ack", func(m testMessage) bool { return m.RequestID == "sub" })
+}
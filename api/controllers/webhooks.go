@@ -0,0 +1,458 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/raghavyuva/go-party/types"
+	"github.com/raghavyuva/go-party/utils"
+)
+
+const (
+	webhookEventHeader     = "X-GoParty-Event"
+	webhookDeliveryHeader  = "X-GoParty-Delivery"
+	webhookTimestampHeader = "X-GoParty-Timestamp"
+	webhookSignatureHeader = "X-GoParty-Signature"
+
+	// webhookQueueSize bounds the deliveries waiting for an attempt; more are
+	// dropped.
+	webhookQueueSize = 1024
+	webhookWorkers   = 4
+	// webhookLogSize is how many of the latest deliveries the log keeps.
+	webhookLogSize = 200
+)
+
+// The webhook events.
+const (
+	webhookRoomCreated  = "room.created"
+	webhookRoomStarted  = "room.started"
+	webhookPeerJoined   = "peer.joined"
+	webhookPeerLeft     = "peer.left"
+	webhookVideoChanged = "room.video_changed"
+	webhookRoomClosed   = "room.closed"
+)
+
+// startReasonCreated is the reason room.started gives for a room created
+// active. The other starts give the reason of the state change.
+const startReasonCreated = "created"
+
+// The states of a delivery.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+	deliveryDropped   = "dropped"
+)
+
+// WebhookConfig sets where room events are posted. Every endpoint gets every
+// event the config selects.
+type WebhookConfig struct {
+	URLs []string
+	// Secret signs the payloads: X-GoParty-Signature is "sha256=" and the hex
+	// HMAC-SHA256 of X-GoParty-Timestamp, a dot and the body.
+	Secret string
+	// Events selects the events to post; all of them if empty.
+	Events      []string
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles with every
+	// further retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+	// LogToken guards the delivery log: requests for it carry the token
+	// as a bearer token. Without one the log is not served.
+	LogToken string
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+		Timeout:     10 * time.Second,
+	}
+}
+
+func loadWebhooksFromEnv() WebhookConfig {
+	config := DefaultWebhookConfig()
+	config.URLs = splitEnvList("WEBHOOK_URLS")
+	config.Secret = os.Getenv("WEBHOOK_SECRET")
+	config.Events = splitEnvList("WEBHOOK_EVENTS")
+	config.LogToken = os.Getenv("WEBHOOK_LOG_TOKEN")
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && v > 0 {
+		config.MaxAttempts = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("WEBHOOK_BACKOFF")); err == nil && v > 0 {
+		config.Backoff = v
+	}
+	return config
+}
+
+// webhookPayload is the body of a webhook. ID is the same for all endpoints
+// and retries, so receivers can drop duplicates. Deliveries may arrive out of
+// order; the revision of the room orders them.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	RoomID    string      `json:"room_id"`
+	Revision  int64       `json:"revision"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is an entry of the delivery log. Endpoint is the scheme and
+// host of the URL only, as webhook URLs often carry credentials.
+type WebhookDelivery struct {
+	ID          string     `json:"id"`
+	Event       string     `json:"event"`
+	RoomID      string     `json:"room_id"`
+	Endpoint    string     `json:"endpoint"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+type webhookDelivery struct {
+	// entry is guarded by the mutex of the dispatcher.
+	entry WebhookDelivery
+	url   string
+	body  []byte
+}
+
+// webhookDispatcher posts webhooks from a queue, retrying failed attempts
+// with exponential backoff, and logs the latest deliveries.
+type webhookDispatcher struct {
+	config WebhookConfig
+	events map[string]bool
+	client *http.Client
+	queue  chan *webhookDelivery
+	stop   <-chan struct{}
+
+	mu  sync.Mutex
+	log []*webhookDelivery
+}
+
+// newWebhookDispatcher starts posting the webhooks of config until stop is
+// closed. Deliveries still pending then are lost.
+func newWebhookDispatcher(config WebhookConfig, stop <-chan struct{}) *webhookDispatcher {
+	d := &webhookDispatcher{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		queue:  make(chan *webhookDelivery, webhookQueueSize),
+		stop:   stop,
+	}
+	if len(config.Events) > 0 {
+		d.events = make(map[string]bool, len(config.Events))
+		for _, event := range config.Events {
+			d.events[event] = true
+		}
+	}
+	if len(config.URLs) > 0 {
+		for i := 0; i < webhookWorkers; i++ {
+			go d.run()
+		}
+	}
+	return d
+}
+
+func (d *webhookDispatcher) enabled(event string) bool {
+	return len(d.config.URLs) > 0 && (d.events == nil || d.events[event])
+}
+
+// send queues the event for every endpoint.
+func (d *webhookDispatcher) send(event, roomID string, revision int64, data interface{}) {
+	if !d.enabled(event) {
+		return
+	}
+	payload := webhookPayload{
+		ID:        uuid.New().String(),
+		Event:     event,
+		RoomID:    roomID,
+		Revision:  revision,
+		CreatedAt: time.Now(),
+		Data:      data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("Error marshaling webhook %s: %v\n", event, err)
+		return
+	}
+	for _, endpoint := range d.config.URLs {
+		delivery := &webhookDelivery{
+			entry: WebhookDelivery{
+				ID:        uuid.New().String(),
+				Event:     event,
+				RoomID:    roomID,
+				Endpoint:  redactURL(endpoint),
+				Status:    deliveryPending,
+				CreatedAt: payload.CreatedAt,
+			},
+			url:  endpoint,
+			body: body,
+		}
+		d.record(delivery)
+		d.enqueue(delivery)
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		d.mu.Lock()
+		delivery.entry.Status = deliveryDropped
+		delivery.entry.Error = "queue full"
+		delivery.entry.NextAttempt = nil
+		d.mu.Unlock()
+		fmt.Printf("Dropped webhook %s to %s: queue full\n", delivery.entry.Event, delivery.entry.Endpoint)
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case delivery := <-d.queue:
+			d.attempt(delivery)
+		}
+	}
+}
+
+// attempt posts a delivery once and schedules its retry if it failed for a
+// reason that may pass: the endpoint being unreachable, overloaded or
+// failing.
+func (d *webhookDispatcher) attempt(delivery *webhookDelivery) {
+	code, err := d.post(delivery)
+	now := time.Now()
+
+	d.mu.Lock()
+	entry := &delivery.entry
+	entry.Attempts++
+	entry.StatusCode = code
+	entry.Error = ""
+	entry.NextAttempt = nil
+	var backoff time.Duration
+	switch {
+	case err == nil:
+		entry.Status = deliveryDelivered
+		entry.DeliveredAt = &now
+	case retryableWebhookStatus(code) && entry.Attempts < d.config.MaxAttempts:
+		entry.Error = err.Error()
+		backoff = d.backoff(entry.Attempts)
+		next := now.Add(backoff)
+		entry.NextAttempt = &next
+	default:
+		entry.Error = err.Error()
+		entry.Status = deliveryFailed
+	}
+	attempts, status := entry.Attempts, entry.Status
+	d.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("Webhook %s to %s failed on attempt %d: %v\n", delivery.entry.Event, delivery.entry.Endpoint, attempts, err)
+	}
+	if status == deliveryPending {
+		time.AfterFunc(backoff, func() {
+			select {
+			case <-d.stop:
+			default:
+				d.enqueue(delivery)
+			}
+		})
+	}
+}
+
+func (d *webhookDispatcher) post(delivery *webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.entry.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.entry.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if d.config.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(d.config.Secret, timestamp, delivery.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.config.Backoff
+	for i := 1; i < attempts && backoff < d.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if d.config.MaxBackoff > 0 && backoff > d.config.MaxBackoff {
+		backoff = d.config.MaxBackoff
+	}
+	return backoff
+}
+
+// retryableWebhookStatus tells whether an attempt that got the status code,
+// or none for a transport error, is worth retrying.
+func retryableWebhookStatus(code int) bool {
+	return code == 0 || code == http.StatusTooManyRequests || code >= 500
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (d *webhookDispatcher) record(delivery *webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, delivery)
+	if len(d.log) > webhookLogSize {
+		d.log = append([]*webhookDelivery(nil), d.log[len(d.log)-webhookLogSize:]...)
+	}
+}
+
+// deliveries returns the delivery log, newest first.
+func (d *webhookDispatcher) deliveries() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := make([]WebhookDelivery, 0, len(d.log))
+	for i := len(d.log) - 1; i >= 0; i-- {
+		entries = append(entries, d.log[i].entry)
+	}
+	return entries
+}
+
+// roomWebhooks posts the webhooks of a room event. Only the owner of the room
+// posts them, so each goes out once however many nodes host the room.
+func (s *SocketServer) roomWebhooks(room *types.Room, ev types.RoomEvent) {
+	roomID := room.ID.String()
+	if !s.ownsRoom(roomID) {
+		return
+	}
+	switch ev.Kind {
+	case types.RoomPeerJoined:
+		s.webhooks.send(webhookPeerJoined, roomID, ev.Revision, map[string]interface{}{
+			"peer": peerView{
+				Email:    ev.Peer.Email,
+				JoinedAt: ev.Peer.JoinedAt,
+				Status:   ev.Peer.Status,
+				Devices:  ev.Peer.Devices,
+			},
+			"peer_count": room.PeerCount(),
+		})
+	case types.RoomPeerLeft:
+		s.webhooks.send(webhookPeerLeft, roomID, ev.Revision, map[string]interface{}{
+			"email":      ev.Email,
+			"peer_count": room.PeerCount(),
+		})
+	case types.RoomStateChanged:
+		if ev.State == types.RoomStateClosed {
+			s.webhooks.send(webhookRoomClosed, roomID, ev.Revision, map[string]interface{}{
+				"reason": ev.Reason,
+			})
+		} else if ev.State == types.RoomStateActive {
+			s.roomStartedWebhook(room, ev.Revision, ev.Reason)
+		}
+	case types.RoomUpdated:
+		if video, ok := ev.Patch["video_source"]; ok {
+			s.webhooks.send(webhookVideoChanged, roomID, ev.Revision, map[string]interface{}{
+				"video_source": video,
+			})
+		}
+	}
+}
+
+// roomStartedWebhook posts room.started for a room that became active:
+// created so, started on schedule, back from idling or started on request.
+func (s *SocketServer) roomStartedWebhook(room *types.Room, revision int64, reason string) {
+	s.webhooks.send(webhookRoomStarted, room.ID.String(), revision, map[string]interface{}{
+		"reason":     reason,
+		"peer_count": room.PeerCount(),
+	})
+}
+
+// roomCreatedWebhook returns the posting of room.created for a room this node
+// just stored, and of room.started if the room starts right away. They carry
+// the room as stored; the watch of the room posts them ahead of its events.
+func (s *SocketServer) roomCreatedWebhook(room *types.Room) func() {
+	revision := room.Revision()
+	var view *roomView
+	if s.webhooks.enabled(webhookRoomCreated) {
+		created, err := newRoomView(room, false)
+		if err != nil {
+			fmt.Printf("Error building webhook for room %s: %v\n", room.ID, err)
+			return nil
+		}
+		view = &created
+	}
+	started := room.GetState() == types.RoomStateActive
+	return func() {
+		if view != nil {
+			s.webhooks.send(webhookRoomCreated, room.ID.String(), revision, *view)
+		}
+		if started {
+			s.roomStartedWebhook(room, revision, startReasonCreated)
+		}
+	}
+}
+
+// authorized tells whether a request for the delivery log bears the log
+// token.
+func (d *webhookDispatcher) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return d.config.LogToken != "" && ok &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(d.config.LogToken)) == 1
+}
+
+// HandleWebhookDeliveries serves the log of the latest webhook deliveries of
+// this node to requests bearing the log token.
+func (s *SocketServer) HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	writer := &utils.ResponseWriter{ResponseWriter: w}
+	if !s.webhooks.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteError(http.StatusUnauthorized, "Authentication required")
+		return
+	}
+	writer.WriteJSON(http.StatusOK, map[string]interface{}{
+		"deliveries": s.webhooks.deliveries(),
+	})
+}
@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raghavyuva/go-party/storage"
+	"github.com/raghavyuva/go-party/types"
+)
+
+type receivedWebhook struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver records the webhooks posted to it and answers each with
+// the next of its statuses, 200 once they ran out.
+type webhookReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	received []receivedWebhook
+	arrived  chan struct{}
+	url      string
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{t: t, statuses: statuses, arrived: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		rcv.received = append(rcv.received, receivedWebhook{at: time.Now(), header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		rcv.mu.Unlock()
+		w.WriteHeader(status)
+		rcv.arrived <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	rcv.url = srv.URL + "/hooks"
+	return rcv
+}
+
+// wait waits for n more webhooks and returns all received so far.
+func (rcv *webhookReceiver) wait(n int) []receivedWebhook {
+	rcv.t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rcv.arrived:
+		case <-time.After(testTimeout):
+			rcv.t.Fatalf("timed out waiting for webhook %d of %d", i+1, n)
+		}
+	}
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]receivedWebhook(nil), rcv.received...)
+}
+
+// waitForDelivery waits until the only delivery of the log left pending.
+func waitForDelivery(t *testing.T, d *webhookDispatcher) WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if entries := d.deliveries(); len(entries) == 1 && entries[0].Status != deliveryPending {
+			return entries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery still pending: %+v", d.deliveries())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookRetriesSignedDelivery(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	stop := make(chan struct{})
+	defer close(stop)
+	config := DefaultWebhookConfig()
+	config.URLs = []string{strings.Replace(rcv.url, "http://", "http://user:pass@", 1)}
+	config.Secret = "secret"
+	config.Backoff = 20 * time.Millisecond
+	d := newWebhookDispatcher(config, stop)
+
+	d.send(webhookPeerLeft, "room-1", 7, map[string]interface{}{"email": "b@example.com"})
+	received := rcv.wait(3)
+
+	var id string
+	for i, hook := range received {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(hook.header.Get(webhookTimestampHeader) + "."))
+		mac.Write(hook.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); hook.header.Get(webhookSignatureHeader) != want {
+			t.Fatalf("attempt %d signed %q, want %q", i+1, hook.header.Get(webhookSignatureHeader), want)
+		}
+		if i > 0 && hook.header.Get(webhookDeliveryHeader) != received[0].header.Get(webhookDeliveryHeader) {
+			t.Fatalf("attempt %d has another delivery ID", i+1)
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal(hook.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != webhookPeerLeft || payload.RoomID != "room-1" || payload.Revision != 7 {
+			t.Fatalf("attempt %d posted %+v", i+1, payload)
+		}
+		if i > 0 && payload.ID != id {
+			t.Fatalf("attempt %d has payload ID %s, want %s", i+1, payload.ID, id)
+		}
+		id = payload.ID
+	}
+	// The backoff doubles: 20ms before the second attempt, 40ms before the
+	// third.
+	if gap := received[1].at.Sub(received[0].at); gap < config.Backoff {
+		t.Fatalf("second attempt came after %v, want at least %v", gap, config.Backoff)
+	}
+	if gap := received[2].at.Sub(received[1].at); gap < 2*config.Backoff {
+		t.Fatalf("third attempt came after %v, want at least %v", gap, 2*config.Backoff)
+	}
+
+	entry := waitForDelivery(t, d)
+	if entry.Status != deliveryDelivered || entry.Attempts != 3 || entry.StatusCode != http.StatusOK ||
+		entry.Error != "" || entry.DeliveredAt == nil || entry.NextAttempt != nil {
+		t.Fatalf("delivery logged as %+v", entry)
+	}
+	if entry.Endpoint != strings.TrimSuffix(rcv.url, "/hooks") || entry.Event != webhookPeerLeft || entry.RoomID != "room-1" {
+		t.Fatalf("delivery logged as %+v", entry)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	for name, tc := range map[string]struct {
+		statuses []int
+		attempts int
+	}{
+		"client error":  {[]int{http.StatusBadRequest}, 1},
+		"out of tries":  {[]int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, 3},
+		"retried first": {[]int{http.StatusBadGateway, http.StatusGone}, 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rcv := newWebhookReceiver(t, tc.statuses...)
+			stop := make(chan struct{})
+			defer close(stop)
+			config := DefaultWebhookConfig()
+			config.URLs = []string{rcv.url}
+			config.MaxAttempts = 3
+			config.Backoff = time.Millisecond
+			d := newWebhookDispatcher(config, stop)
+
+			d.send(webhookRoomClosed, "room-1", 1, nil)
+			rcv.wait(tc.attempts)
+			entry := waitForDelivery(t, d)
+			if entry.Status != deliveryFailed || entry.Attempts != tc.attempts ||
+				entry.StatusCode != tc.statuses[tc.attempts-1] || entry.Error == "" {
+				t.Fatalf("delivery logged as %+v", entry)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliveriesNeedToken(t *testing.T) {
+	t.Setenv("WEBHOOK_LOG_TOKEN", "token")
+	s, err := newSocketServer(storage.NewMemoryStorage(), storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	for auth, want := range map[string]int{
+		"":             http.StatusUnauthorized,
+		"Bearer other": http.StatusUnauthorized,
+		"Basic token":  http.StatusUnauthorized,
+		"Bearer token": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/deliveries", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.HandleWebhookDeliveries(w, r)
+		if w.Code != want {
+			t.Fatalf("%q got %d, want %d", auth, w.Code, want)
+		}
+	}
+}
+
+func TestWebhookDeliveriesOffWithoutToken(t *testing.T) {
+	s, err := newSocketServer(storage.NewMemoryStorage(), storage.NewMemoryBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/deliveries", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	s.HandleWebhookDeliveries(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestRoomStartedWebhook posts room.started whenever a room becomes active,
+// not only when a scheduled room starts.
+func TestRoomStartedWebhook(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	t.Setenv("WEBHOOK_URLS", rcv.url)
+	t.Setenv("WEBHOOK_EVENTS", webhookRoomStarted)
+	s, _ := newTestNode(t, storage.NewMemoryStorage(), storage.NewMemoryBus())
+
+	started := func() map[string]interface{} {
+		t.Helper()
+		received := rcv.wait(1)
+		var payload struct {
+			Event string                 `json:"event"`
+			Data  map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(received[len(received)-1].body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != webhookRoomStarted {
+			t.Fatalf("got %s, want %s", payload.Event, webhookRoomStarted)
+		}
+		return payload.Data
+	}
+
+	roomID := openTestRoom(t, s, "a@example.com", true)
+	if data := started(); data["reason"] != startReasonCreated {
+		t.Fatalf("created room started for %v", data["reason"])
+	}
+	room, _ := s.loadRoom(roomID)
+
+	s.tickLifecycle(time.Now().Add(2 * time.Hour))
+	room.Touch()
+	s.tickLifecycle(time.Now())
+	if data := started(); data["reason"] != stateReasonActivity {
+		t.Fatalf("reactivated room started for %v", data["reason"])
+	}
+
+	if !s.setRoomState(room, types.RoomStateInactive, stateReasonRequested) ||
+		!s.setRoomState(room, types.RoomStateActive, stateReasonRequested) {
+		t.Fatal("could not stop and start the room")
+	}
+	if data := started(); data["reason"] != stateReasonRequested {
+		t.Fatalf("restarted room started for %v", data["reason"])
+	}
+}
+
+// slowRoomStorage takes a while to update hashes, as storing a room does.
+type slowRoomStorage struct {
+	storage.Storage
+}
+
+func (st slowRoomStorage) HUpdate(key string, update func(map[string]string) (map[string]string, error)) error {
+	time.Sleep(20 * time.Millisecond)
+	return st.Storage.HUpdate(key, update)
+}
+
+// TestRoomCreatedWebhookComesFirst creates rooms over the socket, which the
+// creator joins before the room is stored. Each room is still posted as
+// created before its peer joined.
+func TestRoomCreatedWebhookComesFirst(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	t.Setenv("WEBHOOK_URLS", rcv.url)
+	t.Setenv("WEBHOOK_EVENTS", webhookRoomCreated+","+webhookPeerJoined)
+	st := storage.NewMemoryStorage()
+	addTestUsers(st, "a@example.com")
+	s, url := newTestNode(t, slowRoomStorage{st}, storage.NewMemoryBus())
+
+	const rooms = 5
+	for i := 0; i < rooms; i++ {
+		dialTestClient(t, url).createTestRoom("a@example.com")
+	}
+	rcv.wait(2 * rooms)
+
+	posted := make(map[string]string)
+	entries := s.webhooks.deliveries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Event == webhookPeerJoined && posted[entry.RoomID] != webhookRoomCreated {
+			t.Fatalf("room %s: %s posted before %s", entry.RoomID, webhookPeerJoined, webhookRoomCreated)
+		}
+		posted[entry.RoomID] = entry.Event
+	}
+	if len(posted) != rooms {
+		t.Fatalf("got the webhooks of %d rooms, want %d", len(posted), rooms)
+	}
+}
@@ -26,7 +26,7 @@ func NewServer(listenAddr string, store storage.Storage) *Server {
 func (s *Server) CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token, Sec-WebSocket-Extensions, Sec-WebSocket-Key, Sec-WebSocket-Version")
 		w.Header().Set("Access-Control-Expose-Headers", "Authorization")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -75,4 +75,15 @@ func (s *Server) setupRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		wsServer.HandleHTTP(w, r)
 	})
+	mux.HandleFunc("/api/v1/protocol", wsServer.HandleProtocolSchema)
+	mux.HandleFunc("/api/v1/metrics", wsServer.HandleMetrics)
+	mux.HandleFunc("GET /api/v1/webhooks/deliveries", wsServer.HandleWebhookDeliveries)
+	mux.HandleFunc("GET /api/v1/rooms", wsServer.HandleListRooms)
+	mux.HandleFunc("POST /api/v1/rooms", wsServer.HandleCreateRoom)
+	mux.HandleFunc("GET /api/v1/rooms/{id}", wsServer.HandleGetRoom)
+	mux.HandleFunc("PATCH /api/v1/rooms/{id}", wsServer.HandleUpdateRoom)
+	mux.HandleFunc("DELETE /api/v1/rooms/{id}", wsServer.HandleDeleteRoom)
+	mux.HandleFunc("GET /api/v1/rooms/{id}/peers", wsServer.HandleGetRoomPeers)
+	mux.HandleFunc("POST /api/v1/rooms/{id}/rsvp", wsServer.HandleRSVP)
+	mux.HandleFunc("DELETE /api/v1/rooms/{id}/rsvp", wsServer.HandleRSVP)
 }
\ No newline at end of file
@@ -0,0 +1,47 @@
+package storage
+
+import "sync"
+
+// Bus carries messages between the server instances sharing a storage.
+type Bus interface {
+	Publish(channel string, payload []byte) error
+	// Subscribe calls handler for every message published on channel,
+	// including the ones this instance published.
+	Subscribe(channel string, handler func(payload []byte))
+	Close()
+}
+
+// MemoryBus delivers messages within the process, synchronously and in
+// publishing order. Several servers sharing one behave like a cluster.
+type MemoryBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]func([]byte)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		handlers: make(map[string][]func([]byte)),
+	}
+}
+
+func (b *MemoryBus) Publish(channel string, payload []byte) error {
+	b.mu.RLock()
+	handlers := b.handlers[channel]
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(channel string, handler func([]byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[channel] = append(b.handlers[channel], handler)
+}
+
+func (b *MemoryBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = make(map[string][]func([]byte))
+}
@@ -2,13 +2,33 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 var ctx = context.Background()
 
+var acquireLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
 type RedisOpts struct {
 	Address  string
 	Password string
@@ -53,6 +73,184 @@ func (s *RedisStorage) Delete(key string) {
 	}
 }
 
+func (s *RedisStorage) Incr(key string) (int64, error) {
+	return s.client.Incr(ctx, key).Result()
+}
+
+func (s *RedisStorage) Keys(pattern string) []string {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		fmt.Println("Error in scanning keys in redis", err)
+		return nil
+	}
+	return keys
+}
+
+func (s *RedisStorage) HSet(key string, fields map[string]string) {
+	err := s.client.HSet(ctx, key, fields).Err()
+	if err != nil {
+		fmt.Println("Error in setting hash fields in redis", err)
+	}
+}
+
+func (s *RedisStorage) HGetAll(key string) map[string]string {
+	fields, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		fmt.Println("Error in getting hash from redis", err)
+		return nil
+	}
+	return fields
+}
+
+func (s *RedisStorage) SAdd(key, member string) {
+	err := s.client.SAdd(ctx, key, member).Err()
+	if err != nil {
+		fmt.Println("Error in adding set member in redis", err)
+	}
+}
+
+func (s *RedisStorage) SRem(key, member string) {
+	err := s.client.SRem(ctx, key, member).Err()
+	if err != nil {
+		fmt.Println("Error in removing set member from redis", err)
+	}
+}
+
+func (s *RedisStorage) SMembers(key string) []string {
+	members, err := s.client.SMembers(ctx, key).Result()
+	if err != nil {
+		fmt.Println("Error in getting set members from redis", err)
+		return nil
+	}
+	return members
+}
+
+func (s *RedisStorage) SCard(key string) int {
+	count, err := s.client.SCard(ctx, key).Result()
+	if err != nil {
+		fmt.Println("Error in counting set members in redis", err)
+		return 0
+	}
+	return int(count)
+}
+
+func (s *RedisStorage) ZAdd(key, member string, score float64) {
+	err := s.client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+	if err != nil {
+		fmt.Println("Error in adding sorted set member in redis", err)
+	}
+}
+
+func (s *RedisStorage) ZRem(key, member string) {
+	err := s.client.ZRem(ctx, key, member).Err()
+	if err != nil {
+		fmt.Println("Error in removing sorted set member from redis", err)
+	}
+}
+
+func (s *RedisStorage) ZRangeByScore(key string, min, max float64) []string {
+	members, err := s.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: strconv.FormatFloat(min, 'f', -1, 64),
+		Max: strconv.FormatFloat(max, 'f', -1, 64),
+	}).Result()
+	if err != nil {
+		fmt.Println("Error in getting sorted set range from redis", err)
+		return nil
+	}
+	return members
+}
+
+func (s *RedisStorage) ZRevRangeByScore(key string, max, min float64, offset, count int) []string {
+	members, err := s.client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:    strconv.FormatFloat(min, 'f', -1, 64),
+		Max:    strconv.FormatFloat(max, 'f', -1, 64),
+		Offset: int64(offset),
+		Count:  int64(count),
+	}).Result()
+	if err != nil {
+		fmt.Println("Error in getting sorted set range from redis", err)
+		return nil
+	}
+	return members
+}
+
+func (s *RedisStorage) ZCard(key string) int {
+	count, err := s.client.ZCard(ctx, key).Result()
+	if err != nil {
+		fmt.Println("Error in counting sorted set members in redis", err)
+		return 0
+	}
+	return int(count)
+}
+
+func (s *RedisStorage) Update(key string, fn func(string) (string, error)) error {
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		value, err := fn(current)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if value == "" {
+				pipe.Del(ctx, key)
+			} else {
+				pipe.Set(ctx, key, value, 0)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *RedisStorage) HUpdate(key string, fn func(map[string]string) (map[string]string, error)) error {
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		fields, err := fn(current)
+		if err != nil || len(fields) == 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, fields)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *RedisStorage) AcquireLease(key, owner string, ttl time.Duration) bool {
+	acquired, err := acquireLeaseScript.Run(ctx, s.client, []string{key}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		fmt.Println("Error in acquiring lease in redis", err)
+		return false
+	}
+	return acquired == 1
+}
+
+func (s *RedisStorage) ReleaseLease(key, owner string) {
+	err := releaseLeaseScript.Run(ctx, s.client, []string{key}, owner).Err()
+	if err != nil {
+		fmt.Println("Error in releasing lease in redis", err)
+	}
+}
+
 func (s *RedisStorage) Close() {
 	err := s.client.Close()
 	if err != nil {
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps everything in the process. It stands in for Redis in
+// tests and lets several servers in one process share a storage.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	values map[string]string
+	hashes map[string]map[string]string
+	sets   map[string]map[string]struct{}
+	zsets  map[string]map[string]float64
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		values: make(map[string]string),
+		hashes: make(map[string]map[string]string),
+		sets:   make(map[string]map[string]struct{}),
+		zsets:  make(map[string]map[string]float64),
+		leases: make(map[string]memoryLease),
+	}
+}
+
+func (s *MemoryStorage) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func (s *MemoryStorage) Set(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+func (s *MemoryStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	delete(s.hashes, key)
+	delete(s.sets, key)
+	delete(s.zsets, key)
+}
+
+func (s *MemoryStorage) Incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var value int64
+	if current, ok := s.values[key]; ok {
+		var err error
+		if value, err = strconv.ParseInt(current, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	value++
+	s.values[key] = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+func (s *MemoryStorage) Keys(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	match := func(key string) {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.values {
+		match(key)
+	}
+	for key := range s.hashes {
+		match(key)
+	}
+	for key := range s.sets {
+		match(key)
+	}
+	for key := range s.zsets {
+		match(key)
+	}
+	return keys
+}
+
+func (s *MemoryStorage) HSet(key string, fields map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.hashes[key]
+	if !ok {
+		hash = make(map[string]string, len(fields))
+		s.hashes[key] = hash
+	}
+	for field, value := range fields {
+		hash[field] = value
+	}
+}
+
+func (s *MemoryStorage) HGetAll(key string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make(map[string]string, len(s.hashes[key]))
+	for field, value := range s.hashes[key] {
+		fields[field] = value
+	}
+	return fields
+}
+
+func (s *MemoryStorage) SAdd(key, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		s.sets[key] = set
+	}
+	set[member] = struct{}{}
+}
+
+func (s *MemoryStorage) SRem(key, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if set, ok := s.sets[key]; ok {
+		delete(set, member)
+		if len(set) == 0 {
+			delete(s.sets, key)
+		}
+	}
+}
+
+func (s *MemoryStorage) SMembers(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]string, 0, len(s.sets[key]))
+	for member := range s.sets[key] {
+		members = append(members, member)
+	}
+	return members
+}
+
+func (s *MemoryStorage) SCard(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sets[key])
+}
+
+func (s *MemoryStorage) ZAdd(key, member string, score float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zset, ok := s.zsets[key]
+	if !ok {
+		zset = make(map[string]float64)
+		s.zsets[key] = zset
+	}
+	zset[member] = score
+}
+
+func (s *MemoryStorage) ZRem(key, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if zset, ok := s.zsets[key]; ok {
+		delete(zset, member)
+		if len(zset) == 0 {
+			delete(s.zsets, key)
+		}
+	}
+}
+
+func (s *MemoryStorage) ZRangeByScore(key string, min, max float64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zset := s.zsets[key]
+	var members []string
+	for member, score := range zset {
+		if score >= min && score <= max {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+func (s *MemoryStorage) ZRevRangeByScore(key string, max, min float64, offset, count int) []string {
+	members := s.ZRangeByScore(key, min, max)
+	if offset >= len(members) {
+		return nil
+	}
+	page := make([]string, 0, count)
+	for i := len(members) - 1 - offset; i >= 0 && len(page) < count; i-- {
+		page = append(page, members[i])
+	}
+	return page
+}
+
+func (s *MemoryStorage) ZCard(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.zsets[key])
+}
+
+// Update holds the lock while fn runs, so no write can come in between and
+// it never conflicts.
+func (s *MemoryStorage) Update(key string, fn func(string) (string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, err := fn(s.values[key])
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	return nil
+}
+
+func (s *MemoryStorage) HUpdate(key string, fn func(map[string]string) (map[string]string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := make(map[string]string, len(s.hashes[key]))
+	for field, value := range s.hashes[key] {
+		current[field] = value
+	}
+	fields, err := fn(current)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	if s.hashes[key] == nil {
+		s.hashes[key] = make(map[string]string, len(fields))
+	}
+	for field, value := range fields {
+		s.hashes[key][field] = value
+	}
+	return nil
+}
+
+func (s *MemoryStorage) AcquireLease(key, owner string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if lease, ok := s.leases[key]; ok && lease.owner != owner && now.Before(lease.expires) {
+		return false
+	}
+	s.leases[key] = memoryLease{owner: owner, expires: now.Add(ttl)}
+	return true
+}
+
+func (s *MemoryStorage) ReleaseLease(key, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lease, ok := s.leases[key]; ok && lease.owner == owner {
+		delete(s.leases, key)
+	}
+}
+
+func (s *MemoryStorage) Close() {}
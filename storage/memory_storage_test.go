@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStorageUpdateIsAtomic(t *testing.T) {
+	s := NewMemoryStorage()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Update("counter", func(current string) (string, error) {
+				n, _ := strconv.Atoi(current)
+				return strconv.Itoa(n + 1), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.Get("counter"); got != "100" {
+		t.Fatalf("counter is %s, want 100", got)
+	}
+}
+
+func TestMemoryStorageHUpdate(t *testing.T) {
+	s := NewMemoryStorage()
+	s.HSet("h", map[string]string{"a": "1", "b": "1"})
+	err := s.HUpdate("h", func(current map[string]string) (map[string]string, error) {
+		if current["a"] != "1" {
+			t.Errorf("current is %v", current)
+		}
+		return map[string]string{"a": "2"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HUpdate("h", func(map[string]string) (map[string]string, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.HGetAll("h"); got["a"] != "2" || got["b"] != "1" {
+		t.Fatalf("hash is %v", got)
+	}
+}
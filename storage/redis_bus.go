@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBus publishes messages through Redis pub/sub. Subscriptions survive
+// reconnects; messages published while disconnected are lost.
+type RedisBus struct {
+	client *redis.Client
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+}
+
+func NewRedisBus(opts RedisOpts) *RedisBus {
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.Address,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	return &RedisBus{
+		client: client,
+	}
+}
+
+func (b *RedisBus) Publish(channel string, payload []byte) error {
+	return b.client.Publish(ctx, channel, payload).Err()
+}
+
+func (b *RedisBus) Subscribe(channel string, handler func([]byte)) {
+	sub := b.client.Subscribe(ctx, channel)
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range sub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+}
+
+func (b *RedisBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if err := sub.Close(); err != nil {
+			fmt.Println("Error in closing redis subscription", err)
+		}
+	}
+	b.subs = nil
+	if err := b.client.Close(); err != nil {
+		fmt.Println("Error in closing redis client", err)
+	}
+}
@@ -1,8 +1,52 @@
 package storage
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrConflict is returned by Update and HUpdate when the key changed while
+// they computed the new value. The caller retries, calling fn again with the
+// value that is current then.
+var ErrConflict = errors.New("storage: concurrent update")
+
 type Storage interface {
 	Get(string) string
 	Set(string, string)
 	Delete(string)
+	// Incr increments the integer at key, which starts at 0, and returns
+	// the result.
+	Incr(key string) (int64, error)
+	// Keys returns the keys matching a glob pattern such as "room:*".
+	Keys(string) []string
+	HSet(key string, fields map[string]string)
+	HGetAll(key string) map[string]string
+	SAdd(key, member string)
+	SRem(key, member string)
+	SMembers(key string) []string
+	SCard(key string) int
+	ZAdd(key, member string, score float64)
+	ZRem(key, member string)
+	// ZRangeByScore returns the members scored between min and max,
+	// inclusive, lowest first.
+	ZRangeByScore(key string, min, max float64) []string
+	// ZRevRangeByScore returns at most count members scored between max and
+	// min, inclusive, highest first, skipping the first offset of them.
+	ZRevRangeByScore(key string, max, min float64, offset, count int) []string
+	ZCard(key string) int
+	// Update sets key to the value fn computes from its current one, which is
+	// empty for a missing key. An empty value deletes the key. It fails with
+	// ErrConflict if key changed while fn ran. fn must not use the storage.
+	Update(key string, fn func(current string) (string, error)) error
+	// HUpdate sets the fields fn computes from the current ones of the hash
+	// at key, which are empty for a missing key, and fails like Update. fn
+	// returns no fields to leave the hash as it is.
+	HUpdate(key string, fn func(current map[string]string) (map[string]string, error)) error
+	// AcquireLease makes owner the holder of the lease at key for ttl unless
+	// another owner holds it. The holder renews a lease by acquiring it
+	// again.
+	AcquireLease(key, owner string, ttl time.Duration) bool
+	// ReleaseLease drops the lease at key if owner holds it.
+	ReleaseLease(key, owner string)
 	Close()
 }
\ No newline at end of file
@@ -0,0 +1,30 @@
+package types
+
+import "errors"
+
+var (
+	ErrMessageTooLong  = errors.New("message exceeds maximum length")
+	ErrBlockedWord     = errors.New("message contains a blocked word")
+	ErrLinkNotAllowed  = errors.New("message contains a link that is not allowed")
+	ErrInvalidChatRule = errors.New("invalid chat policy")
+)
+
+// ChatPolicy configures the chat filter pipeline. A server-wide policy is
+// always applied; rooms may add their own on top of it.
+type ChatPolicy struct {
+	MaxLength      int      `json:"max_length,omitempty"`
+	BlockedWords   []string `json:"blocked_words,omitempty"`
+	DisableLinks   bool     `json:"disable_links,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	DeniedDomains  []string `json:"denied_domains,omitempty"`
+}
+
+func (p *ChatPolicy) Validate() error {
+	if p.MaxLength < 0 {
+		return ErrInvalidChatRule
+	}
+	if len(p.BlockedWords)+len(p.AllowedDomains)+len(p.DeniedDomains) > MaxChatPolicyEntries {
+		return ErrInvalidChatRule
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package types
+
+import "errors"
+
+// ErrorCode is the stable, machine readable identifier sent with every socket
+// error. Clients should switch on the code rather than on the message text.
+type ErrorCode string
+
+const (
+	CodeRoomNotFound       ErrorCode = "ROOM_NOT_FOUND"
+	CodeRoomFull           ErrorCode = "ROOM_FULL"
+	CodeRoomInactive       ErrorCode = "ROOM_INACTIVE"
+	CodeRoomClosed         ErrorCode = "ROOM_CLOSED"
+	CodeAlreadyInRoom      ErrorCode = "ALREADY_IN_ROOM"
+	CodeNotInRoom          ErrorCode = "NOT_IN_ROOM"
+	CodeNotAuthorized      ErrorCode = "NOT_AUTHORIZED"
+	CodeRateLimited        ErrorCode = "RATE_LIMITED"
+	CodeInvalidMessage     ErrorCode = "INVALID_MESSAGE"
+	CodeInvalidPayload     ErrorCode = "INVALID_PAYLOAD"
+	CodeUnknownAction      ErrorCode = "UNKNOWN_ACTION"
+	CodeUnsupportedVersion ErrorCode = "UNSUPPORTED_VERSION"
+	CodeMessageRejected    ErrorCode = "MESSAGE_REJECTED"
+	CodeSessionExpired     ErrorCode = "SESSION_EXPIRED"
+	CodeInternal           ErrorCode = "INTERNAL_ERROR"
+)
+
+var errorCodes = []struct {
+	err  error
+	code ErrorCode
+}{
+	{ErrRoomNotFound, CodeRoomNotFound},
+	{ErrRoomFull, CodeRoomFull},
+	{ErrRoomInactive, CodeRoomInactive},
+	{ErrRoomClosed, CodeRoomClosed},
+	{ErrPeerExists, CodeAlreadyInRoom},
+	{ErrPeerNotFound, CodeNotInRoom},
+	{ErrNotAuthorized, CodeNotAuthorized},
+	{ErrSessionExpired, CodeSessionExpired},
+	{ErrInvalidPeer, CodeInvalidPayload},
+	{ErrInvalidTransition, CodeInvalidPayload},
+	{ErrInvalidChatRule, CodeInvalidPayload},
+	{ErrNotScheduled, CodeInvalidPayload},
+	{ErrMessageTooLong, CodeMessageRejected},
+	{ErrBlockedWord, CodeMessageRejected},
+	{ErrLinkNotAllowed, CodeMessageRejected},
+}
+
+// SocketError is an error that carries its own code. It wraps an optional
+// cause so errors.Is keeps working against the sentinels above.
+type SocketError struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func NewSocketError(code ErrorCode, message string) *SocketError {
+	return &SocketError{Code: code, Message: message}
+}
+
+func WrapSocketError(code ErrorCode, message string, err error) *SocketError {
+	return &SocketError{Code: code, Message: message, Err: err}
+}
+
+func (e *SocketError) Error() string {
+	return e.Message
+}
+
+func (e *SocketError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCodeFor maps an error returned by a socket handler to its code.
+// Unknown errors are reported as CodeInternal.
+func ErrorCodeFor(err error) ErrorCode {
+	var socketErr *SocketError
+	if errors.As(err, &socketErr) {
+		return socketErr.Code
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
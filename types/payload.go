@@ -0,0 +1,197 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	MaxEmailLength       = 254
+	MaxRoomIDLength      = 64
+	MaxVideoSourceLength = 2048
+	MaxChatMessageLength = 4096
+	MaxClientFieldLength = 64
+	MaxChatPolicyEntries = 200
+)
+
+func validateString(name, value string, max int) error {
+	if value == "" {
+		return fmt.Errorf("invalid %s", name)
+	}
+	if len(value) > max {
+		return fmt.Errorf("%s too long", name)
+	}
+	return nil
+}
+
+func (r *CreateRoomRequest) Validate() error {
+	if err := validateString("email", r.Email, MaxEmailLength); err != nil {
+		return err
+	}
+	if err := validateString("video_source", r.VideoSource, MaxVideoSourceLength); err != nil {
+		return err
+	}
+	if r.Timestamp.Start < 0 {
+		return errors.New("invalid start timestamp")
+	}
+	if r.Timestamp.End == 0 {
+		return errors.New("invalid end timestamp")
+	}
+	if r.Timestamp.Current < r.Timestamp.Start || r.Timestamp.Current > r.Timestamp.End {
+		return errors.New("invalid current timestamp")
+	}
+	if r.ChatPolicy != nil {
+		if err := r.ChatPolicy.Validate(); err != nil {
+			return errors.New("invalid chat policy")
+		}
+	}
+	if r.ScheduledFor != nil && !r.ScheduledFor.After(time.Now()) {
+		return errors.New("scheduled_for must be in the future")
+	}
+	return nil
+}
+
+func (r *UpdateRoomRequest) Validate() error {
+	if r.VideoSource != nil {
+		if err := validateString("video_source", *r.VideoSource, MaxVideoSourceLength); err != nil {
+			return err
+		}
+	}
+	if t := r.Timestamp; t != nil && (t.Start < 0 || t.End == 0 || t.Current < t.Start || t.Current > t.End) {
+		return errors.New("invalid timestamp")
+	}
+	if r.ChatPolicy != nil {
+		if err := r.ChatPolicy.Validate(); err != nil {
+			return errors.New("invalid chat policy")
+		}
+	}
+	if r.MaxCapacity != nil && *r.MaxCapacity < 1 {
+		return errors.New("invalid max_capacity")
+	}
+	if r.Status != nil && (*r.Status < RoomStateActive || *r.Status > RoomStateClosed) {
+		return errors.New("invalid status")
+	}
+	return nil
+}
+
+func (d *JoinRoomData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+func (d *LeaveRoomData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+func (d *PlayerStateData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+func (d *VideoSyncData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	if err := validateString("email", d.Email, MaxEmailLength); err != nil {
+		return err
+	}
+	if d.Timestamp < 0 {
+		return errors.New("invalid timestamp")
+	}
+	return nil
+}
+
+func (d *ChatMessageData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	if err := validateString("email", d.Email, MaxEmailLength); err != nil {
+		return err
+	}
+	if err := validateString("message", d.Message, MaxChatMessageLength); err != nil {
+		return err
+	}
+	if len(d.ID) > MaxClientFieldLength {
+		return errors.New("id too long")
+	}
+	if len(d.TimeStamp) > MaxClientFieldLength {
+		return errors.New("timestamp too long")
+	}
+	return nil
+}
+
+func (d *TypingData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+func (d *ChatReadData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	if err := validateString("email", d.Email, MaxEmailLength); err != nil {
+		return err
+	}
+	if d.Seq < 0 {
+		return errors.New("invalid seq")
+	}
+	return nil
+}
+
+func (d *RoomSyncData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+func (d *SubscribeRoomData) Validate() error {
+	return validateString("room_id", d.RoomID, MaxRoomIDLength)
+}
+
+func (d *ResumeData) Validate() error {
+	if err := validateString("room_id", d.RoomID, MaxRoomIDLength); err != nil {
+		return err
+	}
+	if err := validateString("email", d.Email, MaxEmailLength); err != nil {
+		return err
+	}
+	return validateString("resume_token", d.ResumeToken, MaxClientFieldLength)
+}
+
+func (d *HelloData) Validate() error {
+	if len(d.Versions) == 0 || len(d.Versions) > 16 {
+		return errors.New("invalid versions")
+	}
+	if len(d.Encoding) > MaxClientFieldLength {
+		return errors.New("encoding too long")
+	}
+	return nil
+}
+
+func (d *PingData) Validate() error {
+	return validateString("email", d.Email, MaxEmailLength)
+}
+
+// Actor reports the room and the peer a payload acts for. The socket server
+// bases its role checks on it.
+func (r *CreateRoomRequest) Actor() (string, string) { return "", r.Email }
+func (d *JoinRoomData) Actor() (string, string)      { return d.RoomID, d.Email }
+func (d *LeaveRoomData) Actor() (string, string)     { return d.RoomID, d.Email }
+func (d *PlayerStateData) Actor() (string, string)   { return d.RoomID, d.Email }
+func (d *VideoSyncData) Actor() (string, string)     { return d.RoomID, d.Email }
+func (d *ChatMessageData) Actor() (string, string)   { return d.RoomID, d.Email }
+func (d *TypingData) Actor() (string, string)        { return d.RoomID, d.Email }
+func (d *ChatReadData) Actor() (string, string)      { return d.RoomID, d.Email }
+func (d *RoomSyncData) Actor() (string, string)      { return d.RoomID, d.Email }
+func (d *PingData) Actor() (string, string)          { return "", d.Email }
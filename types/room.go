@@ -20,21 +20,49 @@ var (
 	ErrInvalidTransition = errors.New("invalid room state transition")
 	ErrInvalidPeer       = errors.New("invalid peer data")
 	ErrRoomNotFound      = errors.New("room not found")
+	ErrNotAuthorized     = errors.New("not authorized")
+	ErrSessionExpired    = errors.New("session expired")
+	ErrNotScheduled      = errors.New("room is not scheduled")
 )
 
 type CreateRoomRequest struct {
-	Email       string    `json:"email"`
-	VideoSource string    `json:"video_source"`
-	Timestamp   TimeStamp `json:"timestamp"`
+	Email       string      `json:"email"`
+	VideoSource string      `json:"video_source"`
+	Timestamp   TimeStamp   `json:"timestamp"`
+	ChatPolicy  *ChatPolicy `json:"chat_policy,omitempty"`
+	// Public lists the room in the room directory.
+	Public bool `json:"public,omitempty"`
+	// ScheduledFor makes the room a scheduled watch party starting then.
+	ScheduledFor *time.Time `json:"scheduled_for,omitempty"`
 }
 
 type DeleteRoomRequest struct {
 	Status RoomState `json:"status"`
 }
 
+// UpdateRoomRequest changes the attributes of a room. Nil fields are left
+// alone.
+type UpdateRoomRequest struct {
+	VideoSource *string     `json:"video_source,omitempty"`
+	Timestamp   *TimeStamp  `json:"timestamp,omitempty"`
+	ChatPolicy  *ChatPolicy `json:"chat_policy,omitempty"`
+	Public      *bool       `json:"public,omitempty"`
+	MaxCapacity *int32      `json:"max_capacity,omitempty"`
+	Status      *RoomState  `json:"status,omitempty"`
+}
+
 type Message struct {
-	Action string      `json:"action"`
-	Data   interface{} `json:"data"`
+	Action    string      `json:"action"`
+	RequestID string      `json:"request_id,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// IncomingMessage is the envelope of a client message. Data is decoded into
+// the payload type of the action once the action is known.
+type IncomingMessage struct {
+	Action    string          `json:"action"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
 }
 
 type JoinRoomData struct {
@@ -50,7 +78,7 @@ type LeaveRoomData struct {
 type PlayerStateData struct {
 	RoomID string `json:"room_id"`
 	Email  string `json:"email"`
-	State  bool   `json:"state"`
+	State  bool   `json:"paused"`
 }
 
 type VideoSyncData struct {
@@ -61,11 +89,44 @@ type VideoSyncData struct {
 }
 
 type ChatMessageData struct {
+	RoomID    string          `json:"room_id"`
+	ID        json.RawMessage `json:"id,omitempty"`
+	Email     string          `json:"email"`
+	Message   string          `json:"message"`
+	TimeStamp string          `json:"timestamp,omitempty"`
+	Mentions  []string        `json:"mentions,omitempty"`
+}
+
+type TypingData struct {
+	RoomID string `json:"room_id"`
+	Email  string `json:"email"`
+}
+
+type ChatReadData struct {
+	RoomID string `json:"room_id"`
+	Email  string `json:"email"`
+	Seq    int64  `json:"seq"`
+}
+
+type RoomSyncData struct {
 	RoomID string `json:"room_id"`
-	ID    string `json:"id"`
 	Email  string `json:"email"`
-	Message string `json:"message"`
-	TimeStamp time.Time `json:"timestamp"`
+}
+
+// SubscribeRoomData names a room a connection observes without joining it.
+type SubscribeRoomData struct {
+	RoomID string `json:"room_id"`
+}
+
+type ResumeData struct {
+	RoomID      string `json:"room_id"`
+	Email       string `json:"email"`
+	ResumeToken string `json:"resume_token"`
+}
+
+type HelloData struct {
+	Versions []int  `json:"versions"`
+	Encoding string `json:"encoding,omitempty"`
 }
 
 type PingData struct {
@@ -78,11 +139,24 @@ type TimeStamp struct {
 	Current float64 `json:"current"`
 }
 
+type PeerStatus string
+
+const (
+	PeerConnected PeerStatus = "connected"
+	// PeerReconnecting marks a peer whose socket dropped. It stays in the
+	// room until it resumes or its grace period runs out.
+	PeerReconnecting PeerStatus = "reconnecting"
+)
+
 type Peer struct {
-	Email      string    `json:"email"`
-	JoinedAt   time.Time `json:"joined_at"`
-	Connection string    `json:"connection"`
-	LastPing   time.Time `json:"last_ping"`
+	Email      string     `json:"email"`
+	JoinedAt   time.Time  `json:"joined_at"`
+	Connection string     `json:"connection"`
+	LastPing   time.Time  `json:"last_ping"`
+	Status     PeerStatus `json:"status"`
+	// Devices counts the connections the peer is in the room with, e.g.
+	// several browser tabs.
+	Devices int `json:"devices"`
 }
 
 func (p *Peer) Validate() error {
@@ -127,78 +201,99 @@ type Room struct {
 	CreatedBy   string    `json:"created_by"`
 	CreatedOn   time.Time `json:"created_on"`
 	MaxCapacity int32     `json:"max_capacity"`
-
-	peerJoined   chan *Peer
-	peerLeft     chan string
-	stateChanged chan RoomState
+	Public      bool      `json:"public"`
+	revision    int64     `json:"-"`
+	updatedOn   int64     `json:"-"`
+	activeOn    int64     `json:"-"`
+	// mu guards the attributes Update, Schedule and SetRSVP change. Read
+	// them with the getters once the room is shared.
+	mu sync.RWMutex
+
+	// ScheduledFor is when a scheduled room starts. The room waits inactive
+	// until then, and peers may join it early.
+	ScheduledFor *time.Time `json:"scheduled_for"`
+	// RSVPs holds when the users who said they attend a scheduled room did.
+	RSVPs map[string]time.Time `json:"rsvps"`
+	// ChatPolicy is kept from clients, who must not learn the blocked words.
+	// Storage keeps it in the chat_policy field.
+	ChatPolicy *ChatPolicy `json:"-"`
+	// stateReason is why the room entered its state. Storage keeps it in the
+	// state_reason field.
+	stateReason string
+
+	events roomEvents
 }
 
 func NewRoom(id uuid.UUID, createdBy string, videoSource string, timestamp TimeStamp) *Room {
 	room := &Room{
-		ID:           id,
-		Peers:        &sync.Map{},
-		VideoSource:  videoSource,
-		Timestamp:    timestamp,
-		CreatedBy:    createdBy,
-		CreatedOn:    time.Now(),
-		MaxCapacity:  10,
-		peerJoined:   make(chan *Peer, 1),
-		peerLeft:     make(chan string, 1),
-		stateChanged: make(chan RoomState, 1),
+		ID:          id,
+		Peers:       &sync.Map{},
+		VideoSource: videoSource,
+		Timestamp:   timestamp,
+		CreatedBy:   createdBy,
+		CreatedOn:   time.Now(),
+		MaxCapacity: 10,
 	}
 	atomic.StoreInt32(&room.state, int32(RoomStateActive))
+	atomic.StoreInt64(&room.updatedOn, room.CreatedOn.UnixNano())
+	atomic.StoreInt64(&room.activeOn, room.CreatedOn.UnixNano())
 	return room
 }
 
-func (r *Room) AddPeer(peer *Peer) error {
+// AddPeer adds a peer and returns the room revision the change produced.
+func (r *Room) AddPeer(peer *Peer) (int64, error) {
 	if peer == nil {
-		return ErrInvalidPeer
+		return 0, ErrInvalidPeer
 	}
 
 	if err := peer.Validate(); err != nil {
-		return err
+		return 0, err
 	}
 
-	if RoomState(atomic.LoadInt32(&r.state)) != RoomStateActive {
-		return ErrRoomInactive
+	if RoomState(atomic.LoadInt32(&r.state)) != RoomStateActive && !r.waiting() {
+		return 0, ErrRoomInactive
 	}
 
-	currentCount := atomic.LoadInt32(&r.peerCount)
-	if currentCount >= r.MaxCapacity {
-		return ErrRoomFull
+	// The seat is taken before the peer is stored, so concurrent joins never
+	// exceed the capacity together.
+	capacity := r.GetMaxCapacity()
+	for {
+		count := atomic.LoadInt32(&r.peerCount)
+		if count >= capacity {
+			return 0, ErrRoomFull
+		}
+		if atomic.CompareAndSwapInt32(&r.peerCount, count, count+1) {
+			break
+		}
 	}
 
 	if _, loaded := r.Peers.LoadOrStore(peer.Email, peer); loaded {
-		return ErrPeerExists
+		atomic.AddInt32(&r.peerCount, -1)
+		return 0, ErrPeerExists
 	}
 
-	atomic.AddInt32(&r.peerCount, 1)
-
-	select {
-	case r.peerJoined <- peer:
-	default:
-	}
+	revision := r.commit(RoomEvent{Kind: RoomPeerJoined, Email: peer.Email, Peer: peer})
+	r.Touch()
 
-	return nil
+	return revision, nil
 }
 
-func (r *Room) RemovePeer(email string) error {
+// RemovePeer removes a peer and returns the room revision the change
+// produced.
+func (r *Room) RemovePeer(email string) (int64, error) {
 	if email == "" {
-		return errors.New("email is required")
+		return 0, errors.New("email is required")
 	}
 
 	if _, exists := r.Peers.LoadAndDelete(email); !exists {
-		return ErrPeerNotFound
+		return 0, ErrPeerNotFound
 	}
 
 	atomic.AddInt32(&r.peerCount, -1)
+	revision := r.commit(RoomEvent{Kind: RoomPeerLeft, Email: email})
+	r.Touch()
 
-	select {
-	case r.peerLeft <- email:
-	default:
-	}
-
-	return nil
+	return revision, nil
 }
 
 func (r *Room) UpdatePeerLastPing(email string) (*Peer, error) {
@@ -220,6 +315,24 @@ func (r *Room) UpdatePeerLastPing(email string) (*Peer, error) {
 	return peer, nil
 }
 
+// UpdatePeer replaces the peer with a copy modified by update, so snapshots
+// being marshalled concurrently never see a half updated peer. It returns the
+// updated peer and the room revision the change produced.
+func (r *Room) UpdatePeer(email string, update func(peer *Peer)) (*Peer, int64, error) {
+	for {
+		value, ok := r.Peers.Load(email)
+		if !ok {
+			return nil, 0, ErrPeerNotFound
+		}
+		updated := *value.(*Peer)
+		update(&updated)
+		if r.Peers.CompareAndSwap(email, value, &updated) {
+			revision := r.commit(RoomEvent{Kind: RoomPeerUpdated, Email: email, Peer: &updated, Previous: value.(*Peer)})
+			return &updated, revision, nil
+		}
+	}
+}
+
 func (r *Room) GetPeers() map[string]*Peer {
 	peers := make(map[string]*Peer)
 	r.Peers.Range(func(key, value interface{}) bool {
@@ -243,21 +356,210 @@ func (r *Room) GetPeer(email string) (*Peer, error) {
 	return value.(*Peer), nil
 }
 
-func (r *Room) SetState(newState RoomState) error {
+// GetTimestamp returns the playback position of the room.
+func (r *Room) GetTimestamp() TimeStamp {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Timestamp
+}
+
+// GetMaxCapacity returns how many peers the room takes.
+func (r *Room) GetMaxCapacity() int32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.MaxCapacity
+}
+
+// GetStateReason returns why the room entered its state, empty if it has
+// been in it since it was created.
+func (r *Room) GetStateReason() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stateReason
+}
+
+// IsPublic tells whether the room is listed in the room directory.
+func (r *Room) IsPublic() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Public
+}
+
+// GetChatPolicy returns the chat policy of the room, nil if it has none. The
+// policy is replaced rather than modified, so it may be read without locking.
+func (r *Room) GetChatPolicy() *ChatPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ChatPolicy
+}
+
+// Revision returns the revision of the room state. Every change to the peers
+// or the room attributes increments it, which lets clients apply deltas in
+// order and notice the ones they missed.
+func (r *Room) Revision() int64 {
+	return atomic.LoadInt64(&r.revision)
+}
+
+// bumpRevision moves the room to its next revision, or to the one of the
+// change Mirror applies. The caller holds r.events.mu.
+func (r *Room) bumpRevision() int64 {
+	atomic.StoreInt64(&r.updatedOn, time.Now().UnixNano())
+	if revision := r.events.mirrored; revision > 0 {
+		atomic.StoreInt64(&r.revision, revision)
+		return revision
+	}
+	return atomic.AddInt64(&r.revision, 1)
+}
+
+// UpdatedOn returns when the room last changed.
+func (r *Room) UpdatedOn() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.updatedOn))
+}
+
+// Touch records activity in the room: peers joining or leaving, playback,
+// chat and the like. Changes of the room state are no activity.
+func (r *Room) Touch() {
+	atomic.StoreInt64(&r.activeOn, time.Now().UnixNano())
+}
+
+// LastActive returns when the room last saw activity.
+func (r *Room) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.activeOn))
+}
+
+// SetState changes the room state and returns the room revision the change
+// produced. reason goes with the RoomStateChanged event.
+func (r *Room) SetState(newState RoomState, reason string) (int64, error) {
 	currentState := RoomState(atomic.LoadInt32(&r.state))
 
 	if !r.isValidStateTransition(currentState, newState) {
-		return ErrInvalidTransition
+		return 0, ErrInvalidTransition
 	}
 
+	r.mu.Lock()
+	r.stateReason = reason
+	r.mu.Unlock()
 	atomic.StoreInt32(&r.state, int32(newState))
+	revision := r.commit(
+		RoomEvent{Kind: RoomStateChanged, State: newState, PreviousState: currentState, Reason: reason},
+		RoomEvent{Kind: RoomUpdated, Patch: map[string]interface{}{"status": newState}},
+	)
 
-	select {
-	case r.stateChanged <- newState:
-	default:
+	return revision, nil
+}
+
+// Update applies the changes of u at once and returns them keyed by the JSON
+// names of the fields, along with the revision they produced. Nothing changes
+// if the status change is not a valid transition. reason goes with the
+// RoomStateChanged event of a status change.
+func (r *Room) Update(u UpdateRoomRequest, reason string) (map[string]interface{}, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.GetState()
+	if current == RoomStateClosed {
+		return nil, 0, ErrRoomClosed
+	}
+	if u.Status != nil && *u.Status != current && !r.isValidStateTransition(current, *u.Status) {
+		return nil, 0, ErrInvalidTransition
 	}
 
-	return nil
+	patch := make(map[string]interface{})
+	if u.VideoSource != nil && *u.VideoSource != r.VideoSource {
+		r.VideoSource = *u.VideoSource
+		patch["video_source"] = r.VideoSource
+	}
+	if u.Timestamp != nil && *u.Timestamp != r.Timestamp {
+		r.Timestamp = *u.Timestamp
+		patch["timestamp"] = r.Timestamp
+	}
+	if u.ChatPolicy != nil {
+		r.ChatPolicy = u.ChatPolicy
+		patch["chat_policy"] = r.ChatPolicy
+	}
+	if u.Public != nil && *u.Public != r.Public {
+		r.Public = *u.Public
+		patch["public"] = r.Public
+	}
+	if u.MaxCapacity != nil && *u.MaxCapacity != r.MaxCapacity {
+		r.MaxCapacity = *u.MaxCapacity
+		patch["max_capacity"] = r.MaxCapacity
+	}
+	if u.Status != nil && *u.Status != current {
+		atomic.StoreInt32(&r.state, int32(*u.Status))
+		r.stateReason = reason
+		patch["status"] = *u.Status
+		if *u.Status == RoomStateActive && r.ScheduledFor != nil {
+			// Starting a scheduled room, on time or early, ends its schedule.
+			r.ScheduledFor = nil
+			patch["scheduled_for"] = nil
+		}
+	}
+	if len(patch) == 0 {
+		return patch, r.Revision(), nil
+	}
+	events := []RoomEvent{{Kind: RoomUpdated, Patch: patch}}
+	if u.Status != nil && *u.Status != current {
+		events = append([]RoomEvent{{Kind: RoomStateChanged, State: *u.Status, PreviousState: current, Reason: reason}}, events...)
+	}
+	return patch, r.commit(events...), nil
+}
+
+// Schedule makes the room wait inactive for its start. Called before the room
+// is shared.
+func (r *Room) Schedule(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ScheduledFor = &at
+	r.RSVPs = make(map[string]time.Time)
+	atomic.StoreInt32(&r.state, int32(RoomStateInactive))
+}
+
+// ScheduledStart returns when the room starts if it still waits for that.
+func (r *Room) ScheduledStart() (time.Time, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.ScheduledFor == nil || r.GetState() != RoomStateInactive {
+		return time.Time{}, false
+	}
+	return *r.ScheduledFor, true
+}
+
+func (r *Room) waiting() bool {
+	_, ok := r.ScheduledStart()
+	return ok
+}
+
+// SetRSVP records whether a user attends a scheduled room. It returns the
+// changed RSVPs keyed like Update does, empty if nothing changed.
+func (r *Room) SetRSVP(email string, going bool) (map[string]interface{}, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.GetState() == RoomStateClosed {
+		return nil, 0, ErrRoomClosed
+	}
+	if r.ScheduledFor == nil {
+		return nil, 0, ErrNotScheduled
+	}
+	if r.RSVPs == nil {
+		r.RSVPs = make(map[string]time.Time)
+	}
+
+	patch := make(map[string]interface{})
+	if _, ok := r.RSVPs[email]; ok == going {
+		return patch, r.Revision(), nil
+	}
+	if going {
+		r.RSVPs[email] = time.Now()
+	} else {
+		delete(r.RSVPs, email)
+	}
+	rsvps := make(map[string]time.Time, len(r.RSVPs))
+	for k, v := range r.RSVPs {
+		rsvps[k] = v
+	}
+	patch["rsvps"] = rsvps
+	return patch, r.commit(RoomEvent{Kind: RoomUpdated, Patch: patch}), nil
 }
 
 func (r *Room) isValidStateTransition(current, new RoomState) bool {
@@ -277,18 +579,18 @@ func (r *Room) GetState() RoomState {
 	return RoomState(atomic.LoadInt32(&r.state))
 }
 
+func (r *Room) PeerCount() int {
+	return int(atomic.LoadInt32(&r.peerCount))
+}
+
 func (r *Room) IsEmpty() bool {
 	return atomic.LoadInt32(&r.peerCount) == 0
 }
 
+// Close marks the room closed, ends its subscriptions and drops its peers.
 func (r *Room) Close() {
-	if RoomState(atomic.LoadInt32(&r.state)) != RoomStateClosed {
-		atomic.StoreInt32(&r.state, int32(RoomStateClosed))
-
-		close(r.peerJoined)
-		close(r.peerLeft)
-		close(r.stateChanged)
-
+	atomic.StoreInt32(&r.state, int32(RoomStateClosed))
+	if r.closeEvents() {
 		r.Peers.Range(func(key, _ interface{}) bool {
 			r.Peers.Delete(key)
 			return true
@@ -297,15 +599,70 @@ func (r *Room) Close() {
 	}
 }
 
+// MarshalJSON reads the revision before the rest of the state, so a snapshot
+// is never older than the revision it claims. Deltas are idempotent, which
+// makes applying the ones after it safe even if the snapshot already
+// contains some of their changes.
 func (r *Room) MarshalJSON() ([]byte, error) {
 	type Alias Room
+	revision := r.Revision()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return json.Marshal(&struct {
 		*Alias
-		State RoomState        `json:"status"`
-		Peers map[string]*Peer `json:"peers"`
+		Revision   int64            `json:"revision"`
+		State      RoomState        `json:"status"`
+		Peers      map[string]*Peer `json:"peers"`
+		UpdatedOn  time.Time        `json:"updated_on"`
+		LastActive time.Time        `json:"last_active"`
 	}{
-		Alias: (*Alias)(r),
-		State: r.GetState(),
-		Peers: r.GetPeers(),
+		Alias:      (*Alias)(r),
+		Revision:   revision,
+		State:      r.GetState(),
+		Peers:      r.GetPeers(),
+		UpdatedOn:  r.UpdatedOn(),
+		LastActive: r.LastActive(),
 	})
 }
+
+// UnmarshalJSON restores a room marshalled by MarshalJSON, e.g. one loaded
+// from storage, rebuilding the peer map of the room.
+func (r *Room) UnmarshalJSON(data []byte) error {
+	type Alias Room
+	aux := &struct {
+		*Alias
+		Revision    int64            `json:"revision"`
+		State       RoomState        `json:"status"`
+		Peers       map[string]*Peer `json:"peers"`
+		UpdatedOn   time.Time        `json:"updated_on"`
+		LastActive  time.Time        `json:"last_active"`
+		ChatPolicy  *ChatPolicy      `json:"chat_policy"`
+		StateReason string           `json:"state_reason"`
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	r.ChatPolicy = aux.ChatPolicy
+	r.stateReason = aux.StateReason
+	r.Peers = &sync.Map{}
+	for email, peer := range aux.Peers {
+		r.Peers.Store(email, peer)
+	}
+	r.peerCount = int32(len(aux.Peers))
+	r.state = int32(aux.State)
+	r.revision = aux.Revision
+	r.updatedOn = aux.UpdatedOn.UnixNano()
+	if aux.UpdatedOn.IsZero() {
+		r.updatedOn = r.CreatedOn.UnixNano()
+	}
+	// Rooms stored before activity was tracked were last active when they
+	// last changed.
+	r.activeOn = aux.LastActive.UnixNano()
+	if aux.LastActive.IsZero() {
+		r.activeOn = r.updatedOn
+	}
+	return nil
+}
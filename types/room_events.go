@@ -0,0 +1,305 @@
+package types
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RoomEventKind tells what a RoomEvent changed.
+type RoomEventKind int
+
+const (
+	RoomPeerJoined RoomEventKind = iota
+	RoomPeerUpdated
+	RoomPeerLeft
+	// RoomStateChanged comes right before the RoomUpdated of a status
+	// change, with the same revision.
+	RoomStateChanged
+	RoomUpdated
+)
+
+func (k RoomEventKind) String() string {
+	switch k {
+	case RoomPeerJoined:
+		return "peer_joined"
+	case RoomPeerUpdated:
+		return "peer_updated"
+	case RoomPeerLeft:
+		return "peer_left"
+	case RoomStateChanged:
+		return "state_changed"
+	case RoomUpdated:
+		return "room_updated"
+	default:
+		return "unknown"
+	}
+}
+
+// RoomEvent is a change of a room and the revision it produced.
+type RoomEvent struct {
+	Kind     RoomEventKind
+	Revision int64
+	// Email is set for the peer events, Peer for all but RoomPeerLeft.
+	// Previous is the peer before a RoomPeerUpdated.
+	Email    string
+	Peer     *Peer
+	Previous *Peer
+	// State, PreviousState and Reason are set for RoomStateChanged.
+	State         RoomState
+	PreviousState RoomState
+	Reason        string
+	// Patch holds the attributes RoomUpdated changed, keyed by the JSON
+	// names of the fields.
+	Patch map[string]interface{}
+}
+
+// roomEventBacklog is how many events a subscriber may fall behind before it
+// is dropped. Until then the events wait in a queue of the subscriber, so a
+// slow subscriber never holds up the room.
+const roomEventBacklog = 1 << 16
+
+type roomEvents struct {
+	mu     sync.Mutex
+	subs   []*roomSubscriber
+	closed bool
+	// mirror serialises Mirror; mirrored is the revision the change Mirror
+	// applies takes.
+	mirror   sync.Mutex
+	mirrored int64
+}
+
+// roomSubscriber queues the events of one subscriber and forwards them to its
+// channel.
+type roomSubscriber struct {
+	ch   chan RoomEvent
+	wake chan struct{}
+	stop chan struct{}
+
+	mu    sync.Mutex
+	queue []RoomEvent
+	// ended is set once no more events come. The queue is still forwarded.
+	ended bool
+}
+
+func newRoomSubscriber() *roomSubscriber {
+	sub := &roomSubscriber{
+		ch:   make(chan RoomEvent),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	go sub.forward()
+	return sub
+}
+
+// push queues the events of a change unless the subscriber fell too far
+// behind.
+func (sub *roomSubscriber) push(revision int64, events []RoomEvent) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if len(sub.queue)+len(events) > roomEventBacklog {
+		return false
+	}
+	for _, ev := range events {
+		ev.Revision = revision
+		sub.queue = append(sub.queue, ev)
+	}
+	sub.signal()
+	return true
+}
+
+// end lets the subscriber read the events queued and closes its channel
+// after them.
+func (sub *roomSubscriber) end() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.ended = true
+	sub.signal()
+}
+
+func (sub *roomSubscriber) signal() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward hands the queued events to the channel one by one, taking each
+// off the queue only when it is sent, so the queue counts every event the
+// subscriber did not read yet.
+func (sub *roomSubscriber) forward() {
+	defer close(sub.ch)
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			ended := sub.ended
+			sub.mu.Unlock()
+			if ended {
+				return
+			}
+			select {
+			case <-sub.wake:
+			case <-sub.stop:
+				return
+			}
+			continue
+		}
+		ev := sub.queue[0]
+		sub.mu.Unlock()
+
+		select {
+		case sub.ch <- ev:
+		case <-sub.stop:
+			return
+		}
+		sub.mu.Lock()
+		sub.queue[0] = RoomEvent{}
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+	}
+}
+
+// Subscribe returns a channel that receives the changes of the room from now
+// on, in revision order. A subscriber gets every event, however slowly it
+// reads them, unless it falls roomEventBacklog events behind: then its
+// channel is closed after the events it was still given. The channel is also
+// closed when the subscriber is unsubscribed or the room closes.
+func (r *Room) Subscribe() <-chan RoomEvent {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	sub := newRoomSubscriber()
+	if r.events.closed {
+		sub.end()
+		return sub.ch
+	}
+	r.events.subs = append(r.events.subs, sub)
+	return sub.ch
+}
+
+// Unsubscribe stops the events of a channel returned by Subscribe, drops the
+// ones not read yet and closes it.
+func (r *Room) Unsubscribe(events <-chan RoomEvent) {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	for i, sub := range r.events.subs {
+		if (<-chan RoomEvent)(sub.ch) == events {
+			r.events.subs = append(r.events.subs[:i], r.events.subs[i+1:]...)
+			close(sub.stop)
+			return
+		}
+	}
+}
+
+// Mirror applies a change made to another copy of the room, the one of its
+// owner, and gives it the revision it got there, so every copy numbers the
+// changes alike. apply makes the change and commits at most once. Mirror
+// reports false without calling apply when this copy has the revision
+// already.
+func (r *Room) Mirror(revision int64, apply func()) bool {
+	r.events.mirror.Lock()
+	defer r.events.mirror.Unlock()
+	if revision <= r.Revision() {
+		return false
+	}
+	r.events.mu.Lock()
+	r.events.mirrored = revision
+	r.events.mu.Unlock()
+
+	apply()
+
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	r.events.mirrored = 0
+	// A change this copy had already still moves it to the revision.
+	if r.Revision() < revision {
+		atomic.StoreInt64(&r.revision, revision)
+	}
+	return true
+}
+
+// Reload replaces the state of the room with the one of another copy, the
+// one of its owner, taken at a revision at least as new. It repairs a copy
+// that missed changes Mirror cannot replay. Unlike Mirror it queues no
+// events: subscribers learn from the revision that they missed changes.
+func (r *Room) Reload(from *Room) bool {
+	r.events.mirror.Lock()
+	defer r.events.mirror.Unlock()
+	revision := from.Revision()
+	if revision < r.Revision() {
+		return false
+	}
+
+	from.mu.RLock()
+	r.mu.Lock()
+	r.URL = from.URL
+	r.VideoSource = from.VideoSource
+	r.Timestamp = from.Timestamp
+	r.MaxCapacity = from.MaxCapacity
+	r.Public = from.Public
+	r.ScheduledFor = from.ScheduledFor
+	r.RSVPs = from.RSVPs
+	r.ChatPolicy = from.ChatPolicy
+	r.stateReason = from.stateReason
+	atomic.StoreInt32(&r.state, atomic.LoadInt32(&from.state))
+	r.mu.Unlock()
+	from.mu.RUnlock()
+
+	peers := from.GetPeers()
+	r.Peers.Range(func(key, _ interface{}) bool {
+		if _, ok := peers[key.(string)]; !ok {
+			r.Peers.Delete(key)
+		}
+		return true
+	})
+	for email, peer := range peers {
+		r.Peers.Store(email, peer)
+	}
+	atomic.StoreInt32(&r.peerCount, int32(len(peers)))
+
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	atomic.StoreInt64(&r.revision, revision)
+	atomic.StoreInt64(&r.updatedOn, atomic.LoadInt64(&from.updatedOn))
+	if activeOn := atomic.LoadInt64(&from.activeOn); activeOn > atomic.LoadInt64(&r.activeOn) {
+		atomic.StoreInt64(&r.activeOn, activeOn)
+	}
+	return true
+}
+
+// commit bumps the revision of the room and queues the events of the change
+// with it. Events are queued under the lock the revision is bumped under, so
+// subscribers see them in revision order.
+func (r *Room) commit(events ...RoomEvent) int64 {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	revision := r.bumpRevision()
+	subs := r.events.subs[:0]
+	for _, sub := range r.events.subs {
+		if sub.push(revision, events) {
+			subs = append(subs, sub)
+		} else {
+			sub.end()
+		}
+	}
+	for i := len(subs); i < len(r.events.subs); i++ {
+		r.events.subs[i] = nil
+	}
+	r.events.subs = subs
+	return revision
+}
+
+// closeEvents ends the subscriptions, whose channels close once their
+// subscribers read the events queued. It reports whether the events were
+// still open.
+func (r *Room) closeEvents() bool {
+	r.events.mu.Lock()
+	defer r.events.mu.Unlock()
+	if r.events.closed {
+		return false
+	}
+	r.events.closed = true
+	for _, sub := range r.events.subs {
+		sub.end()
+	}
+	r.events.subs = nil
+	return true
+}
@@ -0,0 +1,111 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSlowSubscriberGetsEveryEvent(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	events := room.Subscribe()
+	for i := 0; i < roomEventBacklog; i++ {
+		room.commit(RoomEvent{Kind: RoomUpdated})
+	}
+	for want := int64(1); want <= roomEventBacklog; want++ {
+		if ev := <-events; ev.Revision != want {
+			t.Fatalf("got revision %d, want %d", ev.Revision, want)
+		}
+	}
+}
+
+func TestSubscriberFallingTooFarBehindIsDropped(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	events := room.Subscribe()
+	kept := room.Subscribe()
+	go func() {
+		for range kept {
+		}
+	}()
+	for i := 0; i < roomEventBacklog+10; i++ {
+		room.commit(RoomEvent{Kind: RoomUpdated})
+	}
+	count := 0
+	for range events {
+		count++
+	}
+	if count != roomEventBacklog {
+		t.Fatalf("read %d events before the channel closed, want %d", count, roomEventBacklog)
+	}
+	room.Close()
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	events := room.Subscribe()
+	room.commit(RoomEvent{Kind: RoomUpdated})
+	room.Unsubscribe(events)
+	for range events {
+	}
+	if closed := room.Subscribe(); closed == nil {
+		t.Fatal("no channel")
+	}
+	room.Close()
+	if _, ok := <-room.Subscribe(); ok {
+		t.Fatal("subscription of a closed room delivered an event")
+	}
+}
+
+func TestMirrorTakesRevisionOfOwner(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	events := room.Subscribe()
+	if !room.Mirror(3, func() { room.AddPeer(testPeer("b@example.com")) }) {
+		t.Fatal("change at revision 3 was skipped")
+	}
+	if ev := <-events; ev.Revision != 3 || ev.Kind != RoomPeerJoined {
+		t.Fatalf("got %s at revision %d, want peer_joined at 3", ev.Kind, ev.Revision)
+	}
+	if room.Mirror(3, func() { t.Fatal("applied a change the room has") }) {
+		t.Fatal("change at revision 3 was applied twice")
+	}
+	// A change the room had already still moves it to the revision.
+	room.Mirror(5, func() { room.AddPeer(testPeer("b@example.com")) })
+	if room.Revision() != 5 {
+		t.Fatalf("room is at revision %d, want 5", room.Revision())
+	}
+	if _, err := room.RemovePeer("b@example.com"); err != nil || room.Revision() != 6 {
+		t.Fatalf("local change got revision %d (%v), want 6", room.Revision(), err)
+	}
+}
+
+func TestReloadTakesNewerCopy(t *testing.T) {
+	owner := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	owner.AddPeer(testPeer("a@example.com"))
+	copy := NewRoom(owner.ID, "a@example.com", "video", TimeStamp{End: 60})
+	copy.Mirror(1, func() { copy.AddPeer(testPeer("a@example.com")) })
+	// The copy misses the next changes of the owner.
+	owner.AddPeer(testPeer("b@example.com"))
+	owner.RemovePeer("a@example.com")
+	source := "other"
+	owner.Update(UpdateRoomRequest{VideoSource: &source}, "")
+
+	events := copy.Subscribe()
+	if !copy.Reload(owner) {
+		t.Fatal("copy did not take the newer room")
+	}
+	if copy.Revision() != owner.Revision() || copy.VideoSource != "other" || copy.PeerCount() != 1 {
+		t.Fatalf("copy is at revision %d with %s and %d peers", copy.Revision(), copy.VideoSource, copy.PeerCount())
+	}
+	if _, err := copy.GetPeer("b@example.com"); err != nil {
+		t.Fatalf("copy misses the peer of the owner: %v", err)
+	}
+	if _, err := copy.RemovePeer("b@example.com"); err != nil || copy.Revision() != owner.Revision()+1 {
+		t.Fatalf("change after the reload got revision %d (%v), want %d", copy.Revision(), err, owner.Revision()+1)
+	}
+	if ev := <-events; ev.Kind != RoomPeerLeft {
+		t.Fatalf("reload queued %s", ev.Kind)
+	}
+	if copy.Reload(owner) {
+		t.Fatal("copy took an older room")
+	}
+}
@@ -0,0 +1,91 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testPeer(email string) *Peer {
+	return &Peer{Email: email, Connection: "127.0.0.1:1", JoinedAt: time.Now(), Status: PeerConnected, Devices: 1}
+}
+
+// TestRoomUpdateWhileReading is meant for the race detector: updates of the
+// attributes run concurrently with the readers of the room.
+func TestRoomUpdateWhileReading(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			capacity := int32(20 + i%5)
+			room.Update(UpdateRoomRequest{
+				ChatPolicy:  &ChatPolicy{MaxLength: i + 1},
+				MaxCapacity: &capacity,
+				Timestamp:   &TimeStamp{End: 60, Current: float64(i % 60)},
+			}, "")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			email := fmt.Sprintf("p%d@example.com", i%10)
+			if _, err := room.AddPeer(testPeer(email)); err == nil {
+				room.RemovePeer(email)
+			}
+			room.GetChatPolicy()
+			room.GetTimestamp()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestAddPeerRespectsCapacityConcurrently(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	capacity := int32(5)
+	room.Update(UpdateRoomRequest{MaxCapacity: &capacity}, "")
+
+	var added, full atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := room.AddPeer(testPeer(fmt.Sprintf("p%d@example.com", i)))
+			switch {
+			case err == nil:
+				added.Add(1)
+			case errors.Is(err, ErrRoomFull):
+				full.Add(1)
+			default:
+				t.Errorf("AddPeer: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if added.Load() != capacity || room.PeerCount() != int(capacity) {
+		t.Fatalf("added %d peers, room holds %d, want %d", added.Load(), room.PeerCount(), capacity)
+	}
+	if full.Load() != 50-capacity {
+		t.Fatalf("%d joins were refused, want %d", full.Load(), 50-capacity)
+	}
+}
+
+func TestAddPeerExistingKeepsSeat(t *testing.T) {
+	room := NewRoom(uuid.New(), "a@example.com", "video", TimeStamp{End: 60})
+	if _, err := room.AddPeer(testPeer("a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.AddPeer(testPeer("a@example.com")); !errors.Is(err, ErrPeerExists) {
+		t.Fatalf("got %v, want ErrPeerExists", err)
+	}
+	if room.PeerCount() != 1 {
+		t.Fatalf("room holds %d peers, want 1", room.PeerCount())
+	}
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DecodeStrict decodes a single JSON value into target, rejecting unknown
+// fields, trailing data and payloads that omit any of the required keys.
+func DecodeStrict(data []byte, target interface{}, required ...string) error {
+	if len(required) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return errors.New("invalid data format")
+		}
+		for _, key := range required {
+			if raw, ok := fields[key]; !ok || string(raw) == "null" {
+				return fmt.Errorf("missing %s", key)
+			}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(target); err != nil {
+		return describeDecodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after payload")
+	}
+	return nil
+}
+
+func describeDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("invalid %s", typeErr.Field)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("invalid data format")
+	}
+	// DisallowUnknownFields reports `json: unknown field "x"`.
+	return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+}
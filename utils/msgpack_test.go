@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := []string{
+		`null`,
+		`true`,
+		`false`,
+		`0`,
+		`127`,
+		`128`,
+		`255`,
+		`256`,
+		`65535`,
+		`65536`,
+		`4294967295`,
+		`4294967296`,
+		`9223372036854775807`,
+		`-1`,
+		`-32`,
+		`-33`,
+		`-128`,
+		`-129`,
+		`-32768`,
+		`-32769`,
+		`-2147483648`,
+		`-2147483649`,
+		`-9223372036854775808`,
+		`1.5`,
+		`-0.25`,
+		`1e+300`,
+		`""`,
+		`"héllo"`,
+		`[]`,
+		`[1,"a",[null,{"b":false}]]`,
+		`{}`,
+		`{"action":"chat_message","data":{"email":"a@example.com","seq":3}}`,
+	}
+	for _, doc := range tests {
+		packed, err := JSONToMsgpack([]byte(doc))
+		if err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		unpacked, err := MsgpackToJSON(packed)
+		if err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		if string(unpacked) != doc {
+			t.Errorf("round trip of %s gave %s", doc, unpacked)
+		}
+	}
+}
+
+// TestMsgpackEncoding checks the smallest encoding is picked at the limits of
+// every integer, string, array and map form.
+func TestMsgpackEncoding(t *testing.T) {
+	tests := []struct {
+		doc    string
+		prefix string
+	}{
+		{`127`, "7f"},
+		{`128`, "cc80"},
+		{`256`, "cd0100"},
+		{`65536`, "ce00010000"},
+		{`4294967296`, "cf0000000100000000"},
+		{`-32`, "e0"},
+		{`-33`, "d0df"},
+		{`-129`, "d1ff7f"},
+		{`-32769`, "d2ffff7fff"},
+		{`-2147483649`, "d3ffffffff7fffffff"},
+		{`1.5`, "cb3ff8000000000000"},
+		{jsonString(31), "bf"},
+		{jsonString(32), "d920"},
+		{jsonString(255), "d9ff"},
+		{jsonString(256), "da0100"},
+		{jsonString(65536), "db00010000"},
+		{jsonArray(15), "9f"},
+		{jsonArray(16), "dc0010"},
+		{jsonArray(65536), "dd00010000"},
+		{jsonObject(15), "8f"},
+		{jsonObject(16), "de0010"},
+		{jsonObject(65536), "df00010000"},
+	}
+	for _, tt := range tests {
+		packed, err := JSONToMsgpack([]byte(tt.doc))
+		if err != nil {
+			t.Fatalf("%.20s: %v", tt.doc, err)
+		}
+		if got := hex.EncodeToString(packed); !strings.HasPrefix(got, tt.prefix) {
+			t.Errorf("%.20s: encoded as %.20s, want prefix %s", tt.doc, got, tt.prefix)
+		}
+		unpacked, err := MsgpackToJSON(packed)
+		if err != nil {
+			t.Fatalf("%.20s: %v", tt.doc, err)
+		}
+		if !jsonEqual(t, unpacked, []byte(tt.doc)) {
+			t.Errorf("%.20s: round trip gave %.20s", tt.doc, unpacked)
+		}
+	}
+}
+
+func TestMsgpackToJSONNumbers(t *testing.T) {
+	tests := []struct {
+		packed string
+		want   string
+	}{
+		// Integers stay integers, floats keep their fraction.
+		{"cd0100", `256`},
+		{"d0df", `-33`},
+		{"ca3fc00000", `1.5`},
+		{"cb3ff8000000000000", `1.5`},
+		{"cb3ff0000000000000", `1`},
+		// Beyond int64 a uint64 can only be represented as a float.
+		{"cfffffffffffffffff", `18446744073709552000`},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.packed)
+		got, err := MsgpackToJSON(data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.packed, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.packed, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackToJSONRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		packed string
+	}{
+		{"empty", ""},
+		{"truncated uint16", "cd01"},
+		{"truncated float64", "cb3ff8"},
+		{"truncated str8", "d905616263"},
+		{"truncated str16", "da0010"},
+		{"truncated str32", "db00000010616263"},
+		{"truncated array", "92c0"},
+		{"truncated map16", "de0002a161c0"},
+		{"array longer than input", "ddffffffff"},
+		{"map longer than input", "dfffffffff"},
+		{"integer key", "8101c0"},
+		{"nil key", "81c0c0"},
+		{"array key", "8190c0"},
+		{"binary", "c40161"},
+		{"extension", "d40100"},
+		{"never used", "c1"},
+		{"NaN", "cb7ff8000000000001"},
+		{"infinity", "ca7f800000"},
+		{"trailing data", "c0c0"},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.packed)
+		if _, err := MsgpackToJSON(data); !errors.Is(err, ErrInvalidMsgpack) {
+			t.Errorf("%s: got %v, want ErrInvalidMsgpack", tt.name, err)
+		}
+	}
+}
+
+func TestMsgpackDepthLimit(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x91}, depth), 0xc0)
+	}
+	if _, err := MsgpackToJSON(nested(msgpackMaxDepth)); err != nil {
+		t.Fatalf("depth %d: %v", msgpackMaxDepth, err)
+	}
+	if _, err := MsgpackToJSON(nested(msgpackMaxDepth + 1)); !errors.Is(err, ErrInvalidMsgpack) {
+		t.Fatalf("depth %d: got %v, want ErrInvalidMsgpack", msgpackMaxDepth+1, err)
+	}
+}
+
+// BenchmarkMessageEncoding compares marshalling a message to JSON with
+// producing its MessagePack form, which marshals to JSON and converts that.
+func BenchmarkMessageEncoding(b *testing.B) {
+	msg := map[string]interface{}{
+		"action": "chat_message",
+		"data": map[string]interface{}{
+			"email":    "a@example.com",
+			"message":  strings.Repeat("hello ", 20),
+			"room":     "2d7c4c38-7d42-4bb3-9fb1-0f1b1b9a6c1e",
+			"seq":      42,
+			"mentions": []string{"b@example.com"},
+		},
+	}
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := JSONToMsgpack(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func jsonString(n int) string {
+	return `"` + strings.Repeat("a", n) + `"`
+}
+
+func jsonArray(n int) string {
+	return "[" + strings.TrimSuffix(strings.Repeat("0,", n), ",") + "]"
+}
+
+func jsonObject(n int) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(`"k` + strings.Repeat("x", i%7) + hex.EncodeToString([]byte{byte(i >> 16), byte(i >> 8), byte(i)}) + `":0`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	ja, _ := json.Marshal(x)
+	jb, _ := json.Marshal(y)
+	return bytes.Equal(ja, jb)
+}